@@ -0,0 +1,290 @@
+package filecache
+
+import (
+	"errors"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// sketchDepth is the number of rows, i.e. hash functions, in the sketch
+	sketchDepth = 4
+	// sketchMaxCount is where the 4-bit counters of the sketch saturate
+	sketchMaxCount = 15
+	// sketchSampleFactor sets how many accesses, relative to the cache size,
+	// are counted before all the counters are halved
+	sketchSampleFactor = 10
+)
+
+// notAdmittedHold is how long a file which wasn't admitted to the cache is kept
+// around for whoever fetched it
+var notAdmittedHold = time.Minute
+
+// AdmissionPolicy decides whether a freshly downloaded file is worth admitting
+// to a full cache, at the expense of the file the eviction policy would drop
+type AdmissionPolicy interface {
+	// RecordAccess counts a request for a key, whether it was a hit or not
+	RecordAccess(key string)
+	// Admit reports whether candidate should replace victim in the cache
+	Admit(candidate, victim string) bool
+}
+
+// TinyLFU is an AdmissionPolicy which only admits files that were requested
+// more often than the file they would evict. Request frequencies are estimated
+// with a count-min sketch of 4-bit counters, which are halved periodically so
+// that old popularity fades away. This stops one-off scans of many files from
+// flushing the working set out of the cache.
+type TinyLFU struct {
+	lock       sync.Mutex
+	counters   [sketchDepth][]uint8
+	mask       uint64
+	additions  int
+	sampleSize int
+}
+
+// NewTinyLFU returns a TinyLFU sized for a cache holding size files
+func NewTinyLFU(size int) *TinyLFU {
+	width := sketchWidth(size)
+
+	t := &TinyLFU{
+		mask:       uint64(width - 1),
+		sampleSize: sketchSampleFactor * size,
+	}
+	for i := range t.counters {
+		t.counters[i] = make([]uint8, width)
+	}
+
+	return t
+}
+
+// sketchWidth returns the number of counters in each row of the sketch for a
+// cache holding size files, a power of two
+func sketchWidth(size int) int {
+	width := 16
+	for width < size {
+		width <<= 1
+	}
+
+	return width
+}
+
+// Resize sizes the sketch for a cache holding size files, keeping the counts.
+// Keys are indexed by the low bits of their hashes, so growing copies each
+// counter to the new ones its keys may move to, and shrinking keeps the
+// largest of the counters which fold together, neither of which can make an
+// estimate too low.
+func (t *TinyLFU) Resize(size int) {
+	width := sketchWidth(size)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for i, row := range t.counters {
+		resized := make([]uint8, width)
+		for j := range resized {
+			resized[j] = row[j&int(t.mask)]
+		}
+		for j := width; j < len(row); j++ {
+			if row[j] > resized[j&(width-1)] {
+				resized[j&(width-1)] = row[j]
+			}
+		}
+		t.counters[i] = resized
+	}
+	t.mask = uint64(width - 1)
+	t.sampleSize = sketchSampleFactor * size
+	if t.additions >= t.sampleSize {
+		t.reset()
+	}
+}
+
+// indexes returns the counter to use in each row of the sketch for key, using
+// double hashing to derive the row hashes from a single FNV hash
+func (t *TinyLFU) indexes(key string) [sketchDepth]uint64 {
+	hasher := fnv.New64a()
+	// The current implementation of fnv.New64a().Write never returns a non-nil error
+	_, _ = hasher.Write([]byte(key))
+	hash := hasher.Sum64()
+	h1, h2 := hash&0xffffffff, hash>>32
+
+	var indexes [sketchDepth]uint64
+	for i := range indexes {
+		indexes[i] = (h1 + uint64(i)*h2) & t.mask
+	}
+
+	return indexes
+}
+
+// RecordAccess counts a request for key
+func (t *TinyLFU) RecordAccess(key string) {
+	indexes := t.indexes(key)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for i, index := range indexes {
+		if t.counters[i][index] < sketchMaxCount {
+			t.counters[i][index]++
+		}
+	}
+
+	t.additions++
+	if t.additions >= t.sampleSize {
+		t.reset()
+	}
+}
+
+// reset halves every counter, so that the sketch favours recent popularity
+func (t *TinyLFU) reset() {
+	for i := range t.counters {
+		for j := range t.counters[i] {
+			t.counters[i][j] >>= 1
+		}
+	}
+	t.additions /= 2
+}
+
+// Estimate returns the estimated number of recent requests for key
+func (t *TinyLFU) Estimate(key string) int {
+	indexes := t.indexes(key)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	estimate := sketchMaxCount
+	for i, index := range indexes {
+		if count := int(t.counters[i][index]); count < estimate {
+			estimate = count
+		}
+	}
+
+	return estimate
+}
+
+// Admit reports whether the candidate was requested more often than the victim
+func (t *TinyLFU) Admit(candidate, victim string) bool {
+	return t.Estimate(candidate) > t.Estimate(victim)
+}
+
+// Admission installs a filter deciding whether freshly downloaded files are
+// admitted to the cache once it is full. Fetching a file which is not admitted
+// still succeeds, but the file is moved to a temporary path outside of the
+// cache, which GetFileName returns, where it can be read once. It is removed
+// a minute later, or when the last lease taken on it through Pin, Open or
+// OpenStream is released, if that is later. AdmissionStats counts the files
+// which were kept out. Files written with Put are always admitted.
+func Admission(policy AdmissionPolicy) option {
+	return func(c *FileCache) error {
+		if policy == nil {
+			return errors.New("nil admission policy")
+		}
+
+		c.admission = policy
+
+		return nil
+	}
+}
+
+// TinyLFUAdmission installs a TinyLFU admission filter sized for the cache
+func TinyLFUAdmission() option {
+	return func(c *FileCache) error {
+		return Admission(NewTinyLFU(c.size))(c)
+	}
+}
+
+// AdmissionStats returns how many downloaded files the admission filter has
+// admitted to the cache, and how many it rejected
+func (c *FileCache) AdmissionStats() (admitted, rejected uint64) {
+	return atomic.LoadUint64(&c.admitted), atomic.LoadUint64(&c.rejected)
+}
+
+// recordAccess tells the admission filter, if any, about a request for a file
+func (c *FileCache) recordAccess(dr *DownloadRecord) {
+	if c.admission != nil {
+		c.admission.RecordAccess(dr.GetUniqueName())
+	}
+}
+
+// admit asks the admission filter whether a freshly downloaded file may enter
+// the cache. Files replacing a cached copy, or going into a cache with room to
+// spare, don't evict anything and are always admitted.
+func (c *FileCache) admit(dr *DownloadRecord) bool {
+	if c.admission == nil {
+		return true
+	}
+
+	key := dr.GetUniqueName()
+	if c.Cache.Contains(key) || c.Cache.Len() < c.capacity() {
+		atomic.AddUint64(&c.admitted, 1)
+		return true
+	}
+
+	// The policies report their keys with the next one to evict first
+	keys := c.Cache.Keys()
+	if len(keys) == 0 {
+		atomic.AddUint64(&c.admitted, 1)
+		return true
+	}
+
+	victim, _ := keys[0].(string)
+	if c.admission.Admit(key, victim) {
+		atomic.AddUint64(&c.admitted, 1)
+		return true
+	}
+
+	atomic.AddUint64(&c.rejected, 1)
+	return false
+}
+
+// serveOnce moves a file which was not admitted to the cache out of its way, to
+// a temporary path handed to the callers holding a lease on key, and returns
+// that path. Callers without a lease, like those of Fetch, get one which lasts
+// for notAdmittedHold.
+func (c *FileCache) serveOnce(key, storagePath string, progress *downloadProgress) string {
+	transient, err := ioutil.TempFile(filepath.Dir(storagePath), filepath.Base(storagePath)+".once-")
+	if err == nil {
+		transient.Close()
+		err = progress.rename(storagePath, transient.Name())
+		if err != nil {
+			os.Remove(transient.Name())
+		}
+	}
+	if err != nil {
+		log.Errorf("Unable to set '%s' aside, removing it: %s", storagePath, err)
+		os.Remove(storagePath)
+		return storagePath
+	}
+
+	c.pin(key)
+	time.AfterFunc(notAdmittedHold, func() {
+		c.unpin(key)
+	})
+	c.holdTransient(key, transient.Name())
+
+	return transient.Name()
+}
+
+// notAdmittedPath returns where the latest download of a record which wasn't
+// admitted to the cache is held, if it still is
+func (c *FileCache) notAdmittedPath(dr *DownloadRecord) (string, bool) {
+	if c.admission == nil || c.Cache.Contains(dr.GetUniqueName()) {
+		return "", false
+	}
+
+	return c.transient(dr.GetUniqueName())
+}
+
+// scheduleRemoval removes a file which is no longer in the cache once delay is
+// over, unless it has been downloaded again since.
+func (c *FileCache) scheduleRemoval(key, storagePath string, delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		c.removeIfUncached(key, storagePath)
+	})
+}
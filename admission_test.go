@@ -0,0 +1,202 @@
+package filecache
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Admission", func() {
+	Describe("TinyLFU", func() {
+		It("estimates how often keys were requested", func() {
+			tinyLFU := NewTinyLFU(100)
+			for i := 0; i < 5; i++ {
+				tinyLFU.RecordAccess("sauron")
+			}
+			tinyLFU.RecordAccess("saruman")
+
+			Expect(tinyLFU.Estimate("sauron")).To(Equal(5))
+			Expect(tinyLFU.Estimate("saruman")).To(Equal(1))
+			Expect(tinyLFU.Estimate("radagast")).To(Equal(0))
+
+			Expect(tinyLFU.Admit("sauron", "saruman")).To(BeTrue())
+			Expect(tinyLFU.Admit("saruman", "sauron")).To(BeFalse())
+			Expect(tinyLFU.Admit("radagast", "saruman")).To(BeFalse())
+		})
+
+		It("saturates its counters", func() {
+			tinyLFU := NewTinyLFU(1000)
+			for i := 0; i < 100; i++ {
+				tinyLFU.RecordAccess("sauron")
+			}
+
+			Expect(tinyLFU.Estimate("sauron")).To(Equal(15))
+		})
+
+		It("lets old popularity fade away", func() {
+			tinyLFU := NewTinyLFU(2)
+			for i := 0; i < 8; i++ {
+				tinyLFU.RecordAccess("sauron")
+			}
+			Expect(tinyLFU.Estimate("sauron")).To(Equal(8))
+
+			for i := 0; i < 12; i++ {
+				tinyLFU.RecordAccess(fmt.Sprintf("orc-%d", i))
+			}
+			Expect(tinyLFU.Estimate("sauron")).To(BeNumerically("<", 8))
+		})
+
+		It("keeps its counts when resized", func() {
+			tinyLFU := NewTinyLFU(100)
+			for i := 0; i < 5; i++ {
+				tinyLFU.RecordAccess("sauron")
+			}
+
+			tinyLFU.Resize(1000)
+			Expect(tinyLFU.counters[0]).To(HaveLen(1024))
+			Expect(tinyLFU.sampleSize).To(Equal(10000))
+			Expect(tinyLFU.Estimate("sauron")).To(Equal(5))
+
+			tinyLFU.Resize(20)
+			Expect(tinyLFU.counters[0]).To(HaveLen(32))
+			Expect(tinyLFU.Estimate("sauron")).To(Equal(5))
+		})
+	})
+
+	Describe("TinyLFUAdmission()", func() {
+		var (
+			cache   *FileCache
+			baseDir string
+		)
+
+		BeforeEach(func() {
+			var err error
+			baseDir, err = ioutil.TempDir("", "filecache-admission")
+			Expect(err).ShouldNot(HaveOccurred())
+
+			cache, err = New(2, baseDir, TinyLFUAdmission())
+			Expect(err).ShouldNot(HaveOccurred())
+			cache.DownloadFunc = func(dr *DownloadRecord, localPath string) error {
+				Expect(os.MkdirAll(filepath.Dir(localPath), 0755)).To(Succeed())
+				return ioutil.WriteFile(localPath, []byte(dr.Path), 0644)
+			}
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(baseDir)
+		})
+
+		It("keeps the working set when scanning files requested once", func() {
+			hot := []*DownloadRecord{{Path: "mordor/barad-dur.pdf"}, {Path: "mordor/orodruin.pdf"}}
+			for i := 0; i < 3; i++ {
+				for _, dr := range hot {
+					Expect(cache.Fetch(dr)).To(BeTrue())
+				}
+			}
+
+			var scanned *DownloadRecord
+			for i := 1; i < 10; i++ {
+				scanned = &DownloadRecord{Path: fmt.Sprintf("mordor/orc-%d.pdf", i)}
+				Expect(cache.Fetch(scanned)).To(BeTrue())
+			}
+
+			for _, dr := range hot {
+				Expect(cache.Contains(dr)).To(BeTrue())
+			}
+			Expect(cache.Contains(scanned)).To(BeFalse())
+
+			admitted, rejected := cache.AdmissionStats()
+			Expect(admitted).To(BeEquivalentTo(2))
+			Expect(rejected).To(BeEquivalentTo(9))
+		})
+
+		It("serves a file which wasn't admitted from a temporary path for a while", func() {
+			notAdmittedHold = 50 * time.Millisecond
+			defer func() { notAdmittedHold = time.Minute }()
+
+			hot := []*DownloadRecord{{Path: "mordor/barad-dur.pdf"}, {Path: "mordor/orodruin.pdf"}}
+			for i := 0; i < 3; i++ {
+				for _, dr := range hot {
+					Expect(cache.Fetch(dr)).To(BeTrue())
+				}
+			}
+
+			scanned := &DownloadRecord{Path: "mordor/gothmog.pdf"}
+			Expect(cache.Fetch(scanned)).To(BeTrue())
+			Expect(cache.Contains(scanned)).To(BeFalse())
+
+			// Set aside, so nobody mistakes it for a cached copy
+			path := cache.GetFileName(scanned)
+			Expect(path).NotTo(Equal(cache.storagePath(scanned)))
+			Expect(ioutil.ReadFile(path)).To(Equal([]byte(scanned.Path)))
+
+			Eventually(func() string { return path }).ShouldNot(BeAnExistingFile())
+			Expect(cache.GetFileName(scanned)).To(Equal(cache.storagePath(scanned)))
+		})
+
+		It("keeps a file which wasn't admitted until its leases are released", func() {
+			notAdmittedHold = 0
+			defer func() { notAdmittedHold = time.Minute }()
+
+			hot := []*DownloadRecord{{Path: "mordor/barad-dur.pdf"}, {Path: "mordor/orodruin.pdf"}}
+			for i := 0; i < 3; i++ {
+				for _, dr := range hot {
+					Expect(cache.Fetch(dr)).To(BeTrue())
+				}
+			}
+
+			scanned := &DownloadRecord{Path: "mordor/gothmog.pdf"}
+			lease, err := cache.Pin(scanned, 0)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(cache.Contains(scanned)).To(BeFalse())
+
+			Consistently(lease.Path).Should(BeAnExistingFile())
+			Expect(ioutil.ReadFile(lease.Path())).To(Equal([]byte(scanned.Path)))
+
+			lease.Release()
+			Eventually(lease.Path).ShouldNot(BeAnExistingFile())
+		})
+
+		It("lets Open read a file which wasn't admitted", func() {
+			hot := []*DownloadRecord{{Path: "mordor/barad-dur.pdf"}, {Path: "mordor/orodruin.pdf"}}
+			for i := 0; i < 3; i++ {
+				for _, dr := range hot {
+					Expect(cache.Fetch(dr)).To(BeTrue())
+				}
+			}
+
+			scanned := &DownloadRecord{Path: "mordor/gothmog.pdf"}
+			file, err := cache.Open(context.Background(), scanned)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ioutil.ReadAll(file)).To(Equal([]byte(scanned.Path)))
+			Expect(file.Close()).To(Succeed())
+			Expect(cache.Contains(scanned)).To(BeFalse())
+		})
+
+		It("resizes the sketch with the cache", func() {
+			_, err := cache.Resize(100)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Expect(cache.admission.(*TinyLFU).counters[0]).To(HaveLen(128))
+			Expect(cache.admission.(*TinyLFU).sampleSize).To(Equal(1000))
+		})
+
+		It("admits files once they are requested often enough", func() {
+			Expect(cache.Fetch(&DownloadRecord{Path: "mordor/barad-dur.pdf"})).To(BeTrue())
+			Expect(cache.Fetch(&DownloadRecord{Path: "mordor/orodruin.pdf"})).To(BeTrue())
+
+			ring := &DownloadRecord{Path: "mordor/ring.pdf"}
+			Expect(cache.MaybeDownload(ring)).To(Succeed())
+			Expect(cache.Contains(ring)).To(BeFalse())
+
+			Expect(cache.MaybeDownload(ring)).To(Succeed())
+			Expect(cache.Contains(ring)).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,115 @@
+package filecache
+
+import (
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MaxBytes caps the total size of the files in the cache, on top of the
+// number of files it was created for. Once the cache grows past the budget,
+// files are evicted in the order the eviction policy picks until it fits
+// again, always keeping at least one file.
+func MaxBytes(bytes int64) option {
+	return func(c *FileCache) error {
+		if bytes <= 0 {
+			return errors.New("must provide a positive byte budget")
+		}
+
+		c.maxBytes = bytes
+
+		return nil
+	}
+}
+
+// UsedBytes returns the total size of the files in the cache
+func (c *FileCache) UsedBytes() int64 {
+	c.entriesLock.RLock()
+	defer c.entriesLock.RUnlock()
+	return c.usedBytes
+}
+
+// addUsage accounts for a new entry. Must be called with entriesLock held.
+func (c *FileCache) addUsage(entry *cacheEntry) {
+	// Content shared with other entries only takes up space once
+	if entry.blob == "" || c.addBlobRef(entry.blob, entry.size) {
+		c.usedBytes += entry.size
+	}
+
+	if c.partitionFunc != nil {
+		addTo(c.partitions, entry.partition, entry.size)
+	}
+	if entry.identity != "" {
+		addTo(c.identities, entry.identity, c.identityCharge(entry, 1))
+	}
+}
+
+// removeUsage stops accounting for an entry, and returns how many bytes that
+// frees. Must be called with entriesLock held, and followed by
+// removeUnusedBlob for the entry's blob once it is released.
+func (c *FileCache) removeUsage(entry *cacheEntry) int64 {
+	if entry.identity != "" {
+		removeFrom(c.identities, entry.identity, c.identityCharge(entry, -1))
+	}
+	removeFrom(c.partitions, entry.partition, entry.size)
+
+	freed := entry.size
+	if entry.blob != "" && !c.removeBlobRef(entry.blob) {
+		freed = 0
+	}
+	c.usedBytes -= freed
+
+	return freed
+}
+
+// addTo accounts for a file of the given size in usages[name]
+func addTo(usages map[string]*PartitionUsage, name string, size int64) {
+	usage, ok := usages[name]
+	if !ok {
+		usage = &PartitionUsage{}
+		usages[name] = usage
+	}
+	usage.Bytes += size
+	usage.Entries++
+}
+
+// removeFrom stops accounting for a file of the given size in usages[name]
+func removeFrom(usages map[string]*PartitionUsage, name string, size int64) {
+	usage, ok := usages[name]
+	if !ok {
+		return
+	}
+	usage.Bytes -= size
+	usage.Entries--
+	if usage.Entries <= 0 {
+		delete(usages, name)
+	}
+}
+
+// enforceBudgets evicts files until the identity and the partition of a
+// freshly added record, and then the whole cache, fit in their budgets again
+func (c *FileCache) enforceBudgets(dr *DownloadRecord) {
+	if c.identityQuota > 0 && len(dr.Args) > 0 {
+		c.enforceIdentityQuota(dr.HashedArgs)
+	}
+	if c.partitionFunc != nil {
+		c.enforcePartitionBudget(c.partitionOf(dr))
+	}
+	c.enforceMaxBytes()
+}
+
+// enforceMaxBytes evicts files until the cache fits in its byte budget
+func (c *FileCache) enforceMaxBytes() {
+	maxBytes := c.byteBudget()
+	if maxBytes <= 0 {
+		return
+	}
+
+	order := c.newEvictionOrder(nil)
+	for c.UsedBytes() > maxBytes && c.Cache.Len() > 1 {
+		log.Debugf("Evicting to stay within %d bytes", maxBytes)
+		if !order.evictNext(EvictionCapacity) {
+			return
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package filecache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Byte budget", func() {
+	var (
+		cache   *FileCache
+		baseDir string
+	)
+
+	BeforeEach(func() {
+		var err error
+		baseDir, err = ioutil.TempDir("", "filecache-capacity")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		cache, err = New(10, baseDir, MaxBytes(250))
+		Expect(err).ShouldNot(HaveOccurred())
+		cache.DownloadFunc = func(dr *DownloadRecord, localPath string) error {
+			Expect(os.MkdirAll(filepath.Dir(localPath), 0755)).To(Succeed())
+			return ioutil.WriteFile(localPath, bytes.Repeat([]byte("x"), 100), 0644)
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(baseDir)
+	})
+
+	It("rejects empty budgets", func() {
+		_, err := New(10, baseDir, MaxBytes(0))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("tracks the size of the cached files", func() {
+		dr := &DownloadRecord{Path: "erebor/thorin.pdf"}
+		Expect(cache.Fetch(dr)).To(BeTrue())
+		Expect(cache.UsedBytes()).To(Equal(int64(100)))
+
+		cache.Cache.Remove(dr.GetUniqueName())
+		Expect(cache.UsedBytes()).To(Equal(int64(0)))
+	})
+
+	It("evicts files to stay within the budget", func() {
+		first := &DownloadRecord{Path: "erebor/thorin.pdf"}
+		Expect(cache.Fetch(first)).To(BeTrue())
+		Expect(cache.Fetch(&DownloadRecord{Path: "erebor/fili.pdf"})).To(BeTrue())
+		Expect(cache.Fetch(&DownloadRecord{Path: "erebor/kili.pdf"})).To(BeTrue())
+
+		Expect(cache.UsedBytes()).To(Equal(int64(200)))
+		Expect(cache.Contains(first)).To(BeFalse())
+		_, err := os.Stat(cache.GetFileName(first))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("counts replaced files once", func() {
+		dr := &DownloadRecord{Path: "erebor/thorin.pdf"}
+		Expect(cache.Fetch(dr)).To(BeTrue())
+		Expect(cache.Reload(dr)).To(BeTrue())
+		Expect(cache.UsedBytes()).To(Equal(int64(100)))
+	})
+})
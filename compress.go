@@ -0,0 +1,471 @@
+package filecache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// compressedMagic starts the header of every file stored with Compression
+	// on. It is followed by the length of the codec's name, the name, and the
+	// uncompressed size. Compressed files then hold their contents in chunks
+	// compressed on their own, followed by the offset of each chunk, so that
+	// reads anywhere in the file only decompress from the chunk they start in.
+	compressedMagic = "\x00FCZ"
+	// compressedChunkSize is how much of the contents each chunk holds
+	compressedChunkSize = 128 * 1024
+	// identityCodecName is the codec of files stored as they are, in one piece
+	identityCodecName = "identity"
+)
+
+// Codec compresses and decompresses cached files. Besides GzipCodec and
+// ZstdCodec, any compression format can be used by implementing it.
+type Codec interface {
+	// Name identifies the codec in the files it compressed
+	Name() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// GzipCodec compresses files with gzip
+var GzipCodec Codec = gzipCodec{}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return "gzip" }
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// ZstdCodec compresses files with zstd, which compresses about as well as gzip
+// but decompresses several times faster
+var ZstdCodec Codec = zstdCodec{}
+
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string { return "zstd" }
+
+func (zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	// Chunks are small, one goroutine is plenty
+	return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+}
+
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
+
+// identityCodec stores files as they are, behind the same header as compressed
+// ones, so that the two are never mistaken for each other
+type identityCodec struct{}
+
+func (identityCodec) Name() string { return identityCodecName }
+
+func (identityCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (identityCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(r), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// CompressionRule says how to store files of some content types
+type CompressionRule struct {
+	// ContentTypes are matched as prefixes of a file's MIME type, so "text/"
+	// covers all text. A rule without any applies to every file.
+	ContentTypes []string
+	Codec        Codec
+	// MinRatio is the smallest ratio of the original size to the compressed
+	// size worth keeping. Files which compress less are stored as they are.
+	MinRatio float64
+}
+
+// matches reports whether the rule applies to a content type
+func (r *CompressionRule) matches(contentType string) bool {
+	if len(r.ContentTypes) == 0 {
+		return true
+	}
+	for _, prefix := range r.ContentTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Compression stores files compressed on disk, with the codec of the first
+// rule matching their content type. The content type is the one reported by
+// the origin, or else guessed from the file extension or the contents. Every
+// stored file starts with a header naming its codec, including those stored
+// as they are. Open and OpenStream decompress files transparently, which is
+// the only way to read them: FileName and Lease.FileName fail with
+// ErrNoLocalPath. UsedBytes and the byte budgets count the compressed size.
+func Compression(rules ...CompressionRule) option {
+	return func(c *FileCache) error {
+		if len(rules) == 0 {
+			return errors.New("must provide at least one compression rule")
+		}
+
+		codecs := make(map[string]Codec)
+		for _, rule := range rules {
+			if rule.Codec == nil {
+				return errors.New("nil compression codec")
+			}
+			if len(rule.Codec.Name()) == 0 || len(rule.Codec.Name()) > math.MaxUint8 ||
+				rule.Codec.Name() == identityCodecName {
+				return fmt.Errorf("invalid compression codec name %q", rule.Codec.Name())
+			}
+			if rule.MinRatio < 0 {
+				return errors.New("minimum compression ratio can't be negative")
+			}
+			codecs[rule.Codec.Name()] = rule.Codec
+		}
+
+		c.compression = rules
+		c.codecs = codecs
+
+		return nil
+	}
+}
+
+// storesEncoded reports whether files are stored in a form which only Open can
+// read
+func (c *FileCache) storesEncoded() bool {
+	return len(c.codecs) > 0 || c.keys != nil
+}
+
+// contentType returns the MIME type of a file about to be stored, without its
+// parameters
+func contentType(dr *DownloadRecord, file io.ReaderAt) string {
+	head := make([]byte, sniffLength)
+	n, _ := file.ReadAt(head, 0)
+
+	return mediaType(detectContentType(dr, head[:n]))
+}
+
+// compress compresses a file about to be stored, if a rule says so, and
+// returns the path of the file to move into place: a copy next to the
+// original, behind a compression header, which the caller must remove if it
+// isn't moved. Without Compression, it returns the original.
+func (c *FileCache) compress(dr *DownloadRecord, file *os.File) (string, error) {
+	if len(c.compression) == 0 {
+		return file.Name(), nil
+	}
+
+	var rule *CompressionRule
+	kind := contentType(dr, file)
+	for i := range c.compression {
+		if c.compression[i].matches(kind) {
+			rule = &c.compression[i]
+			break
+		}
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("could not stat file to compress: %s", err)
+	}
+	if rule == nil || info.Size() == 0 {
+		return storeWith(dr, file, identityCodec{}, info.Size())
+	}
+
+	compressed, err := storeWith(dr, file, rule.Codec, info.Size())
+	if err != nil {
+		return "", err
+	}
+
+	compressedInfo, err := os.Stat(compressed)
+	if err != nil {
+		os.Remove(compressed)
+		return "", fmt.Errorf("could not compress %s: %s", dr.Path, err)
+	}
+	if float64(info.Size()) < rule.MinRatio*float64(compressedInfo.Size()) {
+		log.Debugf("%s only compresses to %d bytes from %d, storing it as is", dr.Path, compressedInfo.Size(), info.Size())
+		os.Remove(compressed)
+		return storeWith(dr, file, identityCodec{}, info.Size())
+	}
+
+	return compressed, nil
+}
+
+// storeWith writes a file through codec into a new file next to it, and
+// returns its name
+func storeWith(dr *DownloadRecord, file *os.File, codec Codec, size int64) (string, error) {
+	stored, err := ioutil.TempFile(filepath.Dir(file.Name()), filepath.Base(file.Name())+".compress-")
+	if err != nil {
+		return "", fmt.Errorf("could not create compressed file: %s", err)
+	}
+	defer stored.Close()
+
+	err = writeCompressed(stored, codec, io.NewSectionReader(file, 0, size), size)
+	if err != nil {
+		os.Remove(stored.Name())
+		return "", fmt.Errorf("could not compress %s: %s", dr.Path, err)
+	}
+
+	return stored.Name(), nil
+}
+
+// writeCompressed writes the header and the compressed contents of a file,
+// chunk by chunk, then the chunk index
+func writeCompressed(w io.Writer, codec Codec, r io.Reader, size int64) error {
+	header := bytes.NewBufferString(compressedMagic)
+	header.WriteByte(byte(len(codec.Name())))
+	header.WriteString(codec.Name())
+	binary.Write(header, binary.BigEndian, size)
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return err
+	}
+
+	if codec.Name() == identityCodecName {
+		_, err := io.Copy(w, r)
+		return err
+	}
+
+	counter := &countingWriter{w: w}
+	offsets := make([]int64, 0, chunkCount(size))
+	for remaining := size; remaining > 0; remaining -= compressedChunkSize {
+		offsets = append(offsets, counter.n)
+
+		writer, err := codec.NewWriter(counter)
+		if err != nil {
+			return err
+		}
+		if _, err := io.CopyN(writer, r, minInt64(remaining, compressedChunkSize)); err != nil {
+			writer.Close()
+			return err
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+	}
+
+	return binary.Write(w, binary.BigEndian, offsets)
+}
+
+// chunkCount returns how many chunks contents of the given size take
+func chunkCount(size int64) int64 {
+	return (size + compressedChunkSize - 1) / compressedChunkSize
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// storedFile is a cached file opened for reading its contents, which may be
+// compressed or encrypted
+type storedFile struct {
+	file   *os.File
+	data   io.ReaderAt // The file, decrypted if need be
+	codec  Codec       // Nil when the data isn't compressed
+	size   int64       // Of the contents
+	start  int64       // Where the compressed data starts
+	chunks []int64     // Offsets of the compressed chunks from start, then of the index
+}
+
+// openStored opens a cached file and reads its encryption and compression
+// headers, if any
+func (c *FileCache) openStored(dr *DownloadRecord, path string) (*storedFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := &storedFile{file: file, data: file}
+	err = c.readEncryptionHeader(dr, stored)
+	if err == nil {
+		err = c.readHeader(stored)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return stored, nil
+}
+
+// openPartial opens a download in progress, which is neither compressed nor
+// encrypted yet
+func openPartial(path string) (*storedFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &storedFile{file: file, data: file, size: info.Size()}, nil
+}
+
+// readHeader fills in how a file's data is compressed. With Compression on,
+// every stored file has a header, so one without is an error.
+func (c *FileCache) readHeader(stored *storedFile) error {
+	if len(c.codecs) == 0 {
+		return nil
+	}
+
+	head := make([]byte, len(compressedMagic)+1)
+	n, _ := stored.data.ReadAt(head, 0)
+	if n < len(head) || string(head[:len(compressedMagic)]) != compressedMagic {
+		return errors.New("missing compression header")
+	}
+
+	name := make([]byte, head[len(compressedMagic)])
+	var size int64
+	section := io.NewSectionReader(stored.data, int64(len(head)), int64(len(name))+8)
+	if _, err := io.ReadFull(section, name); err != nil {
+		return fmt.Errorf("could not read compression header: %s", err)
+	}
+	if err := binary.Read(section, binary.BigEndian, &size); err != nil {
+		return fmt.Errorf("could not read compression header: %s", err)
+	}
+
+	start := int64(len(head)) + int64(len(name)) + 8
+	if string(name) == identityCodecName {
+		stored.data = io.NewSectionReader(stored.data, start, size)
+		stored.size = size
+		return nil
+	}
+
+	codec, ok := c.codecs[string(name)]
+	if !ok {
+		return fmt.Errorf("file was compressed with unknown codec %q", name)
+	}
+
+	// The index is at the very end, and points at the chunks
+	count := chunkCount(size)
+	indexStart := stored.size - count*8
+	if size < 0 || indexStart < start {
+		return errors.New("compressed file is truncated")
+	}
+	chunks := make([]int64, count, count+1)
+	index := io.NewSectionReader(stored.data, indexStart, count*8)
+	if err := binary.Read(index, binary.BigEndian, chunks); err != nil {
+		return fmt.Errorf("could not read compression index: %s", err)
+	}
+	chunks = append(chunks, indexStart-start)
+
+	stored.codec = codec
+	stored.size = size
+	stored.start = start
+	stored.chunks = chunks
+
+	return nil
+}
+
+// decoder returns a reader of the decompressed contents, starting at offset.
+// Only the chunk offset falls in is decompressed up to it.
+func (s *storedFile) decoder(offset int64) (io.ReadCloser, error) {
+	reader := &chunkedReader{stored: s, chunk: int(offset / compressedChunkSize)}
+	if _, err := io.CopyN(ioutil.Discard, reader, offset%compressedChunkSize); err != nil {
+		reader.Close()
+		return nil, fmt.Errorf("could not decompress %s: %s", s.file.Name(), err)
+	}
+
+	return reader, nil
+}
+
+// chunkedReader decompresses a stored file's chunks one after the other
+type chunkedReader struct {
+	stored  *storedFile
+	chunk   int           // The next chunk to decompress
+	current io.ReadCloser // Nil between chunks
+}
+
+func (r *chunkedReader) Read(b []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if r.chunk >= len(r.stored.chunks)-1 {
+				return 0, io.EOF
+			}
+
+			start, end := r.stored.chunks[r.chunk], r.stored.chunks[r.chunk+1]
+			if end < start {
+				return 0, errors.New("corrupt compression index")
+			}
+			section := io.NewSectionReader(r.stored.data, r.stored.start+start, end-start)
+			reader, err := r.stored.codec.NewReader(section)
+			if err != nil {
+				return 0, err
+			}
+			r.current = reader
+			r.chunk++
+		}
+
+		n, err := r.current.Read(b)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunkedReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	err := r.current.Close()
+	r.current = nil
+	return err
+}
+
+// contentSize returns the size of a cached file's contents
+func (c *FileCache) contentSize(dr *DownloadRecord, path string) (int64, error) {
+	stored, err := c.openStored(dr, path)
+	if err != nil {
+		return 0, err
+	}
+	defer stored.file.Close()
+
+	return stored.size, nil
+}
@@ -0,0 +1,228 @@
+package filecache
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Compression", func() {
+	var (
+		cache    *FileCache
+		baseDir  string
+		contents map[string][]byte
+		chunks   chan []byte
+	)
+
+	text := []byte(strings.Repeat("Three Rings for the Elven-kings under the sky. ", 200))
+	noise := make([]byte, 4096)
+	rand.Read(noise)
+
+	download := func(dr *DownloadRecord, localFile *os.File) error {
+		writer := dr.progress.writer(localFile)
+		if chunks != nil {
+			for chunk := range chunks {
+				writer.Write(chunk)
+			}
+			return nil
+		}
+		_, err := writer.Write(contents[dr.Path])
+		return err
+	}
+
+	BeforeEach(func() {
+		var err error
+		baseDir, err = ioutil.TempDir("", "filecache-compress")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		contents = map[string][]byte{
+			"rivendell/rings.txt":  text,
+			"rivendell/rings.json": text,
+			"rivendell/noise.txt":  noise,
+		}
+		chunks = nil
+
+		cache, err = New(10, baseDir, Compression(
+			CompressionRule{ContentTypes: []string{"text/"}, Codec: GzipCodec, MinRatio: 2},
+		))
+		Expect(err).ShouldNot(HaveOccurred())
+		stubDownloads(cache, download)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(baseDir)
+	})
+
+	It("stores matching files compressed and reads them back", func() {
+		dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "rivendell/rings.txt"}
+		Expect(cache.Fetch(dr)).To(BeTrue())
+
+		stored, err := ioutil.ReadFile(cache.storagePath(dr))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(string(stored[:len(compressedMagic)])).To(Equal(compressedMagic))
+		Expect(len(stored)).To(BeNumerically("<", len(text)/10))
+		Expect(cache.UsedBytes()).To(Equal(int64(len(stored))))
+
+		file, err := cache.Open(context.Background(), dr)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer file.Close()
+
+		Expect(file.Size()).To(Equal(int64(len(text))))
+		Expect(ioutil.ReadAll(file)).To(Equal(text))
+	})
+
+	It("fetches compressed files but doesn't hand out paths to them", func() {
+		dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "rivendell/rings.txt"}
+		Expect(cache.Fetch(dr)).To(BeTrue())
+		Expect(cache.GetFileName(dr)).To(BeAnExistingFile())
+		_, err := cache.FileName(dr)
+		Expect(err).To(Equal(ErrNoLocalPath))
+
+		lease, err := cache.Pin(dr, 0)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer lease.Release()
+
+		Expect(lease.Path()).To(Equal(cache.GetFileName(dr)))
+		_, err = lease.FileName()
+		Expect(err).To(Equal(ErrNoLocalPath))
+	})
+
+	It("seeks in compressed files", func() {
+		dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "rivendell/rings.txt"}
+		file, err := cache.Open(context.Background(), dr)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer file.Close()
+
+		_, err = file.Seek(-10, io.SeekEnd)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(ioutil.ReadAll(file)).To(Equal(text[len(text)-10:]))
+
+		buf := make([]byte, 11)
+		_, err = file.ReadAt(buf, 6)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(string(buf)).To(Equal("Rings for t"))
+	})
+
+	It("reads compressed files anywhere without decompressing them from the start", func() {
+		large := []byte(strings.Repeat("One Ring to rule them all, One Ring to find them. ", 8000))
+		contents["mordor/inscription.txt"] = large
+		dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "mordor/inscription.txt"}
+
+		file, err := cache.Open(context.Background(), dr)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer file.Close()
+		Expect(file.stored.chunks).To(HaveLen(int(chunkCount(int64(len(large)))) + 1))
+
+		// Across the boundary between two chunks
+		buf := make([]byte, 100)
+		_, err = file.ReadAt(buf, compressedChunkSize-50)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(buf).To(Equal(large[compressedChunkSize-50 : compressedChunkSize+50]))
+
+		_, err = file.ReadAt(buf, int64(len(large)-100))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(buf).To(Equal(large[len(large)-100:]))
+
+		Expect(ioutil.ReadAll(file)).To(Equal(large))
+	})
+
+	// storedAsIs checks that a file was stored uncompressed, behind a header
+	storedAsIs := func(dr *DownloadRecord, expected []byte) {
+		stored, err := ioutil.ReadFile(cache.storagePath(dr))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(string(stored[:len(compressedMagic)])).To(Equal(compressedMagic))
+		Expect(stored).To(HaveSuffix(string(expected)))
+
+		file, err := cache.Open(context.Background(), dr)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer file.Close()
+		Expect(file.Size()).To(Equal(int64(len(expected))))
+		Expect(ioutil.ReadAll(file)).To(Equal(expected))
+	}
+
+	It("compresses files with zstd", func() {
+		var err error
+		cache, err = New(10, baseDir, Compression(CompressionRule{Codec: ZstdCodec}))
+		Expect(err).ShouldNot(HaveOccurred())
+		stubDownloads(cache, download)
+		large := []byte(strings.Repeat("One Ring to rule them all, One Ring to find them. ", 8000))
+		contents["mordor/inscription.txt"] = large
+		dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "mordor/inscription.txt"}
+
+		file, err := cache.Open(context.Background(), dr)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer file.Close()
+		Expect(file.stored.codec.Name()).To(Equal("zstd"))
+		Expect(cache.UsedBytes()).To(BeNumerically("<", len(large)/10))
+
+		buf := make([]byte, 100)
+		_, err = file.ReadAt(buf, compressedChunkSize-50)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(buf).To(Equal(large[compressedChunkSize-50 : compressedChunkSize+50]))
+		Expect(ioutil.ReadAll(file)).To(Equal(large))
+	})
+
+	It("stores files which don't match any rule as they are", func() {
+		dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "rivendell/rings.json"}
+		Expect(cache.Fetch(dr)).To(BeTrue())
+
+		storedAsIs(dr, text)
+	})
+
+	It("stores files which don't compress well enough as they are", func() {
+		dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "rivendell/noise.txt"}
+		Expect(cache.Fetch(dr)).To(BeTrue())
+
+		storedAsIs(dr, noise)
+	})
+
+	It("doesn't mistake files which look like compressed ones", func() {
+		impostor := []byte(compressedMagic + "\x04gzip not really")
+		contents["rivendell/impostor.bin"] = impostor
+		dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "rivendell/impostor.bin"}
+		Expect(cache.Fetch(dr)).To(BeTrue())
+
+		storedAsIs(dr, impostor)
+	})
+
+	It("refuses stored files without a header", func() {
+		dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "rivendell/rings.json"}
+		Expect(cache.Fetch(dr)).To(BeTrue())
+		Expect(ioutil.WriteFile(cache.storagePath(dr), text, 0644)).To(Succeed())
+
+		_, err := cache.Open(context.Background(), dr)
+		Expect(err).To(MatchError(ContainSubstring("missing compression header")))
+	})
+
+	It("streams files which get compressed once downloaded", func() {
+		chunks = make(chan []byte)
+		dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "rivendell/rings.txt"}
+
+		reader, err := cache.OpenStream(context.Background(), dr)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer reader.Close()
+
+		chunks <- text[:100]
+		buf := make([]byte, 100)
+		_, err = io.ReadFull(reader, buf)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(buf).To(Equal(text[:100]))
+
+		chunks <- text[100:]
+		close(chunks)
+		Eventually(func() bool { return cache.Contains(dr) }).Should(BeTrue())
+
+		Expect(ioutil.ReadAll(reader)).To(Equal(text[100:]))
+	})
+
+	It("rejects rules without a codec", func() {
+		_, err := New(10, baseDir, Compression(CompressionRule{}))
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,180 @@
+package filecache
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sniffLength is how much of a file content type detection looks at
+const sniffLength = 512
+
+// genericContentTypes are what origins report when they don't know better
+var genericContentTypes = map[string]bool{
+	"":                         true,
+	"application/octet-stream": true,
+	"binary/octet-stream":      true,
+}
+
+// preferredExtensions picks among the extensions registered for common types,
+// where the first one isn't the obvious choice
+var preferredExtensions = map[string]string{
+	"text/plain":               ".txt",
+	"text/html":                ".html",
+	"image/jpeg":               ".jpg",
+	"application/octet-stream": "",
+}
+
+// ExtensionFromContentType names cached files with the extension registered
+// for their content type, instead of keeping the last few characters of the
+// path. The record's own extension is kept when it matches the content type.
+// Since the type is only known once a file is downloaded, GetFileName returns
+// where a cached file actually is, and the usual name for other files.
+func ExtensionFromContentType() option {
+	return func(c *FileCache) error {
+		c.typedNames = true
+
+		return nil
+	}
+}
+
+// ContentType returns the content type of a cached file: the one reported by
+// the origin, or else the one guessed from its path or contents
+func (c *FileCache) ContentType(dr *DownloadRecord) (string, bool) {
+	c.entriesLock.RLock()
+	defer c.entriesLock.RUnlock()
+
+	entry, ok := c.entries[dr.GetUniqueName()]
+	if !ok || entry.info.ContentType == "" {
+		return "", false
+	}
+
+	return entry.info.ContentType, true
+}
+
+// mediaType strips the parameters from a content type
+func mediaType(contentType string) string {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+// detectContentType returns the content type reported by the origin for a
+// record, unless it is a generic one, and otherwise guesses it from the
+// record's extension or from the start of the contents
+func detectContentType(dr *DownloadRecord, head []byte) string {
+	if dr.Info != nil && !genericContentTypes[mediaType(dr.Info.ContentType)] {
+		return dr.Info.ContentType
+	}
+
+	if contentType := mime.TypeByExtension(path.Ext(dr.Path)); !genericContentTypes[mediaType(contentType)] {
+		return contentType
+	}
+
+	return http.DetectContentType(head)
+}
+
+// storedContentType returns the content type of a file which was just stored
+func (c *FileCache) storedContentType(dr *DownloadRecord, storagePath string) string {
+	if dr.Info != nil && !genericContentTypes[mediaType(dr.Info.ContentType)] {
+		return dr.Info.ContentType
+	}
+
+	head := make([]byte, sniffLength)
+	n := 0
+	stored, err := c.openStored(dr, storagePath)
+	if err == nil {
+		n, err = readHead(stored, head)
+		stored.file.Close()
+	}
+	if err != nil {
+		log.Warnf("Unable to read %s to detect its content type: %s", dr.Path, err)
+	}
+
+	return detectContentType(dr, head[:n])
+}
+
+// readHead reads the start of a stored file's contents into head
+func readHead(stored *storedFile, head []byte) (int, error) {
+	var reader io.Reader = io.NewSectionReader(stored.data, 0, stored.size)
+	if stored.codec != nil {
+		decoder, err := stored.decoder(0)
+		if err != nil {
+			return 0, err
+		}
+		defer decoder.Close()
+		reader = decoder
+	}
+
+	n, err := io.ReadFull(reader, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+
+	return n, err
+}
+
+// extensionFor returns the extension to store a record's file with, given its
+// content type
+func (c *FileCache) extensionFor(dr *DownloadRecord, contentType string) string {
+	kind := mediaType(contentType)
+
+	ext := path.Ext(dr.Path)
+	if ext != "" && mediaType(mime.TypeByExtension(ext)) == kind {
+		return ext
+	}
+
+	if ext, ok := preferredExtensions[kind]; ok {
+		if ext == "" {
+			return c.DefaultExtension
+		}
+		return ext
+	}
+
+	if exts, err := mime.ExtensionsByType(kind); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+
+	return c.DefaultExtension
+}
+
+// placeByContentType moves a freshly stored file to the name matching its
+// content type, when ExtensionFromContentType is set, and returns where it is
+func (c *FileCache) placeByContentType(dr *DownloadRecord, storagePath, contentType string, progress *downloadProgress) string {
+	if !c.typedNames {
+		return storagePath
+	}
+
+	typedPath := c.fileName(dr, c.extensionFor(dr, contentType))
+	if typedPath == storagePath {
+		return storagePath
+	}
+
+	key := dr.GetUniqueName()
+	if !c.isPinned(key) {
+		err := progress.rename(storagePath, typedPath)
+		if err != nil {
+			log.Warnf("Unable to move %s to '%s', keeping it at '%s': %s", dr.Path, typedPath, storagePath, err)
+			return storagePath
+		}
+		return typedPath
+	}
+
+	// Leases handed out the old name, so it goes with the last of them
+	err := progress.link(storagePath, typedPath)
+	if err != nil {
+		log.Warnf("Unable to move %s to '%s', keeping it at '%s': %s", dr.Path, typedPath, storagePath, err)
+		return storagePath
+	}
+	if !c.holdTransient(key, storagePath) {
+		os.Remove(storagePath)
+	}
+
+	return typedPath
+}
@@ -0,0 +1,174 @@
+package filecache
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Content types", func() {
+	var (
+		cache    *FileCache
+		baseDir  string
+		reported map[string]string
+	)
+
+	png := []byte("\x89PNG\x0D\x0A\x1A\x0A" + strings.Repeat("\x00", 32))
+
+	newCache := func(opts ...option) {
+		var err error
+		cache, err = New(10, baseDir, opts...)
+		Expect(err).ShouldNot(HaveOccurred())
+		stubDownloads(cache, func(dr *DownloadRecord, localFile *os.File) error {
+			if contentType, ok := reported[dr.Path]; ok {
+				dr.Info = &ObjectInfo{ContentType: contentType}
+			}
+			_, err := localFile.Write(png)
+			return err
+		})
+	}
+
+	BeforeEach(func() {
+		var err error
+		baseDir, err = ioutil.TempDir("", "filecache-contenttype")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		reported = map[string]string{
+			"shire/map.bin":        "image/png",
+			"shire/generic.bin":    "application/octet-stream",
+			"shire/letter":         "text/plain; charset=utf-8",
+			"shire/frodo.png":      "image/png",
+			"shire/misnamed.jpeg1": "image/png",
+		}
+		newCache()
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(baseDir)
+	})
+
+	It("records the content type reported by the origin", func() {
+		dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "shire/letter"}
+		Expect(cache.Fetch(dr)).To(BeTrue())
+
+		contentType, _ := cache.ContentType(dr)
+		Expect(contentType).To(Equal("text/plain; charset=utf-8"))
+	})
+
+	It("sniffs the content type when the origin's is generic or missing", func() {
+		generic := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "shire/generic.bin"}
+		missing := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "shire/unreported"}
+		Expect(cache.Fetch(generic)).To(BeTrue())
+		Expect(cache.Fetch(missing)).To(BeTrue())
+
+		contentType, _ := cache.ContentType(generic)
+		Expect(contentType).To(Equal("image/png"))
+		contentType, _ = cache.ContentType(missing)
+		Expect(contentType).To(Equal("image/png"))
+	})
+
+	It("doesn't know the content type of files which aren't cached", func() {
+		_, ok := cache.ContentType(&DownloadRecord{Manager: DownloadMangerDropbox, Path: "shire/letter"})
+		Expect(ok).To(BeFalse())
+	})
+
+	It("hands the content type to open files", func() {
+		file, err := cache.Open(context.Background(), &DownloadRecord{Manager: DownloadMangerDropbox, Path: "shire/map.bin"})
+		Expect(err).ShouldNot(HaveOccurred())
+		defer file.Close()
+
+		Expect(file.ContentType()).To(Equal("image/png"))
+	})
+
+	It("keeps the path's extension by default", func() {
+		dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "shire/map.bin"}
+		Expect(cache.Fetch(dr)).To(BeTrue())
+
+		Expect(filepath.Ext(cache.GetFileName(dr))).To(Equal(".bin"))
+	})
+
+	Context("with extensions from content types", func() {
+		BeforeEach(func() {
+			newCache(ExtensionFromContentType())
+		})
+
+		It("names files after their content type", func() {
+			dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "shire/misnamed.jpeg1"}
+			Expect(filepath.Ext(cache.GetFileName(dr))).To(Equal(cache.DefaultExtension))
+
+			Expect(cache.Fetch(dr)).To(BeTrue())
+
+			Expect(filepath.Ext(cache.GetFileName(dr))).To(Equal(".png"))
+			Expect(cache.GetFileName(dr)).To(BeAnExistingFile())
+			Expect(ioutil.ReadFile(cache.GetFileName(dr))).To(Equal(png))
+		})
+
+		It("keeps extensions which match the content type", func() {
+			dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "shire/frodo.png"}
+			Expect(cache.Fetch(dr)).To(BeTrue())
+
+			Expect(filepath.Ext(cache.GetFileName(dr))).To(Equal(".png"))
+		})
+
+		It("uses the preferred extension of common types", func() {
+			dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "shire/letter"}
+			Expect(cache.Fetch(dr)).To(BeTrue())
+
+			Expect(filepath.Ext(cache.GetFileName(dr))).To(Equal(".txt"))
+		})
+
+		It("doesn't leave the old file behind when the type changes", func() {
+			dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "shire/misnamed.jpeg1"}
+			Expect(cache.Fetch(dr)).To(BeTrue())
+			oldPath := cache.GetFileName(dr)
+
+			reported["shire/misnamed.jpeg1"] = "text/plain"
+			Expect(cache.Reload(dr)).To(BeTrue())
+
+			Expect(cache.GetFileName(dr)).NotTo(Equal(oldPath))
+			Expect(cache.GetFileName(dr)).To(BeAnExistingFile())
+			Expect(oldPath).NotTo(BeAnExistingFile())
+			contentType, _ := cache.ContentType(dr)
+			Expect(contentType).To(Equal("text/plain"))
+		})
+
+		It("keeps the old file for leases until they are released", func() {
+			dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "shire/misnamed.jpeg1"}
+			Expect(cache.Fetch(dr)).To(BeTrue())
+
+			for _, refresh := range []func(dr *DownloadRecord) error{
+				cache.Revalidate,
+				func(dr *DownloadRecord) error {
+					if !cache.Reload(dr) {
+						return errors.New("reload failed")
+					}
+					return nil
+				},
+			} {
+				lease, err := cache.Pin(dr, 0)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				contentType := "text/plain"
+				if filepath.Ext(lease.Path()) == ".txt" {
+					contentType = "image/png"
+				}
+				reported["shire/misnamed.jpeg1"] = contentType
+				Expect(refresh(dr)).To(Succeed())
+
+				Expect(cache.GetFileName(dr)).NotTo(Equal(lease.Path()))
+				Expect(cache.GetFileName(dr)).To(BeAnExistingFile())
+				Expect(lease.Path()).To(BeAnExistingFile())
+
+				lease.Release()
+				Expect(lease.Path()).NotTo(BeAnExistingFile())
+				Expect(cache.GetFileName(dr)).To(BeAnExistingFile())
+			}
+		})
+	})
+})
@@ -0,0 +1,284 @@
+package filecache
+
+import (
+	"container/heap"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// estimatedBytesPerSecond is the download speed assumed when costing a file
+// whose download was never timed, such as one written with Put
+const estimatedBytesPerSecond = 50 * 1024 * 1024
+
+// refetchCost returns what it would cost, in seconds, to download a cached
+// file again, along with the room it takes up. The cost is the time its last
+// download took, or an estimate based on its size when that wasn't measured.
+func (c *FileCache) refetchCost(key interface{}) (float64, int64) {
+	filename, _ := key.(string)
+
+	c.entriesLock.RLock()
+	entry, ok := c.entries[filename]
+	c.entriesLock.RUnlock()
+
+	if !ok {
+		return 0, 0
+	}
+
+	if entry.fetchCost > 0 {
+		return entry.fetchCost.Seconds(), entry.size
+	}
+
+	return float64(entry.size) / estimatedBytesPerSecond, entry.size
+}
+
+// costAwareItem is an entry of the cost-aware policy
+type costAwareItem struct {
+	key      interface{}
+	value    interface{}
+	priority float64
+	size     int64  // Breaks ties, larger files go first
+	sequence uint64 // Breaks remaining ties, older uses go first
+	index    int    // In the heap
+}
+
+// costAwareHeap orders items with the next one to evict at the root
+type costAwareHeap []*costAwareItem
+
+func (h costAwareHeap) Len() int { return len(h) }
+
+func (h costAwareHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority < h[j].priority
+	}
+	if h[i].size != h[j].size {
+		return h[i].size > h[j].size
+	}
+	return h[i].sequence < h[j].sequence
+}
+
+func (h costAwareHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *costAwareHeap) Push(x interface{}) {
+	item := x.(*costAwareItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *costAwareHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// costAwarePolicy is a GreedyDual policy. Every use sets an entry's priority
+// to the current inflation level plus its cost, which the cache reports as the
+// time it would take to fetch it again, and the entry with the lowest priority
+// is evicted, raising the inflation level to its priority. An expensive file
+// therefore outlives cheap ones, but only for as long as it keeps being used:
+// entries which are left alone fall behind as the level rises. Size only
+// breaks ties, as in GreedyDual-Size, evicting the larger of equally costly
+// files, so it never outweighs a measured cost. With equal costs and sizes,
+// this is plain LRU.
+type costAwarePolicy struct {
+	lock      sync.Mutex
+	size      int
+	items     map[interface{}]*costAwareItem
+	heap      costAwareHeap
+	inflation float64
+	sequence  uint64
+	cost      func(key interface{}) (float64, int64)
+	onEvict   func(key, value interface{})
+}
+
+func newCostAwarePolicy(size int, onEvict func(key, value interface{}), cost func(key interface{}) (float64, int64)) *costAwarePolicy {
+	return &costAwarePolicy{
+		size:    size,
+		items:   make(map[interface{}]*costAwareItem),
+		cost:    cost,
+		onEvict: onEvict,
+	}
+}
+
+// touch counts a use of the item, recomputing its priority. Must be called
+// locked.
+func (p *costAwarePolicy) touch(item *costAwareItem) {
+	item.priority = p.inflation
+	if p.cost != nil {
+		cost, size := p.cost(item.key)
+		item.priority += cost
+		item.size = size
+	}
+	p.sequence++
+	item.sequence = p.sequence
+}
+
+// removeOldest drops the item with the lowest priority. Must be called locked.
+func (p *costAwarePolicy) removeOldest() (*costAwareItem, bool) {
+	if len(p.heap) == 0 {
+		return nil, false
+	}
+
+	item := heap.Pop(&p.heap).(*costAwareItem)
+	delete(p.items, item.key)
+	if item.priority > p.inflation {
+		p.inflation = item.priority
+	}
+
+	return item, true
+}
+
+func (p *costAwarePolicy) Add(key, value interface{}) bool {
+	p.lock.Lock()
+	if item, ok := p.items[key]; ok {
+		item.value = value
+		p.touch(item)
+		heap.Fix(&p.heap, item.index)
+		p.lock.Unlock()
+		return false
+	}
+
+	var evicted []evictedEntry
+	if len(p.items) >= p.size {
+		if item, ok := p.removeOldest(); ok {
+			evicted = append(evicted, evictedEntry{item.key, item.value})
+		}
+	}
+
+	item := &costAwareItem{key: key, value: value}
+	p.touch(item)
+	p.items[key] = item
+	heap.Push(&p.heap, item)
+	p.lock.Unlock()
+
+	notifyEvicted(p.onEvict, evicted)
+
+	return len(evicted) > 0
+}
+
+func (p *costAwarePolicy) Get(key interface{}) (interface{}, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	item, ok := p.items[key]
+	if !ok {
+		return nil, false
+	}
+	p.touch(item)
+	heap.Fix(&p.heap, item.index)
+
+	return item.value, true
+}
+
+func (p *costAwarePolicy) Peek(key interface{}) (interface{}, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	item, ok := p.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	return item.value, true
+}
+
+func (p *costAwarePolicy) Contains(key interface{}) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	_, ok := p.items[key]
+	return ok
+}
+
+func (p *costAwarePolicy) Remove(key interface{}) {
+	p.lock.Lock()
+	item, ok := p.items[key]
+	if ok {
+		heap.Remove(&p.heap, item.index)
+		delete(p.items, key)
+	}
+	p.lock.Unlock()
+
+	if ok {
+		notifyEvicted(p.onEvict, []evictedEntry{{item.key, item.value}})
+	}
+}
+
+func (p *costAwarePolicy) RemoveOldest() (interface{}, interface{}, bool) {
+	p.lock.Lock()
+	item, ok := p.removeOldest()
+	p.lock.Unlock()
+
+	if !ok {
+		return nil, nil, false
+	}
+	notifyEvicted(p.onEvict, []evictedEntry{{item.key, item.value}})
+
+	return item.key, item.value, true
+}
+
+// Keys returns the keys in eviction order, the next one to be evicted first
+func (p *costAwarePolicy) Keys() []interface{} {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	items := make(costAwareHeap, len(p.heap))
+	copy(items, p.heap)
+	sort.Slice(items, func(i, j int) bool { return items.Less(i, j) })
+
+	keys := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		keys = append(keys, item.key)
+	}
+
+	return keys
+}
+
+func (p *costAwarePolicy) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.items)
+}
+
+func (p *costAwarePolicy) Purge() {
+	var evicted []evictedEntry
+
+	p.lock.Lock()
+	for _, item := range p.items {
+		evicted = append(evicted, evictedEntry{item.key, item.value})
+	}
+	p.items = make(map[interface{}]*costAwareItem)
+	p.heap = nil
+	p.inflation = 0
+	p.lock.Unlock()
+
+	notifyEvicted(p.onEvict, evicted)
+}
+
+// Resize changes the size, evicting the entries which are cheapest to fetch
+// again until the rest fit
+func (p *costAwarePolicy) Resize(size int) (int, error) {
+	if size <= 0 {
+		return 0, errors.New("must provide a positive size")
+	}
+
+	var evicted []evictedEntry
+
+	p.lock.Lock()
+	p.size = size
+	for len(p.items) > p.size {
+		item, _ := p.removeOldest()
+		evicted = append(evicted, evictedEntry{item.key, item.value})
+	}
+	p.lock.Unlock()
+
+	notifyEvicted(p.onEvict, evicted)
+
+	return len(evicted), nil
+}
@@ -0,0 +1,141 @@
+package filecache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cost-aware eviction", func() {
+	var (
+		evicted []interface{}
+		onEvict = func(key, value interface{}) { evicted = append(evicted, key) }
+		costs   map[interface{}]float64
+		cost    = func(key interface{}) (float64, int64) { return costs[key], 0 }
+	)
+
+	BeforeEach(func() {
+		evicted = nil
+		costs = map[interface{}]float64{}
+	})
+
+	It("keeps files which are expensive to fetch over recent cheap ones", func() {
+		policy := newCostAwarePolicy(2, onEvict, cost)
+		costs["cross-region.tar"] = 40
+		costs["local.json"] = 0.01
+		costs["other.json"] = 0.01
+
+		policy.Add("cross-region.tar", 1)
+		policy.Add("local.json", 2)
+		policy.Add("other.json", 3)
+
+		Expect(evicted).To(ConsistOf("local.json"))
+		Expect(policy.Contains("cross-region.tar")).To(BeTrue())
+	})
+
+	It("eventually evicts expensive files which are no longer used", func() {
+		policy := newCostAwarePolicy(2, onEvict, cost)
+		costs["cross-region.tar"] = 3
+
+		policy.Add("cross-region.tar", 1)
+		for i := 0; i < 10; i++ {
+			costs[i] = 1
+			policy.Add(i, i)
+			policy.Get(i)
+		}
+
+		Expect(evicted).To(ContainElement("cross-region.tar"))
+	})
+
+	It("behaves like LRU when costs are equal", func() {
+		policy := newCostAwarePolicy(2, onEvict, nil)
+
+		policy.Add("frodo", 1)
+		policy.Add("sam", 2)
+		policy.Get("frodo")
+		policy.Add("gollum", 3)
+
+		Expect(evicted).To(ConsistOf("sam"))
+		Expect(policy.Keys()).To(Equal([]interface{}{"frodo", "gollum"}))
+	})
+
+	It("weighs files by their measured download time", func() {
+		baseDir, err := ioutil.TempDir("", "filecache-cost")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(baseDir)
+
+		cache, err := New(2, baseDir, Eviction(EvictCostAware))
+		Expect(err).ShouldNot(HaveOccurred())
+		cache.DownloadFunc = func(dr *DownloadRecord, localPath string) error {
+			if strings.HasPrefix(dr.Path, "slow/") {
+				time.Sleep(20 * time.Millisecond)
+			}
+			Expect(os.MkdirAll(filepath.Dir(localPath), 0755)).To(Succeed())
+			return ioutil.WriteFile(localPath, []byte(dr.Path), 0644)
+		}
+
+		slow := &DownloadRecord{Path: "slow/mordor.tar"}
+		fast := &DownloadRecord{Path: "fast/shire.json"}
+		Expect(cache.Fetch(slow)).To(BeTrue())
+		Expect(cache.Fetch(fast)).To(BeTrue())
+		Expect(cache.Fetch(&DownloadRecord{Path: "fast/bree.json"})).To(BeTrue())
+
+		Expect(cache.Contains(slow)).To(BeTrue())
+		Expect(cache.Contains(fast)).To(BeFalse())
+	})
+
+	It("keeps large files which are slow to fetch over small local ones", func() {
+		cache, err := New(2, os.TempDir(), Eviction(EvictCostAware))
+		Expect(err).ShouldNot(HaveOccurred())
+		cache.entries["cross-region.tar"] = &cacheEntry{size: 3 << 30, fetchCost: 40 * time.Second}
+		cache.entries["local.json"] = &cacheEntry{size: 50 << 10, fetchCost: 50 * time.Millisecond}
+		cache.entries["other.json"] = &cacheEntry{size: 50 << 10, fetchCost: 50 * time.Millisecond}
+
+		for _, key := range []string{"cross-region.tar", "local.json", "other.json"} {
+			cache.Cache.Add(key, key)
+		}
+
+		Expect(cache.Cache.Contains("cross-region.tar")).To(BeTrue())
+		Expect(cache.Cache.Contains("local.json")).To(BeFalse())
+	})
+
+	It("evicts the larger of equally costly files first", func() {
+		policy := newCostAwarePolicy(3, onEvict, func(key interface{}) (float64, int64) {
+			return 1, map[interface{}]int64{"small": 1, "large": 1 << 20}[key]
+		})
+		policy.Add("small", 1)
+		policy.Add("large", 2)
+
+		Expect(policy.Keys()).To(Equal([]interface{}{"large", "small"}))
+	})
+
+	It("only charges the transfer from the origin to the refetch cost", func() {
+		baseDir, err := ioutil.TempDir("", "filecache-cost")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(baseDir)
+
+		cache, err := New(2, baseDir, Eviction(EvictCostAware))
+		Expect(err).ShouldNot(HaveOccurred())
+		stubDownloads(cache, func(dr *DownloadRecord, localFile *os.File) error {
+			_, err := localFile.WriteString("bree")
+			return err
+		})
+		cache.DownloadFunc = func(dr *DownloadRecord, localPath string) error {
+			// Everything around the transfer is slow
+			time.Sleep(50 * time.Millisecond)
+			return cache.download(dr, localPath)
+		}
+
+		dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "bree/pony.json"}
+		Expect(cache.Fetch(dr)).To(BeTrue())
+
+		Expect(cache.entries[dr.GetUniqueName()].fetchCost).To(BeNumerically("<", 50*time.Millisecond))
+		seconds, _ := cache.refetchCost("isengard.json")
+		Expect(seconds).To(BeZero())
+	})
+})
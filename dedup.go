@@ -0,0 +1,196 @@
+package filecache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// blobsDir is where content-addressed blobs live, under BaseDir
+const blobsDir = "blobs"
+
+// blob is a file stored once for every key with the same contents
+type blob struct {
+	refs       int
+	size       int64
+	identities map[string]int // References by the files of each identity
+}
+
+// ContentAddressed stores every file once per distinct contents, in a blob
+// store under BaseDir named after the SHA-256 of the contents. Each key's file
+// becomes a hard link to its blob, so identical files fetched for different
+// records, or for different credentials of the same record, share the disk
+// space. Blobs are reference counted and deleted along with their last key,
+// and UsedBytes and MaxBytes count them only once. So do IdentityUsage and
+// IdentityQuota for each identity, whose files may share a blob with those of
+// other identities, each of which is charged for it. Partition usage is still
+// charged to every key. Files which can't be linked, e.g. on file systems
+// without hard links, are stored on their own as before.
+func ContentAddressed() option {
+	return func(c *FileCache) error {
+		c.blobs = make(map[string]*blob)
+
+		return nil
+	}
+}
+
+// BlobCount returns the number of distinct files in the content-addressed
+// store
+func (c *FileCache) BlobCount() int {
+	c.entriesLock.RLock()
+	defer c.entriesLock.RUnlock()
+	return len(c.blobs)
+}
+
+// blobPath returns where the blob with the given SHA-256 is stored
+func (c *FileCache) blobPath(sum string) string {
+	return filepath.Join(c.BaseDir, blobsDir, sum[:2], sum)
+}
+
+// contentSum returns the hex SHA-256 of a file, using the digest it was
+// verified against when that is one
+func contentSum(storagePath string, digest *Digest) (string, error) {
+	if digest != nil && digest.Algorithm == DigestSHA256 {
+		return hex.EncodeToString(digest.Value), nil
+	}
+
+	file, err := os.Open(storagePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// linkBlob makes storagePath a link to the blob for its contents, creating the
+// blob if this is the first file with them, and returns the blob's sum. It
+// returns an empty sum when the file couldn't be linked and stays on its own.
+// Must be called with blobsLock held, and kept until the reference is counted,
+// so that the blob can't be deleted in the meantime.
+func (c *FileCache) linkBlob(storagePath, sum string) string {
+	blobPath := c.blobPath(sum)
+
+	c.entriesLock.RLock()
+	_, ok := c.blobs[sum]
+	c.entriesLock.RUnlock()
+
+	if ok {
+		// Swap our copy for a link to the blob
+		link := fmt.Sprintf("%s.link-%s", storagePath, sum[:8])
+		err := os.Link(blobPath, link)
+		if err == nil {
+			err = os.Rename(link, storagePath)
+		}
+		if err != nil {
+			os.Remove(link)
+			log.Warnf("Unable to share blob %s with '%s', storing it separately: %s", sum, storagePath, err)
+			return ""
+		}
+
+		return sum
+	}
+
+	// Anything there is left over from an earlier run
+	os.Remove(blobPath)
+
+	err := os.MkdirAll(filepath.Dir(blobPath), 0755)
+	if err == nil {
+		err = os.Link(storagePath, blobPath)
+	}
+	if err != nil {
+		log.Warnf("Unable to store '%s' as blob %s, storing it separately: %s", storagePath, sum, err)
+		return ""
+	}
+
+	return sum
+}
+
+// addBlobRef counts a new reference to a blob, and reports whether it is the
+// first one. Must be called with entriesLock held.
+func (c *FileCache) addBlobRef(sum string, size int64) bool {
+	b, ok := c.blobs[sum]
+	if !ok {
+		b = &blob{size: size}
+		c.blobs[sum] = b
+	}
+	b.refs++
+
+	return !ok
+}
+
+// identityCharge counts a reference to an entry's blob by the entry's identity,
+// or drops one when delta is negative, and returns the bytes that adds to or
+// removes from the identity's usage: none if another of its files shares the
+// blob. Must be called with entriesLock held, while the blob is referenced.
+func (c *FileCache) identityCharge(entry *cacheEntry, delta int) int64 {
+	b, ok := c.blobs[entry.blob]
+	if !ok {
+		return entry.size
+	}
+
+	if b.identities == nil {
+		b.identities = make(map[string]int)
+	}
+	refs := b.identities[entry.identity]
+	b.identities[entry.identity] = refs + delta
+	if refs+delta <= 0 {
+		delete(b.identities, entry.identity)
+	}
+
+	if refs == 0 || refs+delta == 0 {
+		return entry.size
+	}
+	return 0
+}
+
+// removeBlobRef drops a reference to a blob, and reports whether it was the
+// last one. The blob itself is deleted by removeUnusedBlob, once entriesLock
+// is released. Must be called with entriesLock held.
+func (c *FileCache) removeBlobRef(sum string) bool {
+	b, ok := c.blobs[sum]
+	if !ok {
+		return false
+	}
+	b.refs--
+	if b.refs > 0 {
+		return false
+	}
+
+	delete(c.blobs, sum)
+
+	return true
+}
+
+// removeUnusedBlob deletes a blob which lost its last reference, unless a new
+// file was linked to it in the meantime. Must be called without entriesLock.
+func (c *FileCache) removeUnusedBlob(sum string) {
+	if sum == "" {
+		return
+	}
+
+	c.blobsLock.Lock()
+	defer c.blobsLock.Unlock()
+
+	c.entriesLock.RLock()
+	_, ok := c.blobs[sum]
+	c.entriesLock.RUnlock()
+	if ok {
+		return
+	}
+
+	err := os.Remove(c.blobPath(sum))
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("Unable to remove blob %s: %s", sum, err)
+	}
+}
@@ -0,0 +1,180 @@
+package filecache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ContentAddressed", func() {
+	var (
+		cache     *FileCache
+		baseDir   string
+		downloads int32
+	)
+
+	BeforeEach(func() {
+		var err error
+		baseDir, err = ioutil.TempDir("", "filecache-dedup")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		downloads = 0
+		cache, err = New(10, baseDir, ContentAddressed())
+		Expect(err).ShouldNot(HaveOccurred())
+		stubDownloads(cache, func(dr *DownloadRecord, localFile *os.File) error {
+			atomic.AddInt32(&downloads, 1)
+			contents := "the one ring"
+			if dr.Path == "mordor/other.pdf" {
+				contents = "a lesser ring"
+			}
+			_, err := localFile.WriteString(contents)
+			return err
+		})
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(baseDir)
+	})
+
+	record := func(path string, user string) *DownloadRecord {
+		dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: path}
+		if user != "" {
+			dr.Args = map[string]string{"user": user}
+			dr.HashedArgs = user
+		}
+		return dr
+	}
+
+	It("stores identical files once", func() {
+		first := record("mordor/ring.pdf", "frodo")
+		second := record("mordor/ring.pdf", "sam")
+		third := record("shire/ring.pdf", "")
+
+		for _, dr := range []*DownloadRecord{first, second, third} {
+			Expect(cache.Fetch(dr)).To(BeTrue())
+			Expect(ioutil.ReadFile(cache.GetFileName(dr))).To(Equal([]byte("the one ring")))
+		}
+
+		Expect(cache.BlobCount()).To(Equal(1))
+		Expect(cache.UsedBytes()).To(Equal(int64(len("the one ring"))))
+
+		firstInfo, err := os.Stat(cache.GetFileName(first))
+		Expect(err).ShouldNot(HaveOccurred())
+		secondInfo, err := os.Stat(cache.GetFileName(second))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(os.SameFile(firstInfo, secondInfo)).To(BeTrue())
+	})
+
+	It("keeps distinct contents apart", func() {
+		Expect(cache.Fetch(record("mordor/ring.pdf", ""))).To(BeTrue())
+		Expect(cache.Fetch(record("mordor/other.pdf", ""))).To(BeTrue())
+
+		Expect(cache.BlobCount()).To(Equal(2))
+		Expect(cache.UsedBytes()).To(Equal(int64(len("the one ring") + len("a lesser ring"))))
+	})
+
+	It("deletes a blob with its last reference", func() {
+		first := record("mordor/ring.pdf", "frodo")
+		second := record("mordor/ring.pdf", "sam")
+		Expect(cache.Fetch(first)).To(BeTrue())
+		Expect(cache.Fetch(second)).To(BeTrue())
+		blobPath := cache.blobPath(cache.entries[first.GetUniqueName()].blob)
+
+		cache.Remove(first)
+		Expect(blobPath).To(BeAnExistingFile())
+		Expect(cache.UsedBytes()).To(Equal(int64(len("the one ring"))))
+		Expect(ioutil.ReadFile(cache.GetFileName(second))).To(Equal([]byte("the one ring")))
+
+		cache.Remove(second)
+		Expect(blobPath).ShouldNot(BeAnExistingFile())
+		Expect(cache.BlobCount()).To(Equal(0))
+		Expect(cache.UsedBytes()).To(BeZero())
+	})
+
+	It("keeps the blob when a file is downloaded again", func() {
+		dr := record("mordor/ring.pdf", "")
+		Expect(cache.Fetch(dr)).To(BeTrue())
+		Expect(cache.Revalidate(dr)).To(Succeed())
+
+		Expect(cache.BlobCount()).To(Equal(1))
+		Expect(cache.UsedBytes()).To(Equal(int64(len("the one ring"))))
+		Expect(ioutil.ReadFile(cache.GetFileName(dr))).To(Equal([]byte("the one ring")))
+	})
+
+	It("shares blobs safely between concurrent downloads and evictions", func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(user string) {
+				defer GinkgoRecover()
+				defer wg.Done()
+
+				for j := 0; j < 10; j++ {
+					dr := record(fmt.Sprintf("mordor/ring-%d.pdf", j), user)
+					Expect(cache.Fetch(dr)).To(BeTrue())
+					if j%3 == 0 {
+						cache.Remove(dr)
+					}
+				}
+			}(fmt.Sprintf("hobbit-%d", i))
+		}
+		wg.Wait()
+
+		// Whatever is left must still be readable, and stored once
+		Expect(cache.BlobCount()).To(Equal(1))
+		Expect(cache.UsedBytes()).To(Equal(int64(len("the one ring"))))
+		for _, entry := range cache.entries {
+			Expect(ioutil.ReadFile(cache.GetFileName(&entry.record))).To(Equal([]byte("the one ring")))
+			Expect(cache.blobPath(entry.blob)).To(BeAnExistingFile())
+		}
+	})
+
+	It("tells when each key was downloaded, though they share a file", func() {
+		frodo := record("mordor/ring.pdf", "frodo")
+		sam := record("mordor/ring.pdf", "sam")
+		Expect(cache.Fetch(frodo)).To(BeTrue())
+		hourAgo := time.Now().Add(-time.Hour)
+		Expect(os.Chtimes(cache.GetFileName(frodo), hourAgo, hourAgo)).To(Succeed())
+
+		minuteAgo := time.Now().Add(-time.Minute)
+		for i := 0; i < 2; i++ {
+			_, err := cache.FetchNewerThanStatus(sam, minuteAgo)
+			Expect(err).ShouldNot(HaveOccurred())
+		}
+		Expect(atomic.LoadInt32(&downloads)).To(BeEquivalentTo(2))
+	})
+
+	It("doesn't freshen other keys when one is revalidated", func() {
+		now := time.Now().Add(-time.Hour)
+		var err error
+		cache, err = New(10, baseDir, ContentAddressed(), Clock(func() time.Time { return now }))
+		Expect(err).ShouldNot(HaveOccurred())
+		stubDownloads(cache, func(dr *DownloadRecord, localFile *os.File) error {
+			atomic.AddInt32(&downloads, 1)
+			dr.Info = &ObjectInfo{ETag: "precious"}
+			if dr.Validators != nil {
+				return ErrNotModified
+			}
+			_, err := localFile.WriteString("the one ring")
+			return err
+		})
+		frodo := record("mordor/ring.pdf", "frodo")
+		sam := record("mordor/ring.pdf", "sam")
+		Expect(cache.Fetch(frodo)).To(BeTrue())
+		Expect(cache.Fetch(sam)).To(BeTrue())
+
+		now = time.Now()
+		Expect(cache.Revalidate(frodo)).To(Succeed())
+		Expect(atomic.LoadInt32(&downloads)).To(BeEquivalentTo(3))
+
+		_, err = cache.FetchNewerThanStatus(sam, now.Add(-30*time.Minute))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(atomic.LoadInt32(&downloads)).To(BeEquivalentTo(4))
+	})
+})
@@ -0,0 +1,161 @@
+package filecache
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// deletion is an evicted file waiting to be deleted from disk
+type deletion struct {
+	key         string
+	storagePath string
+	size        int64
+}
+
+// AsyncDeletion moves the deletion of evicted files off the request path, onto
+// a background queue holding up to queueSize files. When the queue is full,
+// files are deleted straight away, as they are without a queue. Files waiting
+// in the queue are reported by PendingDeletionBytes and counted as free space
+// by DiskWatermarks, so that they don't cause more evictions. Close() deletes
+// whatever is still queued.
+func AsyncDeletion(queueSize int) option {
+	return func(c *FileCache) error {
+		if queueSize <= 0 {
+			return errors.New("must provide a positive deletion queue size")
+		}
+
+		c.deletions = make(chan deletion, queueSize)
+		c.deleterDone = make(chan struct{})
+
+		return nil
+	}
+}
+
+// PendingDeletionBytes returns the size of the evicted files which are still
+// on disk, waiting in the deletion queue
+func (c *FileCache) PendingDeletionBytes() int64 {
+	return atomic.LoadInt64(&c.pending)
+}
+
+// deleteFile deletes an evicted file, in the background if we can, unless we
+// are reclaiming disk space. Either way, the file is kept if it was downloaded
+// again in the meantime.
+func (c *FileCache) deleteFile(key, storagePath string, size int64) {
+	c.deletionsLock.Lock()
+	if c.deletions != nil && !c.deletionsClosed && atomic.LoadInt32(&c.reclaiming) == 0 {
+		atomic.AddInt64(&c.pending, size)
+		select {
+		case c.deletions <- deletion{key: key, storagePath: storagePath, size: size}:
+			c.deletionsLock.Unlock()
+			return
+		default:
+			atomic.AddInt64(&c.pending, -size)
+			log.Debugf("Deletion queue is full, deleting '%s' right away", key)
+		}
+	}
+	c.deletionsLock.Unlock()
+
+	c.removeIfUncached(key, storagePath)
+}
+
+// runDeleter deletes the queued files until the queue is closed
+func (c *FileCache) runDeleter() {
+	defer close(c.deleterDone)
+
+	for queued := range c.deletions {
+		// The file may have been downloaded again while it was queued
+		c.removeIfUncached(queued.key, queued.storagePath)
+
+		atomic.AddInt64(&c.pending, -queued.size)
+	}
+}
+
+// flushDeletions closes the deletion queue, if any, and waits for the files in
+// it to be deleted. Files evicted afterwards are deleted straight away.
+func (c *FileCache) flushDeletions() {
+	c.deletionsLock.Lock()
+	if c.deletions == nil || c.deletionsClosed {
+		c.deletionsLock.Unlock()
+		return
+	}
+	c.deletionsClosed = true
+	close(c.deletions)
+	c.deletionsLock.Unlock()
+
+	<-c.deleterDone
+}
+
+// removeIfUncached deletes a file unless it was downloaded again since it left
+// the cache. Files which are being downloaded again are left to the download,
+// which removes them if it doesn't end up in the cache.
+func (c *FileCache) removeIfUncached(key, storagePath string) {
+	for {
+		c.WaitLock.Lock()
+		waitChan, busy := c.Waiting[key]
+		if !busy {
+			break
+		}
+		removing := c.removals[key]
+		c.WaitLock.Unlock()
+
+		if !removing {
+			return
+		}
+		// Another file of the same key is being removed
+		<-waitChan
+	}
+
+	// Claimed like a download, so that none can land while the file goes
+	c.Waiting[key] = make(chan struct{})
+	c.removals[key] = true
+	c.releaseWaiting(key, storagePath)
+}
+
+// releaseWaiting gives up our claim on key in Waiting, first deleting the file
+// at storagePath if it is no longer cached there, like an evicted copy which
+// was left for us to replace and we didn't. The claim stops a new download
+// from landing until the file is gone. Must be called with WaitLock held,
+// which it releases.
+func (c *FileCache) releaseWaiting(key, storagePath string) {
+	remove := c.isUncached(key, storagePath)
+	c.WaitLock.Unlock()
+
+	if remove {
+		log.Debugf("Removing '%s', which is no longer cached", key)
+		unlink(storagePath)
+	}
+
+	c.WaitLock.Lock()
+	close(c.Waiting[key]) // Notify anyone waiting on us
+	delete(c.Waiting, key)
+	delete(c.removals, key)
+	c.WaitLock.Unlock()
+}
+
+// isUncached reports whether a file of key can be deleted: it isn't the cached
+// copy, and isn't pinned. Pinned files are deleted once they are released. Must
+// be called with WaitLock held, and key claimed in Waiting.
+func (c *FileCache) isUncached(key, storagePath string) bool {
+	// Files can move when their content type changes, leaving the old name
+	if cachedPath, ok := c.Cache.Peek(key); ok && cachedPath == storagePath {
+		return false
+	}
+
+	if c.deferIfPinned(key, storagePath) {
+		log.Debugf("Not removing '%s' yet, it is pinned", key)
+		return false
+	}
+
+	return true
+}
+
+// unlink deletes a file, unless it is already gone
+func unlink(path string) {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("Unable to remove '%s': %s", path, err)
+	}
+}
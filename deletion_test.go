@@ -0,0 +1,165 @@
+package filecache
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Asynchronous deletion", func() {
+	var (
+		cache   *FileCache
+		baseDir string
+		records []*DownloadRecord
+	)
+
+	BeforeEach(func() {
+		var err error
+		baseDir, err = ioutil.TempDir("", "filecache-deletion")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		cache, err = New(10, baseDir, AsyncDeletion(1))
+		Expect(err).ShouldNot(HaveOccurred())
+		cache.DownloadFunc = func(dr *DownloadRecord, localPath string) error {
+			Expect(os.MkdirAll(filepath.Dir(localPath), 0755)).To(Succeed())
+			return ioutil.WriteFile(localPath, []byte("mithril"), 0644)
+		}
+
+		records = nil
+		for i := 0; i < 3; i++ {
+			dr := &DownloadRecord{Path: fmt.Sprintf("moria/file-%d.pdf", i)}
+			Expect(cache.Fetch(dr)).To(BeTrue())
+			records = append(records, dr)
+		}
+	})
+
+	AfterEach(func() {
+		cache.Close()
+		os.RemoveAll(baseDir)
+	})
+
+	existing := func() int {
+		count := 0
+		for _, dr := range records {
+			if _, err := os.Stat(cache.GetFileName(dr)); err == nil {
+				count++
+			}
+		}
+		return count
+	}
+
+	It("rejects empty queues", func() {
+		_, err := New(10, baseDir, AsyncDeletion(0))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("deletes evicted files in the background", func() {
+		// The deleter needs WaitLock, so this holds it up
+		cache.WaitLock.Lock()
+		cache.Remove(records[0])
+
+		Expect(cache.Contains(records[0])).To(BeFalse())
+		Expect(cache.GetFileName(records[0])).To(BeAnExistingFile())
+		Expect(cache.PendingDeletionBytes()).To(Equal(int64(len("mithril"))))
+		Expect(cache.UsedBytes()).To(Equal(int64(2 * len("mithril"))))
+
+		cache.WaitLock.Unlock()
+		Eventually(func() string { return cache.GetFileName(records[0]) }).ShouldNot(BeAnExistingFile())
+		Eventually(cache.PendingDeletionBytes).Should(Equal(int64(0)))
+	})
+
+	It("deletes files right away when the queue is full", func() {
+		cache.WaitLock.Lock()
+		removed := make(chan struct{})
+		go func() {
+			for _, dr := range records {
+				cache.Remove(dr)
+			}
+			close(removed)
+		}()
+
+		// Checking that the files weren't downloaded again needs WaitLock too
+		Consistently(removed).ShouldNot(BeClosed())
+		cache.WaitLock.Unlock()
+		Eventually(removed).Should(BeClosed())
+
+		// One file may be with the deleter and one in the queue
+		Expect(existing()).To(BeNumerically("<=", 2))
+	})
+
+	It("deletes everything queued on Close", func() {
+		for _, dr := range records {
+			cache.Remove(dr)
+		}
+		cache.Close()
+
+		Expect(existing()).To(Equal(0))
+		Expect(cache.PendingDeletionBytes()).To(Equal(int64(0)))
+	})
+
+	It("doesn't delete files which were cached again in the meantime", func() {
+		cache.WaitLock.Lock()
+		cache.Remove(records[0])
+		cache.Cache.Add(records[0].GetUniqueName(), cache.GetFileName(records[0]))
+		cache.WaitLock.Unlock()
+		cache.Close()
+
+		Expect(cache.GetFileName(records[0])).To(BeAnExistingFile())
+	})
+
+	It("leaves files which are being downloaded again to the download", func() {
+		started := make(chan struct{})
+		release := make(chan struct{})
+		cache.DownloadFunc = func(dr *DownloadRecord, localPath string) error {
+			close(started)
+			<-release
+			return errors.New("the doors of Durin are shut")
+		}
+
+		// Evicted, but not deleted yet
+		dr := &DownloadRecord{Path: "moria/balin.pdf"}
+		Expect(os.MkdirAll(filepath.Dir(cache.GetFileName(dr)), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(cache.GetFileName(dr), []byte("mithril"), 0644)).To(Succeed())
+
+		fetched := make(chan error, 1)
+		go func() { fetched <- cache.MaybeDownload(dr) }()
+		<-started
+
+		cache.removeIfUncached(dr.GetUniqueName(), cache.GetFileName(dr))
+		Expect(cache.GetFileName(dr)).To(BeAnExistingFile())
+
+		close(release)
+		Expect(<-fetched).To(HaveOccurred())
+		Expect(cache.GetFileName(dr)).NotTo(BeAnExistingFile())
+	})
+
+	It("waits for other removals of the same file", func() {
+		dr := &DownloadRecord{Path: "moria/balin.pdf"}
+		key := dr.GetUniqueName()
+		Expect(os.MkdirAll(filepath.Dir(cache.GetFileName(dr)), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(cache.GetFileName(dr), []byte("mithril"), 0644)).To(Succeed())
+
+		// As if an older copy were being removed
+		cache.WaitLock.Lock()
+		cache.Waiting[key] = make(chan struct{})
+		cache.removals[key] = true
+		cache.WaitLock.Unlock()
+
+		removed := make(chan struct{})
+		go func() {
+			cache.removeIfUncached(key, cache.GetFileName(dr))
+			close(removed)
+		}()
+		Consistently(removed).ShouldNot(BeClosed())
+
+		cache.WaitLock.Lock()
+		cache.releaseWaiting(key, filepath.Join(baseDir, "balin-old.pdf"))
+		Eventually(removed).Should(BeClosed())
+		Expect(cache.GetFileName(dr)).NotTo(BeAnExistingFile())
+	})
+})
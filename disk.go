@@ -0,0 +1,197 @@
+package filecache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DiskWatermarks keeps an eye on the volume the cache writes to, which other
+// tenants may be filling too. Whenever more than high of the volume is in use,
+// as a fraction between 0 and 1, files are evicted in the order the eviction
+// policy picks until no more than low of it is. The volume is checked before
+// each download, and every interval in the background if interval is
+// positive, until Close() is called.
+func DiskWatermarks(high, low float64, interval time.Duration) option {
+	return func(c *FileCache) error {
+		if low <= 0 || high > 1 || low > high {
+			return fmt.Errorf("invalid disk watermarks %v/%v: need 0 < low <= high <= 1", low, high)
+		}
+		if interval < 0 {
+			return errors.New("negative disk check interval")
+		}
+
+		c.diskHigh = high
+		c.diskLow = low
+		c.diskInterval = interval
+
+		return nil
+	}
+}
+
+// MaxBytesPercent sets MaxBytes to a percentage of the size of the volume
+// holding the cache's base directory
+func MaxBytesPercent(percent float64) option {
+	return func(c *FileCache) error {
+		if percent <= 0 || percent > 100 {
+			return fmt.Errorf("invalid volume percentage %v", percent)
+		}
+
+		total, _, err := c.volumeUsage(existingParent(c.BaseDir))
+		if err != nil {
+			return fmt.Errorf("could not get size of volume: %s", err)
+		}
+
+		return MaxBytes(int64(float64(total) * percent / 100))(c)
+	}
+}
+
+// existingParent returns path, or its closest ancestor which exists, so that
+// the volume can be inspected before the cache directory is created
+func existingParent(path string) string {
+	for {
+		_, err := os.Stat(path)
+		parent := filepath.Dir(path)
+		if err == nil || parent == path {
+			return path
+		}
+		path = parent
+	}
+}
+
+// diskUsed returns the fraction of the cache's volume which is in use, not
+// counting the files queued for deletion
+func (c *FileCache) diskUsed() (float64, error) {
+	total, free, err := c.volumeUsage(existingParent(c.BaseDir))
+	if err != nil {
+		return 0, err
+	}
+	if total == 0 {
+		return 0, nil
+	}
+
+	// Files queued for deletion are as good as gone
+	free += uint64(c.PendingDeletionBytes())
+	if free > total {
+		free = total
+	}
+
+	return 1 - float64(free)/float64(total), nil
+}
+
+// checkDiskSpace evicts files if the volume went over the high watermark
+func (c *FileCache) checkDiskSpace() error {
+	if c.diskHigh == 0 {
+		return nil
+	}
+
+	c.diskLock.Lock()
+	defer c.diskLock.Unlock()
+
+	used, err := c.diskUsed()
+	if err != nil {
+		return fmt.Errorf("could not check disk space: %s", err)
+	}
+	if used <= c.diskHigh {
+		return nil
+	}
+
+	log.Warnf("Volume of %s is %.1f%% full, evicting files", c.BaseDir, used*100)
+	return c.evictToLowWatermark()
+}
+
+// evictToLowWatermark evicts files until the volume is no more than the low
+// watermark full, or the cache is empty. Must be called with diskLock held.
+func (c *FileCache) evictToLowWatermark() error {
+	order := c.newEvictionOrder(nil)
+	for {
+		used, err := c.diskUsed()
+		if err != nil {
+			return fmt.Errorf("could not check disk space: %s", err)
+		}
+		if used <= c.diskLow {
+			return nil
+		}
+
+		if !order.evictNext(EvictionDiskPressure) {
+			break
+		}
+	}
+
+	log.Warnf("Evicted all we could from %s but its volume is still over the low watermark", c.BaseDir)
+	return nil
+}
+
+// reclaimDiskSpace makes room after a write ran out of space: down to the low
+// watermark when there is one, otherwise by evicting at least half of the
+// cached bytes. The files it evicts are unlinked right away, rather than
+// queued, so that the room is there when the write is retried.
+func (c *FileCache) reclaimDiskSpace() {
+	c.diskLock.Lock()
+	defer c.diskLock.Unlock()
+
+	atomic.AddInt32(&c.reclaiming, 1)
+	defer atomic.AddInt32(&c.reclaiming, -1)
+
+	if c.diskHigh > 0 {
+		err := c.evictToLowWatermark()
+		if err == nil {
+			return
+		}
+		log.Warnf("Falling back to evicting half of the cache: %s", err)
+	}
+
+	target := c.UsedBytes() / 2
+	order := c.newEvictionOrder(nil)
+	for c.UsedBytes() > target {
+		if !order.evictNext(EvictionDiskPressure) {
+			return
+		}
+	}
+}
+
+// runDiskMonitor calls checkDiskSpace every interval until the cache is closed
+func (c *FileCache) runDiskMonitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.checkDiskSpace(); err != nil {
+				log.Warn(err)
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// isNoSpace reports whether err means the volume is full. Downloaders wrap
+// errors in their own messages, so this falls back to looking at the text.
+func isNoSpace(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	if err == syscall.ENOSPC {
+		return true
+	}
+
+	return strings.Contains(err.Error(), syscall.ENOSPC.Error())
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package filecache
+
+import (
+	"errors"
+)
+
+// volumeUsage is not supported on this platform
+func volumeUsage(path string) (total, free uint64, err error) {
+	return 0, 0, errors.New("disk usage is not supported on this platform")
+}
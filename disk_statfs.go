@@ -0,0 +1,21 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package filecache
+
+import (
+	"syscall"
+)
+
+// volumeUsage returns the total size and the space available to us on the
+// volume holding path
+func volumeUsage(path string) (total, free uint64, err error) {
+	var stat syscall.Statfs_t
+	err = syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	blockSize := uint64(stat.Bsize)
+	return uint64(stat.Blocks) * blockSize, uint64(stat.Bavail) * blockSize, nil
+}
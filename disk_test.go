@@ -0,0 +1,149 @@
+package filecache
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Disk space", func() {
+	var (
+		cache      *FileCache
+		baseDir    string
+		otherBytes uint64 // Used by other tenants of the volume
+	)
+
+	newCache := func(opts ...option) {
+		// A 1000 byte volume, installed before any monitor starts
+		fakeVolume := func(c *FileCache) error {
+			c.volumeUsage = func(path string) (uint64, uint64, error) {
+				used := atomic.LoadUint64(&otherBytes) + uint64(c.UsedBytes())
+				return 1000, 1000 - used, nil
+			}
+			return nil
+		}
+
+		var err error
+		cache, err = New(100, baseDir, append([]option{fakeVolume}, opts...)...)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		cache.DownloadFunc = func(dr *DownloadRecord, localPath string) error {
+			Expect(os.MkdirAll(filepath.Dir(localPath), 0755)).To(Succeed())
+			return ioutil.WriteFile(localPath, bytes.Repeat([]byte("x"), 100), 0644)
+		}
+	}
+
+	fetch := func(count int) {
+		for i := 0; i < count; i++ {
+			Expect(cache.Fetch(&DownloadRecord{Path: fmt.Sprintf("isengard/file-%d.pdf", i)})).To(BeTrue())
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		baseDir, err = ioutil.TempDir("", "filecache-disk")
+		Expect(err).ShouldNot(HaveOccurred())
+		atomic.StoreUint64(&otherBytes, 500)
+	})
+
+	AfterEach(func() {
+		if cache != nil {
+			cache.Close()
+		}
+		os.RemoveAll(baseDir)
+	})
+
+	It("rejects invalid watermarks", func() {
+		_, err := New(10, baseDir, DiskWatermarks(0.5, 0.9, 0))
+		Expect(err).To(HaveOccurred())
+		_, err = New(10, baseDir, DiskWatermarks(1.5, 0.9, 0))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("evicts down to the low watermark before downloading", func() {
+		newCache(DiskWatermarks(0.85, 0.6, 0))
+
+		fetch(4)
+		Expect(cache.Cache.Len()).To(Equal(4))
+
+		fetch(5)
+		Expect(cache.Cache.Len()).To(Equal(2))
+	})
+
+	It("checks the volume in the background", func() {
+		newCache(DiskWatermarks(0.85, 0.6, 10*time.Millisecond))
+		fetch(3)
+
+		atomic.StoreUint64(&otherBytes, 700)
+		Eventually(func() int { return cache.Cache.Len() }).Should(BeNumerically("<=", 0))
+	})
+
+	It("evicts and retries when a download runs out of space", func() {
+		newCache()
+		fetch(4)
+
+		download := cache.DownloadFunc
+		failures := 0
+		cache.DownloadFunc = func(dr *DownloadRecord, localPath string) error {
+			if failures == 0 {
+				failures++
+				return fmt.Errorf("could not write: %s", &os.PathError{Op: "write", Path: localPath, Err: syscall.ENOSPC})
+			}
+			return download(dr, localPath)
+		}
+
+		Expect(cache.Fetch(&DownloadRecord{Path: "isengard/palantir.pdf"})).To(BeTrue())
+		Expect(failures).To(Equal(1))
+		Expect(cache.Cache.Len()).To(Equal(3))
+	})
+
+	It("deletes what it evicts before retrying, even with a deletion queue", func() {
+		newCache(AsyncDeletion(10))
+		fetch(4)
+
+		download := cache.DownloadFunc
+		failed := false
+		onDisk := 0
+		cache.DownloadFunc = func(dr *DownloadRecord, localPath string) error {
+			if !failed {
+				failed = true
+				return &os.PathError{Op: "write", Path: localPath, Err: syscall.ENOSPC}
+			}
+			for i := 0; i < 4; i++ {
+				if _, err := os.Stat(cache.GetFileName(&DownloadRecord{Path: fmt.Sprintf("isengard/file-%d.pdf", i)})); err == nil {
+					onDisk++
+				}
+			}
+			return download(dr, localPath)
+		}
+
+		Expect(cache.Fetch(&DownloadRecord{Path: "isengard/palantir.pdf"})).To(BeTrue())
+		Expect(onDisk).To(Equal(2))
+		Expect(cache.PendingDeletionBytes()).To(BeZero())
+	})
+
+	It("recognises out of space errors", func() {
+		Expect(isNoSpace(&os.PathError{Err: syscall.ENOSPC})).To(BeTrue())
+		Expect(isNoSpace(fmt.Errorf("wrapped: %s", syscall.ENOSPC))).To(BeTrue())
+		Expect(isNoSpace(syscall.EACCES)).To(BeFalse())
+		Expect(isNoSpace(nil)).To(BeFalse())
+	})
+
+	It("sizes the cache as a percentage of the volume", func() {
+		var err error
+		cache, err = New(10, filepath.Join(baseDir, "not", "created", "yet"), MaxBytesPercent(10))
+		Expect(err).ShouldNot(HaveOccurred())
+
+		total, _, err := volumeUsage(baseDir)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(cache.maxBytes).To(Equal(int64(float64(total) * 10 / 100)))
+	})
+})
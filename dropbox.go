@@ -30,12 +30,25 @@ func DropboxDownload(dr *DownloadRecord, localFile io.Writer, downloadTimeout ti
 		return fmt.Errorf("could not create HTTP request for URL %q: %s", fileURL, err)
 	}
 
+	if dr.Validators != nil {
+		if dr.Validators.ETag != "" {
+			req.Header.Set("If-None-Match", dr.Validators.ETag)
+		}
+		if !dr.Validators.LastModified.IsZero() {
+			req.Header.Set("If-Modified-Since", dr.Validators.LastModified.UTC().Format(http.TimeFormat))
+		}
+	}
+
 	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
 	if err != nil {
 		return fmt.Errorf("failed to download file %q: %s", fileURL, err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified {
+		return ErrNotModified
+	}
+
 	numBytes, err := io.Copy(localFile, resp.Body)
 	if err != nil {
 		return fmt.Errorf("failed to write local file: %s", err)
@@ -43,5 +56,36 @@ func DropboxDownload(dr *DownloadRecord, localFile io.Writer, downloadTimeout ti
 
 	log.Debugf("Took %.2fms to download %d bytes from Dropbox for %s", time.Since(startTime).Seconds()*1000, numBytes, dr.Path)
 
+	dr.Info = objectInfoFromHeader(resp.Header)
+
 	return nil
 }
+
+// DropboxStat looks up the metadata of the file at the specified Dropbox
+// location with a HEAD request, without downloading it
+func DropboxStat(dr *DownloadRecord, timeout time.Duration) (*ObjectInfo, error) {
+	fileURL, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(dr.Path, "dropbox/"))
+	if err != nil {
+		return nil, fmt.Errorf("could not base64 decode file URL: %s", err)
+	}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), timeout)
+	defer cancelFunc()
+
+	req, err := http.NewRequest(http.MethodHead, string(fileURL), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create HTTP request for URL %q: %s", fileURL, err)
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to HEAD file %q: %s", fileURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status for HEAD of %q: %s", fileURL, resp.Status)
+	}
+
+	return objectInfoFromHeader(resp.Header), nil
+}
@@ -134,4 +134,55 @@ var _ = Describe("DropboxDownload", func() {
 		Expect(err).Should(HaveOccurred())
 		Expect(err.Error()).To(ContainSubstring("context deadline exceeded"))
 	})
+
+	It("returns ErrNotModified when the validators still match", func() {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("If-None-Match") == `"rev-1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"rev-2"`)
+			_, err := w.Write([]byte("dummy_content"))
+			Expect(err).To(BeNil())
+		}))
+		defer ts.Close()
+		url := fmt.Sprintf(
+			"dropbox/%s",
+			base64.RawURLEncoding.EncodeToString([]byte(ts.URL)),
+		)
+
+		dr, err := NewDownloadRecord(url, nil)
+		Expect(err).To(BeNil())
+
+		dr.Validators = &ObjectInfo{ETag: `"rev-1"`}
+		err = DropboxDownload(dr, &dummyWriter{}, 100*time.Millisecond)
+		Expect(err).To(Equal(ErrNotModified))
+
+		dr.Validators = &ObjectInfo{ETag: `"rev-0"`}
+		err = DropboxDownload(dr, &dummyWriter{}, 100*time.Millisecond)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(dr.Info.ETag).To(Equal(`"rev-2"`))
+	})
+
+	It("looks up the file metadata with a HEAD request", func() {
+		lastModified := time.Date(2018, time.October, 1, 12, 0, 0, 0, time.UTC)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.Method).To(Equal(http.MethodHead))
+			w.Header().Set("ETag", `"rev-3"`)
+			w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		}))
+		defer ts.Close()
+		url := fmt.Sprintf(
+			"dropbox/%s",
+			base64.RawURLEncoding.EncodeToString([]byte(ts.URL)),
+		)
+
+		dr, err := NewDownloadRecord(url, nil)
+		Expect(err).To(BeNil())
+
+		info, err := DropboxStat(dr, 100*time.Millisecond)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(info.ETag).To(Equal(`"rev-3"`))
+		Expect(info.LastModified).To(BeTemporally("==", lastModified))
+	})
 })
@@ -0,0 +1,534 @@
+package filecache
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// encryptedMagic starts the header of encrypted files. It is followed by
+	// the length of the key ID, the key ID, and the file's salt.
+	encryptedMagic = "\x00FCE"
+	// encryptedChunkSize is how much plaintext each sealed chunk holds
+	encryptedChunkSize = 64 * 1024
+	// fileSaltSize is the size of the random salt each file's key is derived
+	// with. Since every file has a key of its own, chunk nonces only need to
+	// be unique within a file: they are the chunk number and a flag marking
+	// the last chunk, so chunks can't be reordered or dropped.
+	fileSaltSize = 32
+	// fileKeyInfo binds the keys derived for files to their purpose
+	fileKeyInfo = "filecache chunk key"
+)
+
+// EncryptionKey is a key to encrypt cached files with, named so that files can
+// be matched with it again
+type EncryptionKey struct {
+	ID string
+	// Key is an AES key of 16, 24 or 32 bytes
+	Key []byte
+}
+
+// KeyProvider hands out the keys to encrypt and decrypt cached files with.
+// Both methods receive the record the file belongs to, so that keys can differ
+// per tenant, e.g. per HashedArgs. Providers which pick keys by the values of
+// Args need the records passed to RotateKeys, since the cache doesn't keep
+// those values.
+type KeyProvider interface {
+	// CurrentKey returns the key to encrypt the record's file with
+	CurrentKey(dr *DownloadRecord) (EncryptionKey, error)
+	// Key returns the key with the given ID, to read files encrypted before a
+	// rotation. It returns an error when the key is no longer available.
+	Key(dr *DownloadRecord, id string) ([]byte, error)
+}
+
+// EncryptAtRest encrypts cached files with AES-GCM, under a key derived for
+// each file from the provider's key and a random salt. Open and OpenStream
+// decrypt files transparently, which is the only way to read them: FileName
+// and Lease.FileName fail with ErrNoLocalPath. Files without encryption are
+// refused. Files are encrypted once their download completes,
+// and after any compression, so downloads and uploads are written outside
+// BaseDir, in the StagingDir, until they are. A StagingDir is required.
+// Encrypted files aren't shared through ContentAddressed. See RotateKeys for
+// changing keys.
+func EncryptAtRest(provider KeyProvider) option {
+	return func(c *FileCache) error {
+		if provider == nil {
+			return errors.New("nil key provider")
+		}
+
+		c.keys = provider
+
+		return nil
+	}
+}
+
+// StagingDir sets where downloads and uploads are written in the clear before
+// EncryptAtRest encrypts them into BaseDir. It is created if needed, must only
+// be accessible to the cache's user, and should be on a volume which doesn't
+// outlive the process, e.g. a tmpfs.
+func StagingDir(dir string) option {
+	return func(c *FileCache) error {
+		if dir == "" {
+			return errors.New("empty staging directory")
+		}
+
+		c.staging = dir
+
+		return nil
+	}
+}
+
+// checkStagingDir makes sure files can be staged privately before they are
+// encrypted
+func (c *FileCache) checkStagingDir() error {
+	if c.keys == nil {
+		return nil
+	}
+	if c.staging == "" {
+		return errors.New("encryption at rest needs a staging directory")
+	}
+
+	err := os.MkdirAll(c.staging, 0700)
+	if err != nil {
+		return fmt.Errorf("could not create staging directory: %s", err)
+	}
+	info, err := os.Stat(c.staging)
+	if err != nil {
+		return fmt.Errorf("could not stat staging directory: %s", err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("staging directory '%s' is accessible to other users", c.staging)
+	}
+
+	return nil
+}
+
+// stagingDir returns the directory to write a file bound for target in before
+// it is stored: next to it, unless it is going to be encrypted
+func (c *FileCache) stagingDir(target string) string {
+	if c.keys == nil {
+		return filepath.Dir(target)
+	}
+	return c.staging
+}
+
+// RotateKeys moves the cached files which aren't encrypted with their
+// record's current key onto it. Files whose old key is no longer available are
+// dropped from the cache instead. It returns how many files were re-encrypted
+// and how many were dropped.
+//
+// Given records, it only rotates their files, and hands them to the
+// KeyProvider as they are. Otherwise it rotates every cached file, but the
+// records it has for them only carry the names of their Args, not their values.
+func (c *FileCache) RotateKeys(records ...*DownloadRecord) (reencrypted int, dropped int) {
+	if c.keys == nil {
+		return 0, 0
+	}
+
+	if len(records) == 0 {
+		c.entriesLock.RLock()
+		records = make([]*DownloadRecord, 0, len(c.entries))
+		for _, entry := range c.entries {
+			record := entry.record
+			records = append(records, &record)
+		}
+		c.entriesLock.RUnlock()
+	}
+
+	for _, dr := range records {
+		switch c.rotateKey(dr) {
+		case rotationReencrypted:
+			reencrypted++
+		case rotationDropped:
+			dropped++
+		}
+	}
+
+	log.Infof("Rotated encryption keys, re-encrypting %d files and dropping %d", reencrypted, dropped)
+
+	return reencrypted, dropped
+}
+
+type rotationResult int
+
+const (
+	rotationSkipped rotationResult = iota
+	rotationReencrypted
+	rotationDropped
+)
+
+// rotateKey re-encrypts the file of one record with its current key, if
+// needed, or drops it
+func (c *FileCache) rotateKey(dr *DownloadRecord) rotationResult {
+	result := c.reencryptStale(dr)
+	if result == rotationDropped {
+		// Not while we claim the record, or the file would be left behind as
+		// if it was being downloaded again
+		c.removeWithReason(dr.GetUniqueName(), EvictionKeyRotation)
+	}
+
+	return result
+}
+
+// reencryptStale re-encrypts the file of one record with its current key, if
+// needed. It returns rotationDropped when the file should be dropped instead.
+func (c *FileCache) reencryptStale(dr *DownloadRecord) rotationResult {
+	// Keep downloads of the record out of the way while we swap the file
+	storagePath, release := c.claimWaiting(dr)
+	defer release()
+
+	if !c.Cache.Contains(dr.GetUniqueName()) {
+		return rotationSkipped
+	}
+
+	id, err := encryptionKeyID(storagePath)
+	if err != nil {
+		log.Warnf("Unable to read the encryption header of %s: %s", dr.Path, err)
+		return rotationSkipped
+	}
+
+	current, err := c.keys.CurrentKey(dr)
+	if err != nil {
+		log.Warnf("Unable to get the current encryption key for %s: %s", dr.Path, err)
+		return rotationSkipped
+	}
+	if id == current.ID {
+		return rotationSkipped
+	}
+
+	rotatedPath, err := c.reencrypt(dr, storagePath, current)
+	if err == nil {
+		err = os.Rename(rotatedPath, storagePath)
+		os.Remove(rotatedPath) // Fails harmlessly once renamed
+	}
+	if err != nil {
+		log.Warnf("Unable to re-encrypt %s, dropping it: %s", dr.Path, err)
+		return rotationDropped
+	}
+
+	if stat, err := os.Stat(storagePath); err == nil {
+		c.entriesLock.Lock()
+		if entry, ok := c.entries[dr.GetUniqueName()]; ok {
+			c.removeUsage(entry)
+			entry.size = stat.Size()
+			c.addUsage(entry)
+		}
+		c.entriesLock.Unlock()
+	}
+
+	return rotationReencrypted
+}
+
+// reencrypt decrypts a file and encrypts it again with key, next to it
+func (c *FileCache) reencrypt(dr *DownloadRecord, storagePath string, key EncryptionKey) (string, error) {
+	file, err := os.Open(storagePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	stored := &storedFile{file: file, data: file}
+	if err := c.readEncryptionHeader(dr, stored); err != nil {
+		return "", err
+	}
+
+	return writeEncrypted(storagePath, io.NewSectionReader(stored.data, 0, stored.size), key)
+}
+
+// encrypt encrypts a file about to be stored at target, and returns the path
+// of the encrypted copy next to target, which the caller must remove if it
+// isn't moved into place. Without a key provider, it returns the original
+// path.
+func (c *FileCache) encrypt(dr *DownloadRecord, path, target string) (string, error) {
+	if c.keys == nil {
+		return path, nil
+	}
+
+	key, err := c.keys.CurrentKey(dr)
+	if err != nil {
+		return "", fmt.Errorf("could not get encryption key for %s: %s", dr.Path, err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	encryptedPath, err := writeEncrypted(target, file, key)
+	if err != nil {
+		return "", fmt.Errorf("could not encrypt %s: %s", dr.Path, err)
+	}
+
+	return encryptedPath, nil
+}
+
+// writeEncrypted encrypts r into a new file next to path, and returns its name
+func writeEncrypted(path string, r io.Reader, key EncryptionKey) (string, error) {
+	if len(key.ID) > math.MaxUint8 {
+		return "", fmt.Errorf("encryption key ID %q is too long", key.ID)
+	}
+	salt := make([]byte, fileSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	aead, err := newFileAEAD(key.Key, salt)
+	if err != nil {
+		return "", err
+	}
+
+	header := bytes.NewBufferString(encryptedMagic)
+	header.WriteByte(byte(len(key.ID)))
+	header.WriteString(key.ID)
+	header.Write(salt)
+
+	encrypted, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".encrypt-")
+	if err != nil {
+		return "", err
+	}
+	defer encrypted.Close()
+
+	err = sealChunks(encrypted, r, aead, header.Bytes())
+	if err != nil {
+		os.Remove(encrypted.Name())
+		return "", err
+	}
+
+	return encrypted.Name(), nil
+}
+
+// sealChunks writes the header, then r in sealed chunks
+func sealChunks(w io.Writer, r io.Reader, aead cipher.AEAD, header []byte) error {
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	// Read a chunk ahead, to know which one is the last
+	chunk := make([]byte, encryptedChunkSize)
+	next := make([]byte, encryptedChunkSize)
+	n, err := io.ReadFull(r, chunk)
+	for index := uint32(0); ; index++ {
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+
+		var nextN int
+		last := err != nil
+		if !last {
+			nextN, err = io.ReadFull(r, next)
+			last = err == io.EOF
+		}
+
+		sealed := aead.Seal(nil, chunkNonce(index, last), chunk[:n], header)
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+
+		chunk, next = next, chunk
+		n = nextN
+	}
+}
+
+// chunkNonce returns the nonce of a chunk, under its file's key
+func chunkNonce(index uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint32(nonce[7:], index)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// newFileAEAD returns the cipher of one file, keyed with HKDF from key and the
+// file's salt, so that no two files share a key
+func newFileAEAD(key, salt []byte) (cipher.AEAD, error) {
+	if _, err := aes.NewCipher(key); err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %s", err)
+	}
+
+	fileKey := make([]byte, len(key))
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte(fileKeyInfo)), fileKey); err != nil {
+		return nil, fmt.Errorf("could not derive file key: %s", err)
+	}
+	block, err := aes.NewCipher(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptionKeyID returns the ID of the key a file was encrypted with
+func encryptionKeyID(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	id, _, err := readEncryptedHeader(file)
+	return id, err
+}
+
+// readEncryptedHeader reads the key ID and the salt of an encrypted file. It
+// returns an empty ID for files which aren't encrypted.
+func readEncryptedHeader(file io.ReaderAt) (id string, salt []byte, err error) {
+	head := make([]byte, len(encryptedMagic)+1)
+	n, _ := file.ReadAt(head, 0)
+	if n < len(head) || string(head[:len(encryptedMagic)]) != encryptedMagic {
+		return "", nil, nil
+	}
+
+	rest := make([]byte, int(head[len(encryptedMagic)])+fileSaltSize)
+	if _, err := file.ReadAt(rest, int64(len(head))); err != nil {
+		return "", nil, fmt.Errorf("could not read encryption header: %s", err)
+	}
+	id = string(rest[:len(rest)-fileSaltSize])
+	if id == "" {
+		return "", nil, errors.New("encryption header without a key ID")
+	}
+
+	return id, rest[len(rest)-fileSaltSize:], nil
+}
+
+// readEncryptionHeader makes stored read the decrypted contents of its file,
+// if it is encrypted
+func (c *FileCache) readEncryptionHeader(dr *DownloadRecord, stored *storedFile) error {
+	info, err := stored.file.Stat()
+	if err != nil {
+		return err
+	}
+	stored.size = info.Size()
+
+	if c.keys == nil {
+		return nil
+	}
+
+	id, salt, err := readEncryptedHeader(stored.file)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		return errors.New("missing encryption header")
+	}
+
+	key, err := c.keys.Key(dr, id)
+	if err != nil {
+		return fmt.Errorf("could not get encryption key %q: %s", id, err)
+	}
+	aead, err := newFileAEAD(key, salt)
+	if err != nil {
+		return err
+	}
+
+	headerSize := int64(len(encryptedMagic) + 1 + len(id) + fileSaltSize)
+	header := make([]byte, headerSize)
+	if _, err := stored.file.ReadAt(header, 0); err != nil {
+		return err
+	}
+
+	sealedSize := int64(encryptedChunkSize + aead.Overhead())
+	body := info.Size() - headerSize
+	chunks := (body + sealedSize - 1) / sealedSize
+	if chunks == 0 {
+		return errors.New("encrypted file is truncated")
+	}
+
+	stored.data = &decryptingReader{
+		file:       stored.file,
+		aead:       aead,
+		header:     header,
+		chunks:     chunks,
+		sealedSize: sealedSize,
+		bodySize:   body,
+		cached:     -1,
+	}
+	stored.size = body - chunks*int64(aead.Overhead())
+
+	return nil
+}
+
+// decryptingReader reads the plaintext of an encrypted file, a chunk at a time
+type decryptingReader struct {
+	file       io.ReaderAt
+	aead       cipher.AEAD
+	header     []byte
+	chunks     int64
+	sealedSize int64
+	bodySize   int64
+
+	lock   sync.Mutex
+	cached int64 // Index of the chunk in plain, -1 if none
+	plain  []byte
+}
+
+// chunk returns the plaintext of a chunk. Must be called locked.
+func (d *decryptingReader) chunk(index int64) ([]byte, error) {
+	if index == d.cached {
+		return d.plain, nil
+	}
+
+	size := d.sealedSize
+	if remaining := d.bodySize - index*d.sealedSize; remaining < size {
+		size = remaining
+	}
+	sealed := make([]byte, size)
+	offset := int64(len(d.header)) + index*d.sealedSize
+	if _, err := d.file.ReadAt(sealed, offset); err != nil {
+		return nil, err
+	}
+
+	nonce := chunkNonce(uint32(index), index == d.chunks-1)
+	plain, err := d.aead.Open(d.plain[:0], nonce, sealed, d.header)
+	if err != nil {
+		d.cached = -1
+		return nil, errors.New("encrypted file failed authentication")
+	}
+	d.cached = index
+	d.plain = plain
+
+	return plain, nil
+}
+
+func (d *decryptingReader) ReadAt(b []byte, offset int64) (int, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	read := 0
+	for read < len(b) {
+		index := (offset + int64(read)) / encryptedChunkSize
+		if index >= d.chunks {
+			return read, io.EOF
+		}
+
+		plain, err := d.chunk(index)
+		if err != nil {
+			return read, err
+		}
+
+		start := (offset + int64(read)) % encryptedChunkSize
+		if start >= int64(len(plain)) {
+			return read, io.EOF
+		}
+		read += copy(b[read:], plain[start:])
+	}
+
+	return read, nil
+}
@@ -0,0 +1,351 @@
+package filecache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// testKeys hands out a key per HashedArgs, or per value of the byArg Arg when
+// set, named after its generation
+type testKeys struct {
+	lock    sync.Mutex
+	byArg   string
+	current map[string]string // Tenant to key ID
+	keys    map[string][]byte
+}
+
+func (k *testKeys) CurrentKey(dr *DownloadRecord) (EncryptionKey, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	tenant := dr.HashedArgs
+	if k.byArg != "" {
+		tenant = dr.Args[k.byArg]
+	}
+	id := k.current[tenant]
+	return EncryptionKey{ID: id, Key: k.keys[id]}, nil
+}
+
+func (k *testKeys) Key(dr *DownloadRecord, id string) ([]byte, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, errors.New("no such key")
+	}
+	return key, nil
+}
+
+func (k *testKeys) rotate(tenant, id string, key []byte, forgetOld bool) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if forgetOld {
+		delete(k.keys, k.current[tenant])
+	}
+	k.current[tenant] = id
+	k.keys[id] = key
+}
+
+var _ = Describe("EncryptAtRest", func() {
+	var (
+		cache   *FileCache
+		baseDir string
+		keys    *testKeys
+		staging string
+	)
+
+	// Spans a few chunks, and ends halfway through one
+	contents := []byte(strings.Repeat("Speak, friend, and enter. ", 8000))
+
+	download := func(dr *DownloadRecord, localFile *os.File) error {
+		_, err := localFile.Write(contents)
+		return err
+	}
+
+	BeforeEach(func() {
+		var err error
+		baseDir, err = ioutil.TempDir("", "filecache-encrypt")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		keys = &testKeys{
+			current: map[string]string{"": "shared-1", "gandalf": "gandalf-1"},
+			keys: map[string][]byte{
+				"shared-1":  bytes.Repeat([]byte{1}, 32),
+				"gandalf-1": bytes.Repeat([]byte{2}, 32),
+			},
+		}
+
+		staging, err = ioutil.TempDir("", "filecache-staging")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		cache, err = New(10, baseDir, EncryptAtRest(keys), StagingDir(staging))
+		Expect(err).ShouldNot(HaveOccurred())
+		stubDownloads(cache, download)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(baseDir)
+		os.RemoveAll(staging)
+	})
+
+	record := func(tenant string) *DownloadRecord {
+		dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "moria/doors.txt"}
+		if tenant != "" {
+			dr.Args = map[string]string{"user": tenant}
+			dr.HashedArgs = tenant
+		}
+		return dr
+	}
+
+	readAll := func(dr *DownloadRecord) ([]byte, error) {
+		file, err := cache.Open(context.Background(), dr)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return ioutil.ReadAll(file)
+	}
+
+	It("stores files encrypted and reads them back", func() {
+		dr := record("")
+		Expect(cache.Fetch(dr)).To(BeTrue())
+
+		stored, err := ioutil.ReadFile(cache.storagePath(dr))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(string(stored[:len(encryptedMagic)])).To(Equal(encryptedMagic))
+		Expect(bytes.Contains(stored, []byte("Speak, friend"))).To(BeFalse())
+
+		Expect(readAll(dr)).To(Equal(contents))
+	})
+
+	It("fetches encrypted files but doesn't hand out paths to them", func() {
+		dr := record("")
+		Expect(cache.Fetch(dr)).To(BeTrue())
+		Expect(cache.Reload(dr)).To(BeTrue())
+		Expect(cache.GetFileName(dr)).To(BeAnExistingFile())
+		_, err := cache.FileName(dr)
+		Expect(err).To(Equal(ErrNoLocalPath))
+
+		lease, err := cache.Pin(dr, 0)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer lease.Release()
+
+		Expect(lease.Path()).To(Equal(cache.GetFileName(dr)))
+		_, err = lease.FileName()
+		Expect(err).To(Equal(ErrNoLocalPath))
+	})
+
+	It("refuses files which aren't encrypted", func() {
+		dr := record("")
+		Expect(cache.Fetch(dr)).To(BeTrue())
+		Expect(ioutil.WriteFile(cache.storagePath(dr), contents, 0644)).To(Succeed())
+
+		_, err := readAll(dr)
+		Expect(err).To(MatchError(ContainSubstring("missing encryption header")))
+	})
+
+	It("keeps downloads in the clear out of BaseDir", func() {
+		halfway := make(chan struct{})
+		resume := make(chan struct{})
+		stubDownloads(cache, func(dr *DownloadRecord, localFile *os.File) error {
+			localFile.Write(contents[:len(contents)/2])
+			close(halfway)
+			<-resume
+			_, err := localFile.Write(contents[len(contents)/2:])
+			return err
+		})
+
+		dr := record("")
+		fetched := make(chan error, 1)
+		go func() { fetched <- cache.MaybeDownload(dr) }()
+		<-halfway
+
+		inClear := func(dir string) bool {
+			found := false
+			filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					data, _ := ioutil.ReadFile(path)
+					found = found || bytes.Contains(data, []byte("Speak, friend"))
+				}
+				return nil
+			})
+			return found
+		}
+		Expect(inClear(staging)).To(BeTrue())
+		Expect(inClear(baseDir)).To(BeFalse())
+
+		close(resume)
+		Expect(<-fetched).To(Succeed())
+		Expect(inClear(staging)).To(BeFalse())
+		Expect(inClear(baseDir)).To(BeFalse())
+		Expect(readAll(dr)).To(Equal(contents))
+	})
+
+	It("only stages files in a private directory", func() {
+		_, err := New(10, baseDir, EncryptAtRest(keys))
+		Expect(err).To(MatchError(ContainSubstring("staging directory")))
+
+		Expect(os.Chmod(staging, 0755)).To(Succeed())
+		_, err = New(10, baseDir, EncryptAtRest(keys), StagingDir(staging))
+		Expect(err).To(MatchError(ContainSubstring("accessible to other users")))
+
+		private := filepath.Join(staging, "private")
+		_, err = New(10, baseDir, EncryptAtRest(keys), StagingDir(private))
+		Expect(err).ShouldNot(HaveOccurred())
+		info, err := os.Stat(private)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0700)))
+	})
+
+	It("derives a key of its own for every file", func() {
+		shared := record("")
+		Expect(cache.Fetch(shared)).To(BeTrue())
+		first, err := ioutil.ReadFile(cache.storagePath(shared))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(cache.Reload(shared)).To(BeTrue())
+		second, err := ioutil.ReadFile(cache.storagePath(shared))
+		Expect(err).ShouldNot(HaveOccurred())
+
+		_, firstSalt, err := readEncryptedHeader(bytes.NewReader(first))
+		Expect(err).ShouldNot(HaveOccurred())
+		_, secondSalt, err := readEncryptedHeader(bytes.NewReader(second))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(firstSalt).To(HaveLen(fileSaltSize))
+		Expect(firstSalt).NotTo(Equal(secondSalt))
+
+		// The same contents under the same chunk nonces, but other keys
+		body := len(encryptedMagic) + 1 + len("shared-1") + fileSaltSize
+		Expect(first[body : body+64]).NotTo(Equal(second[body : body+64]))
+		Expect(readAll(shared)).To(Equal(contents))
+	})
+
+	It("reads encrypted files at any offset", func() {
+		dr := record("")
+		file, err := cache.Open(context.Background(), dr)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer file.Close()
+
+		Expect(file.Size()).To(Equal(int64(len(contents))))
+
+		buf := make([]byte, 100)
+		offset := int64(encryptedChunkSize - 50)
+		_, err = file.ReadAt(buf, offset)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(buf).To(Equal(contents[offset : offset+100]))
+
+		_, err = file.Seek(-20, io.SeekEnd)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(ioutil.ReadAll(file)).To(Equal(contents[len(contents)-20:]))
+	})
+
+	It("uses each tenant's key", func() {
+		shared := record("")
+		gandalf := record("gandalf")
+		Expect(cache.Fetch(shared)).To(BeTrue())
+		Expect(cache.Fetch(gandalf)).To(BeTrue())
+
+		Expect(encryptionKeyID(cache.storagePath(shared))).To(Equal("shared-1"))
+		Expect(encryptionKeyID(cache.storagePath(gandalf))).To(Equal("gandalf-1"))
+		Expect(readAll(gandalf)).To(Equal(contents))
+	})
+
+	It("detects tampering", func() {
+		dr := record("")
+		Expect(cache.Fetch(dr)).To(BeTrue())
+
+		stored, err := ioutil.ReadFile(cache.storagePath(dr))
+		Expect(err).ShouldNot(HaveOccurred())
+		stored[len(stored)/2] ^= 1
+		Expect(ioutil.WriteFile(cache.storagePath(dr), stored, 0644)).To(Succeed())
+
+		_, err = readAll(dr)
+		Expect(err).To(MatchError(ContainSubstring("authentication")))
+	})
+
+	It("detects truncation", func() {
+		dr := record("")
+		Expect(cache.Fetch(dr)).To(BeTrue())
+
+		info, err := os.Stat(cache.storagePath(dr))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(os.Truncate(cache.storagePath(dr), info.Size()-int64(len(contents))%encryptedChunkSize-16)).To(Succeed())
+
+		_, err = readAll(dr)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("re-encrypts files when keys are rotated", func() {
+		shared := record("")
+		gandalf := record("gandalf")
+		Expect(cache.Fetch(shared)).To(BeTrue())
+		Expect(cache.Fetch(gandalf)).To(BeTrue())
+
+		keys.rotate("gandalf", "gandalf-2", bytes.Repeat([]byte{3}, 32), false)
+		reencrypted, dropped := cache.RotateKeys()
+		Expect(reencrypted).To(Equal(1))
+		Expect(dropped).To(Equal(0))
+
+		Expect(encryptionKeyID(cache.storagePath(gandalf))).To(Equal("gandalf-2"))
+		Expect(readAll(gandalf)).To(Equal(contents))
+		Expect(encryptionKeyID(cache.storagePath(shared))).To(Equal("shared-1"))
+	})
+
+	It("hands the records it is given to the provider when rotating", func() {
+		keys.byArg = "user"
+		gandalf := record("gandalf")
+		Expect(cache.Fetch(gandalf)).To(BeTrue())
+		Expect(encryptionKeyID(cache.storagePath(gandalf))).To(Equal("gandalf-1"))
+
+		keys.rotate("gandalf", "gandalf-2", bytes.Repeat([]byte{3}, 32), false)
+		reencrypted, dropped := cache.RotateKeys(record("gandalf"))
+		Expect(reencrypted).To(Equal(1))
+		Expect(dropped).To(Equal(0))
+
+		Expect(encryptionKeyID(cache.storagePath(gandalf))).To(Equal("gandalf-2"))
+		Expect(readAll(gandalf)).To(Equal(contents))
+	})
+
+	It("drops files whose key is gone", func() {
+		gandalf := record("gandalf")
+		Expect(cache.Fetch(gandalf)).To(BeTrue())
+
+		var reasons []EvictionReason
+		cache.evictionHandler = func(event *EvictionEvent) EvictionDecision {
+			reasons = append(reasons, event.Reason)
+			return EvictionDecision{}
+		}
+
+		keys.rotate("gandalf", "gandalf-2", bytes.Repeat([]byte{3}, 32), true)
+		reencrypted, dropped := cache.RotateKeys()
+		Expect(reencrypted).To(Equal(0))
+		Expect(dropped).To(Equal(1))
+
+		Expect(cache.Contains(gandalf)).To(BeFalse())
+		Expect(reasons).To(Equal([]EvictionReason{EvictionKeyRotation}))
+		Eventually(cache.storagePath(gandalf)).ShouldNot(BeAnExistingFile())
+	})
+
+	It("encrypts compressed files", func() {
+		var err error
+		cache, err = New(10, baseDir, EncryptAtRest(keys), StagingDir(staging), Compression(CompressionRule{Codec: GzipCodec}))
+		Expect(err).ShouldNot(HaveOccurred())
+		stubDownloads(cache, download)
+
+		dr := record("")
+		Expect(cache.Fetch(dr)).To(BeTrue())
+		Expect(cache.UsedBytes()).To(BeNumerically("<", len(contents)/10))
+		Expect(readAll(dr)).To(Equal(contents))
+	})
+})
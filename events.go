@@ -0,0 +1,296 @@
+package filecache
+
+import (
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxVetoes is how many pinned files, or files whose eviction was vetoed, an
+// eviction pass skips before it evicts files whatever the handler says
+const maxVetoes = 16
+
+// EvictionReason tells why a file left the cache
+type EvictionReason int
+
+const (
+	// EvictionCapacity means the cache, or one of its partition, identity or
+	// byte budgets, was full. Files dropped by the eviction policy without a
+	// more specific reason are reported with it.
+	EvictionCapacity EvictionReason = iota
+	// EvictionDiskPressure means the volume went over its high watermark, or a
+	// download ran out of space
+	EvictionDiskPressure
+	// EvictionExpired means the file outlived its TTL
+	EvictionExpired
+	// EvictionReload means the file is being downloaded again, by Reload or
+	// because the cached copy went missing
+	EvictionReload
+	// EvictionRemoved means the file was removed with Remove
+	EvictionRemoved
+	// EvictionPurge means the whole cache was purged
+	EvictionPurge
+	// EvictionKeyRotation means the file was encrypted with a key which is no
+	// longer available
+	EvictionKeyRotation
+)
+
+func (r EvictionReason) String() string {
+	switch r {
+	case EvictionCapacity:
+		return "capacity"
+	case EvictionDiskPressure:
+		return "disk pressure"
+	case EvictionExpired:
+		return "expired"
+	case EvictionReload:
+		return "reload"
+	case EvictionRemoved:
+		return "removed"
+	case EvictionPurge:
+		return "purge"
+	case EvictionKeyRotation:
+		return "key rotation"
+	default:
+		return "unknown"
+	}
+}
+
+// vetoable reports whether evictions for this reason can be vetoed, which is
+// the case for the automatic ones
+func (r EvictionReason) vetoable() bool {
+	switch r {
+	case EvictionCapacity, EvictionDiskPressure, EvictionExpired:
+		return true
+	default:
+		return false
+	}
+}
+
+// EvictionEvent describes a file which is about to leave the cache
+type EvictionEvent struct {
+	Reason      EvictionReason
+	Key         string
+	StoragePath string
+	// Record is a copy of the record the file was cached for, without the
+	// values of its Args, which may be secrets. It is nil, and so are the
+	// fields below, for entries added to Cache directly.
+	Record *DownloadRecord
+	Size   int64
+	Age    time.Duration
+	Hits   int
+}
+
+// EvictionDecision is an EvictionHandler's answer to an EvictionEvent. The
+// zero value lets the eviction go ahead.
+type EvictionDecision struct {
+	// Veto keeps the file in the cache, where it stays in its place in the
+	// eviction order, and the next file in line is evicted instead. Only
+	// automatic evictions (capacity, disk pressure and expiry) can be vetoed;
+	// Remove, Reload and Purge always go ahead. When too many evictions in a
+	// row are vetoed, the cache evicts files anyway so that it can make room.
+	Veto bool
+	// Postpone takes the file out of the cache but only deletes it from disk
+	// once this long has passed, e.g. to let readers finish with it
+	Postpone time.Duration
+}
+
+// EvictionHandlerFunc is told about every eviction, with its reason, before
+// the file is deleted
+type EvictionHandlerFunc = func(event *EvictionEvent) EvictionDecision
+
+// EvictionHandler installs a handler which receives a typed event for every
+// file leaving the cache, and may veto or postpone the eviction. OnEvict is
+// still called for evictions which go ahead.
+func EvictionHandler(handler EvictionHandlerFunc) option {
+	return func(c *FileCache) error {
+		if handler == nil {
+			return errors.New("nil eviction handler")
+		}
+
+		c.evictionHandler = handler
+
+		return nil
+	}
+}
+
+// Remove evicts a file from the cache and deletes it from disk
+func (c *FileCache) Remove(dr *DownloadRecord) {
+	c.removeWithReason(dr.GetUniqueName(), EvictionRemoved)
+}
+
+// removeWithReason evicts key, reporting the given reason to the handler
+func (c *FileCache) removeWithReason(key string, reason EvictionReason) {
+	c.removeDecided(key, reason, nil)
+}
+
+// removeDecided evicts key for the given reason, along with the handler's
+// decision about it if it was already asked
+func (c *FileCache) removeDecided(key string, reason EvictionReason, decision *EvictionDecision) {
+	c.entriesLock.Lock()
+	c.reasons[key] = reason
+	if decision != nil {
+		c.decisions[key] = *decision
+	}
+	c.entriesLock.Unlock()
+
+	c.Cache.Remove(key)
+
+	// In case it wasn't there to be evicted
+	c.entriesLock.Lock()
+	delete(c.reasons, key)
+	delete(c.decisions, key)
+	c.entriesLock.Unlock()
+}
+
+// evictUnlessVetoed evicts key for an automatic reason, unless it is pinned or
+// the handler vetoes it, and reports whether it did. Kept files are left alone,
+// so the eviction policy still knows how often and how recently they were used.
+func (c *FileCache) evictUnlessVetoed(key string, reason EvictionReason) bool {
+	if c.isPinned(key) {
+		log.Debugf("Not evicting '%s' (%s), it is pinned", key, reason)
+		return false
+	}
+
+	storagePath, ok := c.Cache.Peek(key)
+	if !ok {
+		return false
+	}
+	decision := c.decideEviction(key, storagePath.(string), reason)
+	if decision.Veto {
+		log.Debugf("Eviction of '%s' (%s) was vetoed, keeping it", key, reason)
+		return false
+	}
+
+	c.removeDecided(key, reason, &decision)
+
+	return true
+}
+
+// evictionOrder walks the cache in the order the eviction policy would drop
+// files, from a single snapshot of its keys, so that an enforcement pass
+// doesn't copy them again for every file it evicts. Files are visited at most
+// once, which also keeps a pass from going round in circles when evictions
+// are vetoed.
+type evictionOrder struct {
+	cache  *FileCache
+	keys   []interface{}
+	match  func(entry *cacheEntry) bool // Nil for all files
+	vetoes int                          // Files skipped so far
+}
+
+// newEvictionOrder starts a walk over the files whose entries match, or all
+// of them if match is nil
+func (c *FileCache) newEvictionOrder(match func(entry *cacheEntry) bool) *evictionOrder {
+	return &evictionOrder{cache: c, keys: c.Cache.Keys(), match: match}
+}
+
+// next returns the next file to evict, skipping those which left the cache
+// since the walk started
+func (o *evictionOrder) next() (string, bool) {
+	o.cache.entriesLock.RLock()
+	defer o.cache.entriesLock.RUnlock()
+
+	for len(o.keys) > 0 {
+		filename, _ := o.keys[0].(string)
+		o.keys = o.keys[1:]
+
+		entry, ok := o.cache.entries[filename]
+		if ok && (o.match == nil || o.match(entry)) {
+			return filename, true
+		}
+	}
+
+	return "", false
+}
+
+// evictNext evicts the next file of the walk, reporting whether there was one.
+// Pinned files and vetoed evictions are skipped, up to maxVetoes of them, after
+// which files are evicted whatever the handler says.
+func (o *evictionOrder) evictNext(reason EvictionReason) bool {
+	for {
+		key, ok := o.next()
+		if !ok {
+			return false
+		}
+
+		if o.vetoes >= maxVetoes {
+			log.Warnf("Too many vetoed evictions, evicting '%s' anyway", key)
+			o.cache.removeWithReason(key, reason)
+			return true
+		}
+
+		if o.cache.evictUnlessVetoed(key, reason) {
+			return true
+		}
+		o.vetoes++
+	}
+}
+
+// makeRoom evicts files until key fits in the cache, in the order the eviction
+// policy picks but skipping pinned files and vetoed evictions, which the policy
+// can't do when it drops a file on its own to make room
+func (c *FileCache) makeRoom(key string) {
+	if c.evictionHandler == nil && !c.anyPinned() {
+		return
+	}
+	if c.Cache.Contains(key) {
+		return
+	}
+
+	order := c.newEvictionOrder(nil)
+	for c.Cache.Len() >= c.capacity() {
+		if !order.evictNext(EvictionCapacity) {
+			return
+		}
+	}
+}
+
+// takeEviction returns, and forgets, the reason recorded for evicting key, and
+// the handler's decision if it was already asked
+func (c *FileCache) takeEviction(key string) (EvictionReason, EvictionDecision, bool) {
+	c.entriesLock.Lock()
+	defer c.entriesLock.Unlock()
+
+	decision, decided := c.decisions[key]
+	delete(c.decisions, key)
+
+	reason, ok := c.reasons[key]
+	if !ok {
+		return EvictionCapacity, decision, decided
+	}
+	delete(c.reasons, key)
+
+	return reason, decision, decided
+}
+
+// recordHit counts a request served from the cache
+func (c *FileCache) recordHit(dr *DownloadRecord) {
+	c.entriesLock.Lock()
+	if entry, ok := c.entries[dr.GetUniqueName()]; ok {
+		entry.hits++
+	}
+	c.entriesLock.Unlock()
+}
+
+// decideEviction asks the handler, if any, what to do about an eviction
+func (c *FileCache) decideEviction(key, storagePath string, reason EvictionReason) EvictionDecision {
+	if c.evictionHandler == nil {
+		return EvictionDecision{}
+	}
+
+	event := &EvictionEvent{Reason: reason, Key: key, StoragePath: storagePath}
+
+	c.entriesLock.RLock()
+	if entry, ok := c.entries[key]; ok {
+		record := entry.record
+		event.Record = &record
+		event.Size = entry.size
+		event.Age = c.now().Sub(entry.addedAt)
+		event.Hits = entry.hits
+	}
+	c.entriesLock.RUnlock()
+
+	return c.evictionHandler(event)
+}
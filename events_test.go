@@ -0,0 +1,235 @@
+package filecache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Eviction events", func() {
+	var (
+		cache    *FileCache
+		baseDir  string
+		now      time.Time
+		lock     sync.Mutex
+		events   []EvictionEvent
+		decision func(event *EvictionEvent) EvictionDecision
+	)
+
+	newCache := func(size int, opts ...option) {
+		handler := func(event *EvictionEvent) EvictionDecision {
+			lock.Lock()
+			events = append(events, *event)
+			lock.Unlock()
+			return decision(event)
+		}
+		clock := func() time.Time { return now }
+
+		var err error
+		cache, err = New(size, baseDir, append([]option{EvictionHandler(handler), Clock(clock)}, opts...)...)
+		Expect(err).ShouldNot(HaveOccurred())
+		cache.DownloadFunc = func(dr *DownloadRecord, localPath string) error {
+			Expect(os.MkdirAll(filepath.Dir(localPath), 0755)).To(Succeed())
+			return ioutil.WriteFile(localPath, []byte(dr.Path), 0644)
+		}
+	}
+
+	reasons := func() []EvictionReason {
+		lock.Lock()
+		defer lock.Unlock()
+
+		var reasons []EvictionReason
+		for _, event := range events {
+			reasons = append(reasons, event.Reason)
+		}
+		return reasons
+	}
+
+	BeforeEach(func() {
+		var err error
+		baseDir, err = ioutil.TempDir("", "filecache-events")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		now = time.Now()
+		events = nil
+		decision = func(*EvictionEvent) EvictionDecision { return EvictionDecision{} }
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(baseDir)
+	})
+
+	It("rejects a nil handler", func() {
+		_, err := New(10, baseDir, EvictionHandler(nil))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("describes what was evicted", func() {
+		newCache(1)
+
+		first := &DownloadRecord{Path: "shire/bag-end.pdf"}
+		Expect(cache.Fetch(first)).To(BeTrue())
+		Expect(cache.Fetch(first)).To(BeTrue())
+		Expect(cache.Fetch(first)).To(BeTrue())
+		now = now.Add(time.Hour)
+		Expect(cache.Fetch(&DownloadRecord{Path: "shire/bywater.pdf"})).To(BeTrue())
+
+		Expect(events).To(HaveLen(1))
+		event := events[0]
+		Expect(event.Reason).To(Equal(EvictionCapacity))
+		Expect(event.Key).To(Equal(first.GetUniqueName()))
+		Expect(event.StoragePath).To(Equal(cache.GetFileName(first)))
+		Expect(event.Record.Path).To(Equal(first.Path))
+		Expect(event.Size).To(Equal(int64(len(first.Path))))
+		Expect(event.Age).To(Equal(time.Hour))
+		Expect(event.Hits).To(Equal(2))
+	})
+
+	It("leaves the values of the record's Args out", func() {
+		newCache(1)
+
+		keyed := &DownloadRecord{
+			Path:       "shire/bag-end.pdf",
+			Args:       map[string]string{"x-sse-key": "secret"},
+			HashedArgs: "5ebe2294ecd0e0f08eab7690d2a6ee69",
+		}
+		Expect(cache.Fetch(keyed)).To(BeTrue())
+		Expect(cache.Fetch(&DownloadRecord{Path: "shire/bywater.pdf"})).To(BeTrue())
+
+		Expect(events).To(HaveLen(1))
+		record := events[0].Record
+		Expect(record.Args).To(Equal(map[string]string{"x-sse-key": ""}))
+		Expect(record.GetUniqueName()).To(Equal(keyed.GetUniqueName()))
+		Expect(keyed.Args["x-sse-key"]).To(Equal("secret"))
+	})
+
+	It("tells reasons apart", func() {
+		newCache(10, DefaultTTL(time.Minute))
+
+		records := []*DownloadRecord{
+			{Path: "shire/bag-end.pdf"},
+			{Path: "shire/bywater.pdf"},
+			{Path: "shire/buckland.pdf"},
+		}
+		for _, dr := range records {
+			Expect(cache.Fetch(dr)).To(BeTrue())
+		}
+
+		cache.Remove(records[0])
+		Expect(cache.Reload(records[1])).To(BeTrue())
+		now = now.Add(2 * time.Minute)
+		Expect(cache.RemoveExpired()).To(Equal(2))
+		Expect(cache.Fetch(records[0])).To(BeTrue())
+		cache.Purge()
+
+		Expect(reasons()).To(Equal([]EvictionReason{
+			EvictionRemoved, EvictionReload, EvictionExpired, EvictionExpired, EvictionPurge,
+		}))
+		Expect(EvictionDiskPressure.String()).To(Equal("disk pressure"))
+	})
+
+	It("keeps files whose eviction was vetoed", func() {
+		precious := &DownloadRecord{Path: "mordor/the-one-ring.pdf"}
+		decision = func(event *EvictionEvent) EvictionDecision {
+			return EvictionDecision{Veto: event.Key == precious.GetUniqueName()}
+		}
+		newCache(2)
+
+		Expect(cache.Fetch(precious)).To(BeTrue())
+		for _, path := range []string{"shire/a.pdf", "shire/b.pdf", "shire/c.pdf"} {
+			Expect(cache.Fetch(&DownloadRecord{Path: path})).To(BeTrue())
+		}
+
+		Expect(cache.Contains(precious)).To(BeTrue())
+		Expect(cache.Cache.Len()).To(Equal(2))
+		_, err := os.Stat(cache.GetFileName(precious))
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	It("evicts anyway when everything is vetoed", func() {
+		decision = func(*EvictionEvent) EvictionDecision { return EvictionDecision{Veto: true} }
+		newCache(2)
+
+		for _, path := range []string{"shire/a.pdf", "shire/b.pdf", "shire/c.pdf"} {
+			Expect(cache.Fetch(&DownloadRecord{Path: path})).To(BeTrue())
+		}
+
+		Expect(cache.Cache.Len()).To(Equal(2))
+	})
+
+	It("keeps what the policy knows about files whose eviction was vetoed", func() {
+		decision = func(*EvictionEvent) EvictionDecision { return EvictionDecision{Veto: true} }
+		newCache(2, Eviction(EvictLFU))
+
+		hot := &DownloadRecord{Path: "shire/bag-end.pdf"}
+		Expect(cache.Fetch(hot)).To(BeTrue())
+		for i := 0; i < 3; i++ {
+			cache.Cache.Get(hot.GetUniqueName())
+		}
+
+		for _, path := range []string{"shire/a.pdf", "shire/b.pdf", "shire/c.pdf", "shire/d.pdf"} {
+			Expect(cache.Fetch(&DownloadRecord{Path: path})).To(BeTrue())
+			Expect(cache.Cache.Keys()[1]).To(Equal(hot.GetUniqueName()))
+		}
+
+		Expect(cache.Contains(hot)).To(BeTrue())
+		Expect(cache.Cache.Len()).To(Equal(2))
+		Expect(cache.Cache.(*lfuPolicy).items[hot.GetUniqueName()].frequency).To(Equal(4))
+	})
+
+	It("walks the files in eviction order once per pass", func() {
+		newCache(4)
+
+		paths := []string{"shire/a.pdf", "bree/b.pdf", "shire/c.pdf", "bree/d.pdf"}
+		for _, path := range paths {
+			Expect(cache.Fetch(&DownloadRecord{Path: path})).To(BeTrue())
+		}
+
+		order := cache.newEvictionOrder(func(entry *cacheEntry) bool {
+			return filepath.Dir(entry.record.Path) == "shire"
+		})
+		cache.Remove(&DownloadRecord{Path: "shire/a.pdf"})
+
+		key, ok := order.next()
+		Expect(ok).To(BeTrue())
+		Expect(key).To(Equal((&DownloadRecord{Path: "shire/c.pdf"}).GetUniqueName()))
+		_, ok = order.next()
+		Expect(ok).To(BeFalse())
+
+		order = cache.newEvictionOrder(nil)
+		for order.evictNext(EvictionCapacity) {
+		}
+		Expect(cache.Cache.Len()).To(BeZero())
+	})
+
+	It("doesn't let explicit removals be vetoed", func() {
+		decision = func(*EvictionEvent) EvictionDecision { return EvictionDecision{Veto: true} }
+		newCache(2)
+
+		dr := &DownloadRecord{Path: "shire/bag-end.pdf"}
+		Expect(cache.Fetch(dr)).To(BeTrue())
+		cache.Remove(dr)
+
+		Expect(cache.Contains(dr)).To(BeFalse())
+	})
+
+	It("postpones deleting files", func() {
+		decision = func(*EvictionEvent) EvictionDecision {
+			return EvictionDecision{Postpone: 50 * time.Millisecond}
+		}
+		newCache(2)
+
+		dr := &DownloadRecord{Path: "shire/bag-end.pdf"}
+		Expect(cache.Fetch(dr)).To(BeTrue())
+		cache.Remove(dr)
+
+		Expect(cache.Contains(dr)).To(BeFalse())
+		Expect(cache.GetFileName(dr)).To(BeAnExistingFile())
+		Eventually(func() string { return cache.GetFileName(dr) }).ShouldNot(BeAnExistingFile())
+	})
+})
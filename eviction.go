@@ -0,0 +1,779 @@
+package filecache
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/hashicorp/golang-lru"
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+// EvictionPolicy is the in-memory index of the cached files, which decides
+// which of them to drop once it is full. Implementations must call the eviction
+// callback they were built with for every entry they drop, including on Remove
+// and Purge, since that is what deletes the files from disk. Callbacks are made
+// after the policy's internal lock has been released.
+type EvictionPolicy interface {
+	// Add adds or updates an entry, returning true if it caused an eviction
+	Add(key, value interface{}) bool
+	// Get looks up an entry, counting it as a use
+	Get(key interface{}) (interface{}, bool)
+	// Peek looks up an entry without counting it as a use
+	Peek(key interface{}) (interface{}, bool)
+	Contains(key interface{}) bool
+	Remove(key interface{})
+	// RemoveOldest evicts the entry the policy would drop next
+	RemoveOldest() (interface{}, interface{}, bool)
+	// Keys returns the keys in the order the policy would drop them, the next
+	// one first
+	Keys() []interface{}
+	Len() int
+	Purge()
+}
+
+// EvictionPolicyType selects one of the built-in eviction policies
+type EvictionPolicyType int
+
+const (
+	// EvictLRU drops the least recently used file. This is the default.
+	EvictLRU EvictionPolicyType = iota
+	// EvictARC uses hashicorp/golang-lru's Adaptive Replacement Cache, which
+	// balances recency and frequency and resists scans
+	EvictARC
+	// Evict2Q uses hashicorp/golang-lru's 2Q cache, which keeps files seen
+	// only once apart from frequently used ones
+	Evict2Q
+	// EvictLFU drops the least frequently used file, breaking ties by recency
+	EvictLFU
+	// EvictCostAware drops the file which is quickest to download again,
+	// crediting each file with its measured download time, and ageing those
+	// credits so that files which are no longer used still go eventually
+	EvictCostAware
+)
+
+// evictedEntry is an entry dropped by a policy, waiting for its callback
+type evictedEntry struct {
+	key   interface{}
+	value interface{}
+}
+
+// Eviction selects the policy deciding which files to evict when the cache is
+// full. Files are deleted through the same path whatever the policy.
+func Eviction(policyType EvictionPolicyType) option {
+	return func(c *FileCache) error {
+		policy, err := newEvictionPolicy(policyType, c.size, c.onEvictDelete, c.refetchCost)
+		if err != nil {
+			return err
+		}
+
+		c.policyType = policyType
+		c.Cache = policy
+
+		return nil
+	}
+}
+
+// newEvictionPolicy builds one of the built-in policies. cost is only used by
+// EvictCostAware, and may be nil to treat all entries as equally costly.
+func newEvictionPolicy(policyType EvictionPolicyType, size int, onEvict func(key, value interface{}), cost func(key interface{}) (float64, int64)) (EvictionPolicy, error) {
+	if size <= 0 {
+		return nil, errors.New("must provide a positive size")
+	}
+
+	switch policyType {
+	case EvictLRU:
+		return newLRUPolicy(size, onEvict)
+	case EvictARC:
+		return newAdaptivePolicy(size, func(size int) (adaptiveCache, error) {
+			return lru.NewARC(size)
+		}, false, onEvict)
+	case Evict2Q:
+		return newAdaptivePolicy(size, func(size int) (adaptiveCache, error) {
+			return lru.New2Q(size)
+		}, true, onEvict)
+	case EvictLFU:
+		return newLFUPolicy(size, onEvict), nil
+	case EvictCostAware:
+		return newCostAwarePolicy(size, onEvict, cost), nil
+	default:
+		return nil, fmt.Errorf("unknown eviction policy %d", policyType)
+	}
+}
+
+// notifyEvicted makes the eviction callbacks for entries dropped by a policy
+func notifyEvicted(onEvict func(key, value interface{}), evicted []evictedEntry) {
+	if onEvict == nil {
+		return
+	}
+
+	for _, entry := range evicted {
+		onEvict(entry.key, entry.value)
+	}
+}
+
+// lruPolicy is a thread-safe wrapper around simplelru which defers the eviction
+// callbacks until its lock has been released
+type lruPolicy struct {
+	lock    sync.Mutex
+	lru     *simplelru.LRU
+	onEvict func(key, value interface{})
+	evicted []evictedEntry // Collected while locked
+}
+
+func newLRUPolicy(size int, onEvict func(key, value interface{})) (*lruPolicy, error) {
+	p := &lruPolicy{onEvict: onEvict}
+
+	cache, err := simplelru.NewLRU(size, p.collect)
+	if err != nil {
+		return nil, err
+	}
+	p.lru = cache
+
+	return p, nil
+}
+
+// collect is simplelru's eviction callback, called while locked
+func (p *lruPolicy) collect(key, value interface{}) {
+	p.evicted = append(p.evicted, evictedEntry{key, value})
+}
+
+// unlock releases the lock and then makes any pending eviction callbacks
+func (p *lruPolicy) unlock() {
+	evicted := p.evicted
+	p.evicted = nil
+	p.lock.Unlock()
+
+	notifyEvicted(p.onEvict, evicted)
+}
+
+func (p *lruPolicy) Add(key, value interface{}) bool {
+	p.lock.Lock()
+	defer p.unlock()
+	return p.lru.Add(key, value)
+}
+
+func (p *lruPolicy) Get(key interface{}) (interface{}, bool) {
+	p.lock.Lock()
+	defer p.unlock()
+	return p.lru.Get(key)
+}
+
+func (p *lruPolicy) Peek(key interface{}) (interface{}, bool) {
+	p.lock.Lock()
+	defer p.unlock()
+	return p.lru.Peek(key)
+}
+
+func (p *lruPolicy) Contains(key interface{}) bool {
+	p.lock.Lock()
+	defer p.unlock()
+	return p.lru.Contains(key)
+}
+
+func (p *lruPolicy) Remove(key interface{}) {
+	p.lock.Lock()
+	defer p.unlock()
+	p.lru.Remove(key)
+}
+
+func (p *lruPolicy) RemoveOldest() (interface{}, interface{}, bool) {
+	p.lock.Lock()
+	defer p.unlock()
+	return p.lru.RemoveOldest()
+}
+
+func (p *lruPolicy) Keys() []interface{} {
+	p.lock.Lock()
+	defer p.unlock()
+	return p.lru.Keys()
+}
+
+func (p *lruPolicy) Len() int {
+	p.lock.Lock()
+	defer p.unlock()
+	return p.lru.Len()
+}
+
+func (p *lruPolicy) Purge() {
+	p.lock.Lock()
+	defer p.unlock()
+	p.lru.Purge()
+}
+
+// Resize rebuilds the LRU with a new size, evicting the oldest entries which
+// don't fit anymore
+func (p *lruPolicy) Resize(size int) (int, error) {
+	p.lock.Lock()
+	defer p.unlock()
+
+	cache, err := simplelru.NewLRU(size, p.collect)
+	if err != nil {
+		return 0, err
+	}
+
+	// Keys come oldest first, so the newest entries are kept
+	for _, key := range p.lru.Keys() {
+		value, _ := p.lru.Peek(key)
+		cache.Add(key, value)
+	}
+	p.lru = cache
+
+	return len(p.evicted), nil
+}
+
+// adaptiveCache is the API shared by golang-lru's ARC and 2Q caches
+type adaptiveCache interface {
+	Add(key, value interface{})
+	Get(key interface{}) (interface{}, bool)
+	Peek(key interface{}) (interface{}, bool)
+	Contains(key interface{}) bool
+	Remove(key interface{})
+	Keys() []interface{}
+	Len() int
+	Purge()
+}
+
+// adaptivePolicy wraps golang-lru's ARC and 2Q caches, which don't have
+// eviction callbacks. It mirrors their contents to work out which entries they
+// dropped. They don't expose their eviction order either. ARC reports its
+// entries seen only once first, which is close enough, but 2Q reports its
+// frequently used ones first, so for 2Q the mirror also tracks which queue
+// each entry is in, and Keys and RemoveOldest go through the entries seen
+// once first.
+//
+// Both caches keep two lists, and every Add or Get hit moves the entry to the
+// front of one of them. So the mirror keeps its entries in the order they were
+// last used: an entry dropped by the cache was the oldest of its list, and the
+// only ones behind it in the mirror belong to the other list. Finding it walks
+// back from the oldest entry, which is usually just a few steps.
+type adaptivePolicy struct {
+	lock     sync.Mutex
+	cache    adaptiveCache
+	newCache func(size int) (adaptiveCache, error)
+	order    *list.List // Of evictedEntry, most recently used first
+	items    map[interface{}]*list.Element
+	queues   *twoQueueMirror // Nil for ARC
+	onEvict  func(key, value interface{})
+}
+
+func newAdaptivePolicy(size int, newCache func(size int) (adaptiveCache, error), twoQueue bool, onEvict func(key, value interface{})) (*adaptivePolicy, error) {
+	cache, err := newCache(size)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &adaptivePolicy{
+		cache:    cache,
+		newCache: newCache,
+		order:    list.New(),
+		items:    make(map[interface{}]*list.Element),
+		onEvict:  onEvict,
+	}
+	if twoQueue {
+		p.queues, err = newTwoQueueMirror(size)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// twoQueueMirror tracks which of 2Q's queues its entries are in. Entries used
+// more than once are in the frequent queue, and the ghosts are the keys 2Q
+// remembers dropping from the recent queue, which go straight to the frequent
+// one when they are added again. Its methods must be called with the policy
+// locked, and do nothing on a nil mirror.
+type twoQueueMirror struct {
+	frequent map[interface{}]bool
+	ghosts   *simplelru.LRU
+}
+
+func newTwoQueueMirror(size int) (*twoQueueMirror, error) {
+	ghosts, err := simplelru.NewLRU(int(float64(size)*lru.Default2QGhostEntries), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &twoQueueMirror{frequent: make(map[interface{}]bool), ghosts: ghosts}, nil
+}
+
+// used records a hit, or an update, which moves an entry to the frequent queue
+func (m *twoQueueMirror) used(key interface{}) {
+	if m != nil {
+		m.frequent[key] = true
+	}
+}
+
+// added records a new entry, which is frequent if 2Q remembered dropping it
+func (m *twoQueueMirror) added(key interface{}) {
+	if m != nil && m.ghosts.Remove(key) {
+		m.frequent[key] = true
+	}
+}
+
+// dropped records an entry 2Q evicted to make room
+func (m *twoQueueMirror) dropped(key interface{}) {
+	if m == nil {
+		return
+	}
+	if !m.frequent[key] {
+		m.ghosts.Add(key, nil)
+	}
+	delete(m.frequent, key)
+}
+
+// removed records an entry taken out of 2Q, which forgets it entirely
+func (m *twoQueueMirror) removed(key interface{}) {
+	if m != nil {
+		delete(m.frequent, key)
+		m.ghosts.Remove(key)
+	}
+}
+
+// purge forgets everything, along with 2Q
+func (m *twoQueueMirror) purge() {
+	if m != nil {
+		m.frequent = make(map[interface{}]bool)
+		m.ghosts.Purge()
+	}
+}
+
+// victims reorders 2Q's keys, which come frequent queue first, so that the
+// recent queue is drained first. Both queues are oldest first.
+func (m *twoQueueMirror) victims(keys []interface{}) []interface{} {
+	if m == nil {
+		return keys
+	}
+
+	victims := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		if !m.frequent[key] {
+			victims = append(victims, key)
+		}
+	}
+	for _, key := range keys {
+		if m.frequent[key] {
+			victims = append(victims, key)
+		}
+	}
+
+	return victims
+}
+
+// forget drops an entry from the mirror. Must be called locked.
+func (p *adaptivePolicy) forget(element *list.Element) evictedEntry {
+	entry := p.order.Remove(element).(evictedEntry)
+	delete(p.items, entry.key)
+	return entry
+}
+
+// collectDropped finds the entries the cache dropped, walking back from the
+// least recently used one. Must be called locked.
+func (p *adaptivePolicy) collectDropped() []evictedEntry {
+	var evicted []evictedEntry
+
+	element := p.order.Back()
+	for element != nil && p.cache.Len() < len(p.items) {
+		previous := element.Prev()
+		if key := element.Value.(evictedEntry).key; !p.cache.Contains(key) {
+			evicted = append(evicted, p.forget(element))
+			p.queues.dropped(key)
+		}
+		element = previous
+	}
+
+	return evicted
+}
+
+func (p *adaptivePolicy) Add(key, value interface{}) bool {
+	var evicted []evictedEntry
+
+	p.lock.Lock()
+	p.cache.Add(key, value)
+	if element, ok := p.items[key]; ok {
+		element.Value = evictedEntry{key, value}
+		p.order.MoveToFront(element)
+		p.queues.used(key)
+	} else {
+		p.items[key] = p.order.PushFront(evictedEntry{key, value})
+		p.queues.added(key)
+		// Adding a new key to a full cache drops another one
+		evicted = p.collectDropped()
+	}
+	p.lock.Unlock()
+
+	notifyEvicted(p.onEvict, evicted)
+
+	return len(evicted) > 0
+}
+
+func (p *adaptivePolicy) Get(key interface{}) (interface{}, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	value, ok := p.cache.Get(key)
+	if ok {
+		p.order.MoveToFront(p.items[key])
+		p.queues.used(key)
+	}
+
+	return value, ok
+}
+
+func (p *adaptivePolicy) Peek(key interface{}) (interface{}, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.cache.Peek(key)
+}
+
+func (p *adaptivePolicy) Contains(key interface{}) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.cache.Contains(key)
+}
+
+func (p *adaptivePolicy) Remove(key interface{}) {
+	var evicted []evictedEntry
+
+	p.lock.Lock()
+	p.cache.Remove(key)
+	if element, ok := p.items[key]; ok {
+		evicted = append(evicted, p.forget(element))
+	}
+	p.queues.removed(key)
+	p.lock.Unlock()
+
+	notifyEvicted(p.onEvict, evicted)
+}
+
+func (p *adaptivePolicy) RemoveOldest() (interface{}, interface{}, bool) {
+	p.lock.Lock()
+	keys := p.queues.victims(p.cache.Keys())
+	if len(keys) == 0 {
+		p.lock.Unlock()
+		return nil, nil, false
+	}
+
+	p.cache.Remove(keys[0])
+	entry := p.forget(p.items[keys[0]])
+	p.queues.removed(keys[0])
+	p.lock.Unlock()
+
+	notifyEvicted(p.onEvict, []evictedEntry{entry})
+
+	return entry.key, entry.value, true
+}
+
+func (p *adaptivePolicy) Keys() []interface{} {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.queues.victims(p.cache.Keys())
+}
+
+func (p *adaptivePolicy) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.cache.Len()
+}
+
+func (p *adaptivePolicy) Purge() {
+	var evicted []evictedEntry
+
+	p.lock.Lock()
+	for element := p.order.Front(); element != nil; element = element.Next() {
+		evicted = append(evicted, element.Value.(evictedEntry))
+	}
+	p.cache.Purge()
+	p.order = list.New()
+	p.items = make(map[interface{}]*list.Element)
+	p.queues.purge()
+	p.lock.Unlock()
+
+	notifyEvicted(p.onEvict, evicted)
+}
+
+// Resize rebuilds the cache with a new size. golang-lru's ARC and 2Q caches
+// can't be resized in place, and can't be told which entries were used more
+// than once, so the rebuilt cache starts off treating every entry as seen
+// once. Entries are added in eviction order, so a smaller cache keeps the
+// ones which were used more.
+func (p *adaptivePolicy) Resize(size int) (int, error) {
+	var evicted []evictedEntry
+
+	p.lock.Lock()
+	cache, err := p.newCache(size)
+	if err != nil {
+		p.lock.Unlock()
+		return 0, err
+	}
+	var queues *twoQueueMirror
+	if p.queues != nil {
+		queues, err = newTwoQueueMirror(size)
+		if err != nil {
+			p.lock.Unlock()
+			return 0, err
+		}
+	}
+
+	keys := p.queues.victims(p.cache.Keys())
+	for _, key := range keys {
+		value, _ := p.cache.Peek(key)
+		cache.Add(key, value)
+	}
+	p.cache = cache
+	p.queues = queues
+	for _, key := range keys {
+		if !cache.Contains(key) {
+			queues.dropped(key)
+		}
+	}
+
+	// The rebuilt cache holds everything in one list, in the order it was
+	// added, so the mirror follows that order from now on
+	order := list.New()
+	items := make(map[interface{}]*list.Element)
+	for _, key := range cache.Keys() {
+		items[key] = order.PushFront(p.forget(p.items[key]))
+	}
+	for element := p.order.Front(); element != nil; element = element.Next() {
+		evicted = append(evicted, element.Value.(evictedEntry))
+	}
+	p.order = order
+	p.items = items
+	p.lock.Unlock()
+
+	notifyEvicted(p.onEvict, evicted)
+
+	return len(evicted), nil
+}
+
+// lfuItem is an entry of the LFU policy
+type lfuItem struct {
+	key       interface{}
+	value     interface{}
+	frequency int
+	element   *list.Element // In the list for its frequency
+}
+
+// lfuPolicy evicts the least frequently used entry, and the least recently
+// used one among those. Entries are kept in one list per use count, most
+// recently used at the front, so every operation is O(1).
+type lfuPolicy struct {
+	lock         sync.Mutex
+	size         int
+	items        map[interface{}]*lfuItem
+	frequencies  map[int]*list.List
+	minFrequency int
+	onEvict      func(key, value interface{})
+}
+
+func newLFUPolicy(size int, onEvict func(key, value interface{})) *lfuPolicy {
+	return &lfuPolicy{
+		size:        size,
+		items:       make(map[interface{}]*lfuItem),
+		frequencies: make(map[int]*list.List),
+		onEvict:     onEvict,
+	}
+}
+
+// touch counts a use of the item, moving it to the next frequency list
+func (p *lfuPolicy) touch(item *lfuItem) {
+	p.unlink(item)
+	item.frequency++
+	p.link(item)
+}
+
+// link adds the item to the front of the list for its frequency
+func (p *lfuPolicy) link(item *lfuItem) {
+	items, ok := p.frequencies[item.frequency]
+	if !ok {
+		items = list.New()
+		p.frequencies[item.frequency] = items
+	}
+	item.element = items.PushFront(item)
+}
+
+// unlink takes the item out of the list for its frequency
+func (p *lfuPolicy) unlink(item *lfuItem) {
+	items := p.frequencies[item.frequency]
+	items.Remove(item.element)
+	if items.Len() == 0 {
+		delete(p.frequencies, item.frequency)
+		if p.minFrequency == item.frequency {
+			p.minFrequency++
+		}
+	}
+}
+
+// removeOldest drops the least frequently used item. Must be called locked.
+func (p *lfuPolicy) removeOldest() (*lfuItem, bool) {
+	if len(p.items) == 0 {
+		return nil, false
+	}
+
+	// minFrequency can run ahead after removals, catch up with the real one
+	for p.frequencies[p.minFrequency] == nil {
+		p.minFrequency++
+	}
+
+	item := p.frequencies[p.minFrequency].Back().Value.(*lfuItem)
+	p.unlink(item)
+	delete(p.items, item.key)
+
+	return item, true
+}
+
+func (p *lfuPolicy) Add(key, value interface{}) bool {
+	p.lock.Lock()
+	if item, ok := p.items[key]; ok {
+		item.value = value
+		p.touch(item)
+		p.lock.Unlock()
+		return false
+	}
+
+	var evicted []evictedEntry
+	if len(p.items) >= p.size {
+		if item, ok := p.removeOldest(); ok {
+			evicted = append(evicted, evictedEntry{item.key, item.value})
+		}
+	}
+
+	item := &lfuItem{key: key, value: value, frequency: 1}
+	p.items[key] = item
+	p.link(item)
+	p.minFrequency = 1
+	p.lock.Unlock()
+
+	notifyEvicted(p.onEvict, evicted)
+
+	return len(evicted) > 0
+}
+
+func (p *lfuPolicy) Get(key interface{}) (interface{}, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	item, ok := p.items[key]
+	if !ok {
+		return nil, false
+	}
+	p.touch(item)
+
+	return item.value, true
+}
+
+func (p *lfuPolicy) Peek(key interface{}) (interface{}, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	item, ok := p.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	return item.value, true
+}
+
+func (p *lfuPolicy) Contains(key interface{}) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	_, ok := p.items[key]
+	return ok
+}
+
+func (p *lfuPolicy) Remove(key interface{}) {
+	p.lock.Lock()
+	item, ok := p.items[key]
+	if ok {
+		p.unlink(item)
+		delete(p.items, key)
+	}
+	p.lock.Unlock()
+
+	if ok {
+		notifyEvicted(p.onEvict, []evictedEntry{{item.key, item.value}})
+	}
+}
+
+func (p *lfuPolicy) RemoveOldest() (interface{}, interface{}, bool) {
+	p.lock.Lock()
+	item, ok := p.removeOldest()
+	p.lock.Unlock()
+
+	if !ok {
+		return nil, nil, false
+	}
+	notifyEvicted(p.onEvict, []evictedEntry{{item.key, item.value}})
+
+	return item.key, item.value, true
+}
+
+// Keys returns the keys in eviction order, the next one to be evicted first
+func (p *lfuPolicy) Keys() []interface{} {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	frequencies := make([]int, 0, len(p.frequencies))
+	for frequency := range p.frequencies {
+		frequencies = append(frequencies, frequency)
+	}
+	sort.Ints(frequencies)
+
+	keys := make([]interface{}, 0, len(p.items))
+	for _, frequency := range frequencies {
+		for element := p.frequencies[frequency].Back(); element != nil; element = element.Prev() {
+			keys = append(keys, element.Value.(*lfuItem).key)
+		}
+	}
+
+	return keys
+}
+
+func (p *lfuPolicy) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.items)
+}
+
+func (p *lfuPolicy) Purge() {
+	var evicted []evictedEntry
+
+	p.lock.Lock()
+	for _, item := range p.items {
+		evicted = append(evicted, evictedEntry{item.key, item.value})
+	}
+	p.items = make(map[interface{}]*lfuItem)
+	p.frequencies = make(map[int]*list.List)
+	p.minFrequency = 0
+	p.lock.Unlock()
+
+	notifyEvicted(p.onEvict, evicted)
+}
+
+// Resize changes the size, evicting the least frequently used entries which
+// don't fit anymore
+func (p *lfuPolicy) Resize(size int) (int, error) {
+	if size <= 0 {
+		return 0, errors.New("must provide a positive size")
+	}
+
+	var evicted []evictedEntry
+
+	p.lock.Lock()
+	p.size = size
+	for len(p.items) > p.size {
+		item, _ := p.removeOldest()
+		evicted = append(evicted, evictedEntry{item.key, item.value})
+	}
+	p.lock.Unlock()
+
+	notifyEvicted(p.onEvict, evicted)
+
+	return len(evicted), nil
+}
@@ -0,0 +1,233 @@
+package filecache
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Eviction policies", func() {
+	var (
+		evictLock sync.Mutex
+		evicted   []interface{}
+		onEvict   func(key, value interface{})
+	)
+
+	BeforeEach(func() {
+		evicted = nil
+		onEvict = func(key, value interface{}) {
+			evictLock.Lock()
+			evicted = append(evicted, key)
+			evictLock.Unlock()
+		}
+	})
+
+	It("rejects unknown policies", func() {
+		_, err := New(10, ".", Eviction(EvictionPolicyType(42)))
+		Expect(err).To(HaveOccurred())
+	})
+
+	for _, policyType := range []EvictionPolicyType{EvictLRU, EvictARC, Evict2Q, EvictLFU, EvictCostAware} {
+		policyType := policyType
+
+		Describe(fmt.Sprintf("policy %d", policyType), func() {
+			var policy EvictionPolicy
+
+			BeforeEach(func() {
+				var err error
+				policy, err = newEvictionPolicy(policyType, 4, onEvict, nil)
+				Expect(err).ShouldNot(HaveOccurred())
+			})
+
+			It("stays within its size and reports what it evicted", func() {
+				for i := 0; i < 10; i++ {
+					policy.Add(i, fmt.Sprintf("file-%d", i))
+				}
+
+				Expect(policy.Len()).To(Equal(4))
+				Expect(evicted).To(HaveLen(6))
+				for _, key := range evicted {
+					Expect(policy.Contains(key)).To(BeFalse())
+				}
+			})
+
+			It("reports exactly the entries it dropped under a mixed workload", func() {
+				present := make(map[interface{}]bool)
+				onEvict = func(key, value interface{}) { delete(present, key) }
+				policy, _ = newEvictionPolicy(policyType, 16, onEvict, nil)
+
+				random := rand.New(rand.NewSource(42))
+				for i := 0; i < 2000; i++ {
+					key := random.Intn(40)
+					if random.Intn(3) == 0 {
+						policy.Get(key)
+						continue
+					}
+					policy.Add(key, i)
+					present[key] = true
+				}
+
+				keys := make(map[interface{}]bool)
+				for _, key := range policy.Keys() {
+					keys[key] = true
+				}
+				Expect(keys).To(Equal(present))
+			})
+
+			It("is safe for concurrent use", func() {
+				var wg sync.WaitGroup
+				for worker := 0; worker < 4; worker++ {
+					wg.Add(1)
+					go func(worker int) {
+						defer wg.Done()
+						for i := 0; i < 200; i++ {
+							key := (worker * i) % 10
+							policy.Add(key, i)
+							policy.Get(key)
+							policy.Peek(key)
+							policy.Contains(key)
+							policy.Keys()
+							policy.Len()
+						}
+					}(worker)
+				}
+				wg.Wait()
+
+				Expect(policy.Len()).To(BeNumerically("<=", 4))
+			})
+
+			It("updates existing entries without evicting", func() {
+				policy.Add("legolas", "a")
+				Expect(policy.Add("legolas", "b")).To(BeFalse())
+
+				value, ok := policy.Peek("legolas")
+				Expect(ok).To(BeTrue())
+				Expect(value).To(Equal("b"))
+				Expect(evicted).To(BeEmpty())
+			})
+
+			It("reports removals and purges", func() {
+				policy.Add("legolas", "a")
+				policy.Add("gimli", "b")
+				policy.Add("aragorn", "c")
+
+				policy.Remove("legolas")
+				Expect(evicted).To(ConsistOf("legolas"))
+
+				key, _, ok := policy.RemoveOldest()
+				Expect(ok).To(BeTrue())
+				Expect(evicted).To(ContainElement(key))
+
+				policy.Purge()
+				Expect(policy.Len()).To(Equal(0))
+				Expect(evicted).To(ConsistOf("legolas", "gimli", "aragorn"))
+
+				_, _, ok = policy.RemoveOldest()
+				Expect(ok).To(BeFalse())
+			})
+		})
+	}
+
+	Describe("EvictLFU", func() {
+		It("keeps frequently used entries over recent ones", func() {
+			policy, err := newEvictionPolicy(EvictLFU, 3, onEvict, nil)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			policy.Add("frodo", 1)
+			policy.Add("sam", 2)
+			policy.Get("frodo")
+			policy.Get("frodo")
+			policy.Get("sam")
+			policy.Add("merry", 3)
+			policy.Add("pippin", 4)
+
+			Expect(evicted).To(ConsistOf("merry"))
+			Expect(policy.Keys()).To(Equal([]interface{}{"pippin", "sam", "frodo"}))
+		})
+	})
+
+	Describe("EvictARC", func() {
+		It("resists a scan of files only seen once", func() {
+			policy, err := newEvictionPolicy(EvictARC, 4, onEvict, nil)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			policy.Add("hot", 1)
+			policy.Get("hot")
+			for i := 0; i < 20; i++ {
+				policy.Add(i, i)
+			}
+
+			Expect(policy.Contains("hot")).To(BeTrue())
+		})
+	})
+
+	Describe("Evict2Q", func() {
+		It("drops entries seen once before frequently used ones", func() {
+			policy, err := newEvictionPolicy(Evict2Q, 4, onEvict, nil)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			policy.Add("hot", 1)
+			policy.Get("hot")
+			policy.Add("frodo", 2)
+			policy.Add("sam", 3)
+
+			Expect(policy.Keys()).To(Equal([]interface{}{"frodo", "sam", "hot"}))
+
+			key, _, ok := policy.RemoveOldest()
+			Expect(ok).To(BeTrue())
+			Expect(key).To(Equal("frodo"))
+		})
+
+		It("resists a scan of files only seen once under a byte budget", func() {
+			baseDir, err := ioutil.TempDir("", "filecache-eviction")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer os.RemoveAll(baseDir)
+
+			cache, err := New(10, baseDir, Eviction(Evict2Q), MaxBytes(250))
+			Expect(err).ShouldNot(HaveOccurred())
+			cache.DownloadFunc = func(dr *DownloadRecord, localPath string) error {
+				Expect(os.MkdirAll(filepath.Dir(localPath), 0755)).To(Succeed())
+				return ioutil.WriteFile(localPath, bytes.Repeat([]byte("x"), 100), 0644)
+			}
+
+			hot := &DownloadRecord{Path: "shire/frodo.pdf"}
+			Expect(cache.Fetch(hot)).To(BeTrue())
+			cache.Cache.Get(hot.GetUniqueName())
+
+			for i := 0; i < 20; i++ {
+				Expect(cache.Fetch(&DownloadRecord{Path: fmt.Sprintf("moria/%d.pdf", i)})).To(BeTrue())
+			}
+
+			Expect(cache.Contains(hot)).To(BeTrue())
+			Expect(cache.Cache.Len()).To(Equal(2))
+		})
+	})
+
+	It("deletes evicted files from disk whatever the policy", func() {
+		baseDir, err := ioutil.TempDir("", "filecache-eviction")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(baseDir)
+
+		cache, err := New(1, baseDir, Eviction(EvictARC))
+		Expect(err).ShouldNot(HaveOccurred())
+		cache.DownloadFunc = func(dr *DownloadRecord, localPath string) error {
+			Expect(os.MkdirAll(filepath.Dir(localPath), 0755)).To(Succeed())
+			return ioutil.WriteFile(localPath, []byte(dr.Path), 0644)
+		}
+
+		first := &DownloadRecord{Path: "moria/balin.pdf"}
+		Expect(cache.Fetch(first)).To(BeTrue())
+		Expect(cache.Fetch(&DownloadRecord{Path: "moria/ori.pdf"})).To(BeTrue())
+
+		Expect(cache.Contains(first)).To(BeFalse())
+		_, err = os.Stat(cache.GetFileName(first))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+})
@@ -1,19 +1,29 @@
+// Package filecache implements a local, rudimentary file cache backed by an
+// S3 bucket, which is useful for a file caching service.
+//
+// Upgrading: FileCache.Cache is now an EvictionPolicy rather than a
+// *lru.Cache, which breaks code naming golang-lru's types or calling
+// ContainsOrAdd. Its Add, Get, Peek, Contains, Remove, Keys, Len and Purge
+// work as before.
 package filecache
 
 import (
+	"context"
 	"crypto/md5"
 	"errors"
 	"fmt"
 	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/djherbis/times"
-	"github.com/hashicorp/golang-lru"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -24,6 +34,13 @@ const (
 
 var (
 	errInvalidURLPath = errors.New("invalid URL path")
+	// ErrNotModified is returned by downloaders when a conditional request
+	// finds that the origin object still matches the record's Validators
+	ErrNotModified = errors.New("not modified")
+	// ErrNoLocalPath is returned by FileName and Lease.FileName when files are
+	// stored compressed or encrypted, since they can then only be read with
+	// Open and OpenStream
+	ErrNoLocalPath = errors.New("cached files are stored encoded, read them with Open")
 	// HashableArgs allows us to support various authentication headers in the future
 	HashableArgs = map[string]struct{}{}
 )
@@ -36,32 +53,168 @@ type DownloadRecord struct {
 	Path       string
 	Args       map[string]string
 	HashedArgs string
+
+	// Validators, when set, asks the downloader to make a conditional request
+	// and to return ErrNotModified if the origin object hasn't changed
+	Validators *ObjectInfo
+	// Info is filled in by the downloader with the origin's object metadata
+	Info *ObjectInfo
+	// TTL overrides the cache's DefaultTTL for this record when set
+	TTL time.Duration
+	// ExpectedDigest, when set, is checked against the downloaded file along
+	// with any checksums reported by the origin
+	ExpectedDigest *Digest
+
+	// progress is told how a download is going, for streaming readers
+	progress *downloadProgress
+	// verified is the digest the download was checked against
+	verified *Digest
+	// validated is set once the Validators passed the download
+	validated bool
+	// transferTime is how long the downloader took to fetch the file from
+	// the origin, leaving out what the cache did with it afterwards
+	transferTime time.Duration
+	// limit holds the download to the maximum object size as it is written
+	limit *sizeLimit
+}
+
+// ObjectInfo holds the metadata reported by the origin for an object
+type ObjectInfo struct {
+	ETag         string
+	LastModified time.Time
+	// Digests are the checksums of the object's contents reported along with
+	// it, which downloads are verified against
+	Digests []Digest
+	// ContentType is the MIME type reported for the object, or once it is
+	// cached, the one detected for it
+	ContentType string
+	// Size is the size of the object in bytes, -1 if the origin didn't say
+	Size int64
+}
+
+// objectInfoFromHeader extracts the object metadata from an HTTP response
+func objectInfoFromHeader(header http.Header) *ObjectInfo {
+	info := &ObjectInfo{
+		ETag:        header.Get("ETag"),
+		Digests:     digestsFromHeader(header),
+		ContentType: header.Get("Content-Type"),
+		Size:        sizeFromHeader(header),
+	}
+
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err == nil {
+		info.LastModified = lastModified
+	}
+
+	return info
+}
+
+// cacheEntry holds what we know about a file in the cache, besides its path
+type cacheEntry struct {
+	info        ObjectInfo
+	validatedAt time.Time
+	expiresAt   time.Time // Zero if it never expires
+	size        int64
+	fetchCost   time.Duration // How long the transfer took, zero if unknown
+	partition   string
+	identity    string // HashedArgs, empty for files shared by everyone
+	record      DownloadRecord
+	addedAt     time.Time
+	hits        int
+	digest      *Digest // What the download was verified against, if anything
+	blob        string  // SHA-256 of the content-addressed blob, if any
 }
 
 type RecordDownloaderFunc = func(dr *DownloadRecord, localFile *os.File) error
 
 // FileCache is a wrapper for hashicorp/golang-lru
 type FileCache struct {
+	// Updated atomically, so they come first to keep them 64-bit aligned
+	admitted   uint64
+	rejected   uint64
+	pending    int64 // Bytes queued for deletion
+	reclaiming int32 // Set while making room after running out of space
+
 	BaseDir          string
-	Cache            *lru.Cache
+	Cache            EvictionPolicy // Was a *lru.Cache before the policy could be picked
 	Waiting          map[string]chan struct{}
 	WaitLock         sync.Mutex
+	streams          map[string]*downloadProgress // Guarded by WaitLock
+	results          map[string]*fetchResult      // Guarded by WaitLock
+	removals         map[string]bool              // Guarded by WaitLock
+	entries          map[string]*cacheEntry
+	entriesLock      sync.RWMutex
+	usedBytes        int64            // Guarded by entriesLock
+	blobs            map[string]*blob // Guarded by entriesLock, nil unless ContentAddressed
+	blobsLock        sync.Mutex       // Held while linking and deleting blobs
+	maxBytes         int64            // Guarded by limitsLock, like size
+	limitsLock       sync.RWMutex
+	resizeLock       sync.Mutex
+	pins             map[string]*pin // Guarded by pinsLock
+	pinsLock         sync.Mutex
+	partitionFunc    PartitionFunc
+	partitions       map[string]*PartitionUsage // Guarded by entriesLock
+	partitionBudgets map[string]PartitionBudget
+	defaultBudget    PartitionBudget
+	overflow         PartitionBudget
+	identityQuota    int64
+	identities       map[string]*PartitionUsage // Guarded by entriesLock
+	diskHigh         float64
+	diskLow          float64
+	diskInterval     time.Duration
+	diskLock         sync.Mutex
+	volumeUsage      func(path string) (total, free uint64, err error)
+	reasons          map[string]EvictionReason   // Guarded by entriesLock
+	decisions        map[string]EvictionDecision // Guarded by entriesLock
+	deletions        chan deletion
+	deletionsClosed  bool // Guarded by deletionsLock
+	deletionsLock    sync.Mutex
+	deleterDone      chan struct{}
+	evictionHandler  EvictionHandlerFunc
+	compression      []CompressionRule
+	codecs           map[string]Codec
+	keys             KeyProvider
+	staging          string // Where to write files before encrypting them
+	typedNames       bool   // Extensions come from content types
+	checks           []Validator
+	quarantineDir    string
+	rejectionTTL     time.Duration
+	rejections       map[string]rejection // Guarded by WaitLock
+	rejectionsSwept  time.Time            // Guarded by WaitLock
+	sizes            *SizePolicy
 	DownloadFunc     func(dr *DownloadRecord, localPath string) error
 	OnEvict          func(key interface{}, value interface{})
 	DefaultExtension string
 	DownloadTimeout  time.Duration
 	downloaders      map[DownloadManager]RecordDownloaderFunc
+	statters         map[DownloadManager]RecordStatFunc
+	uploaders        map[DownloadManager]RecordUploaderFunc
+	freshness        FreshnessMode
+	defaultTTL       time.Duration
+	janitorInterval  time.Duration
+	now              func() time.Time
+	done             chan struct{}
+	closeOnce        sync.Once
+	size             int
+	policyType       EvictionPolicyType
+	admission        AdmissionPolicy
+	sseCustomerKeys  SSECustomerKeyProvider
+	s3Credentials    S3CredentialResolver
+	s3Region         string
+	s3Once           sync.Once
+	s3               *S3RegionManagedDownloader
 }
 
 type option func(*FileCache) error
 
 func setSize(size int) option {
 	return func(c *FileCache) error {
-		cache, err := lru.NewWithEvict(size, c.onEvictDelete)
+		cache, err := newEvictionPolicy(c.policyType, size, c.onEvictDelete, c.refetchCost)
 		if err != nil {
 			return fmt.Errorf("invalid size: %s", err)
 		}
 
+		c.size = size
 		c.Cache = cache
 
 		return nil
@@ -99,29 +252,82 @@ func DefaultExtension(ext string) option {
 	}
 }
 
-// S3Downloader allows the DownloadFunc to pull files from S3 buckets.
-// Bucket names are passed at the first part of the path in files requested
-// from the cache. Bubbles up errors from the Hashicrorp LRU library
+// S3Downloader allows the DownloadFunc to pull files from S3 buckets, and Put
+// to write them. Bucket names are passed at the first part of the path in files
+// requested from the cache. Bubbles up errors from the Hashicrorp LRU library
 // when something goes wrong there.
 func S3Downloader(awsRegion string) option {
 	return func(c *FileCache) error {
+		c.s3Region = awsRegion
 		c.downloaders[DownloadMangerS3] = func(dr *DownloadRecord, localFile *os.File) error {
-			return NewS3RegionManagedDownloader(awsRegion).Download(
-				dr, localFile, c.DownloadTimeout,
-			)
+			return c.s3Manager().Download(dr, dr.limit.writerAt(dr.progress.writerAt(localFile)), c.DownloadTimeout)
+		}
+		c.statters[DownloadMangerS3] = func(dr *DownloadRecord) (*ObjectInfo, error) {
+			return c.s3Manager().Stat(dr, c.DownloadTimeout)
+		}
+		c.uploaders[DownloadMangerS3] = func(ctx context.Context, dr *DownloadRecord, body io.ReadSeeker) error {
+			return c.s3Manager().Upload(ctx, dr, body)
+		}
+
+		return nil
+	}
+}
+
+// S3SSECustomerKey configures the S3 downloader to request objects encrypted
+// with customer-provided keys (SSE-C), using the key returned by the provider
+// for each DownloadRecord. See ArgsSSECustomerKey for taking the key from the
+// record's Args.
+func S3SSECustomerKey(provider SSECustomerKeyProvider) option {
+	return func(c *FileCache) error {
+		if provider == nil {
+			return errors.New("nil SSE-C key provider")
+		}
+
+		c.sseCustomerKeys = provider
+
+		return nil
+	}
+}
+
+// S3Credentials configures the S3 downloader to resolve per-bucket or
+// per-record AWS identities instead of always using the ambient process
+// credentials. See BucketCredentials and ArgsCredentials.
+func S3Credentials(resolver S3CredentialResolver) option {
+	return func(c *FileCache) error {
+		if resolver == nil {
+			return errors.New("nil S3 credential resolver")
 		}
 
+		c.s3Credentials = resolver
+
 		return nil
 	}
 }
 
+// s3Manager returns the S3 downloader shared by all downloads from this cache,
+// creating it on first use so that it picks up every S3 option regardless of
+// the order they were passed to New().
+func (c *FileCache) s3Manager() *S3RegionManagedDownloader {
+	c.s3Once.Do(func() {
+		c.s3 = NewS3RegionManagedDownloader(c.s3Region)
+		c.s3.SSECustomerKeyProvider = c.sseCustomerKeys
+		c.s3.CredentialResolver = c.s3Credentials
+		c.s3.AllowEmpty = c.sizes != nil && c.sizes.AllowEmpty
+	})
+
+	return c.s3
+}
+
 // DropboxDownloader allows the DownloadFunc to pull files from Dropbox
 // accounts. Bubbles up errors from the Hashicrorp LRU library when
 // something goes wrong there.
 func DropboxDownloader() option {
 	return func(c *FileCache) error {
 		c.downloaders[DownloadMangerDropbox] = func(dr *DownloadRecord, localFile *os.File) error {
-			return DropboxDownload(dr, localFile, c.DownloadTimeout)
+			return DropboxDownload(dr, dr.limit.writer(dr.progress.writer(localFile)), c.DownloadTimeout)
+		}
+		c.statters[DownloadMangerDropbox] = func(dr *DownloadRecord) (*ObjectInfo, error) {
+			return DropboxStat(dr, c.DownloadTimeout)
 		}
 
 		return nil
@@ -129,8 +335,15 @@ func DropboxDownloader() option {
 }
 
 // download is a generic wrapper which performs common actions before delegating to the
-// specific downloader implementations
+// specific downloader implementations. Files are downloaded next to localPath and
+// only renamed into place once complete, so a cached copy is never clobbered by
+// a failed or not modified download.
 func (c *FileCache) download(dr *DownloadRecord, localPath string) error {
+	downloader, ok := c.downloaders[dr.Manager]
+	if !ok {
+		return fmt.Errorf("no dowloader found for %q", dr.Path)
+	}
+
 	directory := filepath.Dir(localPath)
 	if directory != "." {
 		// Make sure the path to the local file exists
@@ -141,17 +354,65 @@ func (c *FileCache) download(dr *DownloadRecord, localPath string) error {
 		}
 	}
 
-	localFile, err := os.Create(localPath)
+	err := c.preflightSize(dr)
+	if err != nil {
+		return err
+	}
+
+	localFile, err := ioutil.TempFile(c.stagingDir(localPath), filepath.Base(localPath)+".download-")
 	if err != nil {
 		return fmt.Errorf("could not create local file: %s", err)
 	}
+	defer os.Remove(localFile.Name()) // Fails harmlessly once renamed
 	defer localFile.Close()
+	dr.progress.start(localFile.Name())
+
+	dr.limit = c.newSizeLimit()
+	startTime := time.Now()
+	err = downloader(dr, localFile)
+	dr.transferTime = time.Since(startTime)
+	if dr.limit.wasExceeded() {
+		log.Warnf("Aborted download of %s, which went over %d bytes", dr.Path, dr.limit.max)
+		return ErrObjectTooLarge
+	}
+	if err != nil {
+		return err
+	}
+
+	err = c.checkSize(dr, localFile)
+	if err != nil {
+		return err
+	}
+
+	dr.verified, err = verifyDownload(dr, localFile)
+	if err != nil {
+		return err
+	}
+
+	err = c.validate(dr, localFile)
+	if err != nil {
+		return err
+	}
+	dr.validated = true
+
+	storedPath, err := c.compress(dr, localFile)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(storedPath) // Fails harmlessly once renamed
+
+	storedPath, err = c.encrypt(dr, storedPath, localPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(storedPath) // Fails harmlessly once renamed
 
-	if downloader, ok := c.downloaders[dr.Manager]; ok {
-		return downloader(dr, localFile)
+	err = dr.progress.rename(storedPath, localPath)
+	if err != nil {
+		return fmt.Errorf("could not move download into place: %s", err)
 	}
 
-	return fmt.Errorf("no dowloader found for %q", dr.Path)
+	return nil
 }
 
 // New returns a properly configured cache. Bubbles up errors from the Hashicrorp
@@ -161,7 +422,21 @@ func (c *FileCache) download(dr *DownloadRecord, localPath string) error {
 func New(size int, baseDir string, opts ...option) (*FileCache, error) {
 	fCache := &FileCache{
 		Waiting:     make(map[string]chan struct{}),
+		streams:     make(map[string]*downloadProgress),
+		results:     make(map[string]*fetchResult),
+		removals:    make(map[string]bool),
+		rejections:  make(map[string]rejection),
+		entries:     make(map[string]*cacheEntry),
+		identities:  make(map[string]*PartitionUsage),
+		reasons:     make(map[string]EvictionReason),
+		decisions:   make(map[string]EvictionDecision),
+		pins:        make(map[string]*pin),
 		downloaders: make(map[DownloadManager]RecordDownloaderFunc),
+		statters:    make(map[DownloadManager]RecordStatFunc),
+		uploaders:   make(map[DownloadManager]RecordUploaderFunc),
+		now:         time.Now,
+		volumeUsage: volumeUsage,
+		done:        make(chan struct{}),
 	}
 	fCache.DownloadFunc = fCache.download
 
@@ -180,41 +455,62 @@ func New(size int, baseDir string, opts ...option) (*FileCache, error) {
 		}
 	}
 
+	if err := fCache.checkStagingDir(); err != nil {
+		return nil, err
+	}
+
+	if fCache.janitorInterval > 0 {
+		go fCache.runJanitor(fCache.janitorInterval)
+	}
+
+	if fCache.diskHigh > 0 && fCache.diskInterval > 0 {
+		go fCache.runDiskMonitor(fCache.diskInterval)
+	}
+
+	if fCache.deletions != nil {
+		go fCache.runDeleter()
+	}
+
 	return fCache, nil
 }
 
+// Close stops the background goroutines of the cache, after deleting the files
+// still queued for deletion. The cached files are left on disk.
+func (c *FileCache) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.flushDeletions()
+	})
+
+	return nil
+}
+
 // FetchNewerThan will look in the cache for a file, make sure it's newer than
 // timestamp, and if so return true. Otherwise it will possibly download the file
 // and only return false if it's unable to do so.
+// See Freshness() for what the timestamp is compared with.
 func (c *FileCache) FetchNewerThan(dr *DownloadRecord, timestamp time.Time) bool {
-	if !c.Contains(dr) {
-		return c.Fetch(dr)
-	}
-
-	storagePath := c.GetFileName(dr)
-	stat, err := times.Stat(storagePath)
+	_, err := c.FetchNewerThanStatus(dr, timestamp)
 	if err != nil {
-		return c.Fetch(dr)
-	}
-
-	// We use mtime because the file could have been overwritten with new data
-	// Compare the timestamp, and need to check the cache again... could have changed
-	if c.Contains(dr) && timestamp.Before(stat.ModTime()) {
-		return true
+		log.Errorf("Tried to fetch file %s, got '%s'", dr.Path, err)
+		return false
 	}
 
-	return c.Reload(dr)
+	return true
 }
 
 // Fetch will return true if we have the file, or will go download the file and
 // return true if we can. It will return false only if it's unable to fetch the
 // file from the backing store (S3).
 func (c *FileCache) Fetch(dr *DownloadRecord) bool {
+	c.recordAccess(dr)
+
 	if c.Contains(dr) {
+		c.recordHit(dr)
 		return true
 	}
 
-	err := c.MaybeDownload(dr)
+	_, err := c.maybeDownload(dr, false)
 	if err != nil {
 		log.Errorf("Tried to fetch file %s, got '%s'", dr.Path, err)
 		return false
@@ -226,7 +522,7 @@ func (c *FileCache) Fetch(dr *DownloadRecord) bool {
 // Reload will remove a file from the cache and attempt to reload from the
 // backing store, calling MaybeDownload().
 func (c *FileCache) Reload(dr *DownloadRecord) bool {
-	c.Cache.Remove(dr.GetUniqueName())
+	c.removeWithReason(dr.GetUniqueName(), EvictionReload)
 
 	err := c.MaybeDownload(dr)
 	if err != nil {
@@ -237,29 +533,89 @@ func (c *FileCache) Reload(dr *DownloadRecord) bool {
 	return true
 }
 
-// Contains looks to see if we have an entry in the cache for this file.
+// Revalidate checks with the backing store whether the cached copy of a file is
+// still current, using the ETag and Last-Modified recorded when it was
+// downloaded. If the origin reports it unchanged, only the entry's freshness is
+// updated. Otherwise, or when the entry has no validators, the file is
+// downloaded again and replaces the cached copy once complete.
+func (c *FileCache) Revalidate(dr *DownloadRecord) error {
+	_, err := c.maybeDownload(dr, true)
+	return err
+}
+
+// Contains looks to see if we have an entry in the cache for this file, which
+// hasn't expired.
 func (c *FileCache) Contains(dr *DownloadRecord) bool {
-	return c.Cache.Contains(dr.GetUniqueName())
+	return c.Cache.Contains(dr.GetUniqueName()) && !c.isExpired(dr.GetUniqueName())
 }
 
 // MaybeDownload might go out to the backing store (S3) and get the file if the
 // file isn't already being downloaded in another routine. In both cases it will
 // block until the download is completed either by this goroutine or another one.
 func (c *FileCache) MaybeDownload(dr *DownloadRecord) error {
+	c.recordAccess(dr)
+
+	_, err := c.maybeDownload(dr, false)
+	return err
+}
+
+// maybeDownload implements MaybeDownload and Revalidate. With revalidate set, a
+// file which is already in the cache is downloaded again with a conditional
+// request. Reports whether new content was downloaded, by us or by the
+// goroutine we waited for.
+func (c *FileCache) maybeDownload(dr *DownloadRecord, revalidate bool) (bool, error) {
+	return c.fetch(dr, revalidate, nil)
+}
+
+// fetchResult is how a download went, for the callers who waited on it. It is
+// written before the download's Waiting channel is closed.
+type fetchResult struct {
+	downloaded bool
+	err        error
+}
+
+// fetch implements maybeDownload. When a download is made, or is already in
+// progress, its downloadProgress is sent to follow, if set, before waiting for
+// it to finish. At most one is ever sent. Callers who wait on someone else's
+// download get its result.
+func (c *FileCache) fetch(dr *DownloadRecord, revalidate bool, follow chan<- *downloadProgress) (downloaded bool, err error) {
 	// See if someone is already downloading
 	c.WaitLock.Lock()
 	if waitChan, ok := c.Waiting[dr.GetUniqueName()]; ok {
+		progress := c.streams[dr.GetUniqueName()]
+		result := c.results[dr.GetUniqueName()]
 		c.WaitLock.Unlock()
 
+		if follow != nil && progress != nil {
+			follow <- progress
+			follow = nil // Nobody may be reading a second one
+		}
+
 		log.Debugf("Awaiting download of %s", dr.Path)
 		<-waitChan
-		return nil
+
+		// Uploads and key rotations don't report a result, so look again
+		if result == nil {
+			return c.fetch(dr, revalidate, follow)
+		}
+		return result.downloaded, result.err
 	}
 
 	// The file could have arrived while we were getting here
-	if c.Contains(dr) {
+	var validators *ObjectInfo
+	if c.Cache.Contains(dr.GetUniqueName()) {
+		if !revalidate && !c.isExpired(dr.GetUniqueName()) {
+			c.WaitLock.Unlock()
+			c.recordHit(dr)
+			return false, nil
+		}
+		// Our copy is stale or expired, but may still be good
+		validators = c.validators(dr)
+	}
+
+	if rejected := c.pastRejection(dr); rejected != nil {
 		c.WaitLock.Unlock()
-		return nil
+		return false, rejected
 	}
 
 	// Still don't have it, let's fetch it.
@@ -267,50 +623,264 @@ func (c *FileCache) MaybeDownload(dr *DownloadRecord) error {
 	// lets us signal completion.
 	log.Debugf("Making channel for %s", dr.Path)
 	c.Waiting[dr.GetUniqueName()] = make(chan struct{})
+	progress := newDownloadProgress(func(path string) (int64, error) {
+		return c.contentSize(dr, path)
+	})
+	c.streams[dr.GetUniqueName()] = progress
+	result := &fetchResult{}
+	c.results[dr.GetUniqueName()] = result
 	c.WaitLock.Unlock()
 
+	if follow != nil {
+		follow <- progress
+	}
+
+	storagePath := c.storagePath(dr)
+	previousPath := storagePath
+
 	// Ensure we don't leave the channel open when leaving this function
 	defer func() {
+		progress.finish(storagePath, err) // Tell streaming readers how it went
+
+		result.downloaded, result.err = downloaded, err
+
 		c.WaitLock.Lock()
 		log.Debugf("Deleting channel for %s", dr.Path)
-		close(c.Waiting[dr.GetUniqueName()])  // Notify anyone waiting on us
-		delete(c.Waiting, dr.GetUniqueName()) // Remove it from the waiting map
-		c.WaitLock.Unlock()
+		delete(c.streams, dr.GetUniqueName())
+		delete(c.results, dr.GetUniqueName())
+		// Removing an evicted copy left for us to replace, if we didn't
+		c.releaseWaiting(dr.GetUniqueName(), previousPath)
 	}()
 
-	storagePath := c.GetFileName(dr)
-	err := c.DownloadFunc(dr, storagePath)
+	// Don't hand our bookkeeping back to the caller through their record
+	attempt := *dr
+	attempt.Validators = validators
+	attempt.Info = nil
+	attempt.progress = progress
+
+	if err := c.checkDiskSpace(); err != nil {
+		log.Warn(err)
+	}
+
+	startTime := time.Now()
+	err = c.DownloadFunc(&attempt, storagePath)
+	if isNoSpace(err) {
+		log.Warnf("Ran out of disk space downloading %s, evicting and retrying: %s", dr.Path, err)
+		c.reclaimDiskSpace()
+
+		attempt.Info = nil
+		attempt.transferTime = 0
+		startTime = time.Now()
+		err = c.DownloadFunc(&attempt, storagePath)
+	}
+	// A custom DownloadFunc is timed as a whole
+	fetchCost := time.Since(startTime)
+	if attempt.transferTime > 0 {
+		fetchCost = attempt.transferTime
+	}
+	if err == ErrNotModified {
+		log.Debugf("%s not modified, refreshing", dr.Path)
+		return false, c.refresh(dr, storagePath)
+	}
+	if err == nil && !attempt.validated {
+		err = c.validateStored(dr, storagePath)
+	}
 	if err != nil {
-		return err
+		c.rememberRejection(dr, err)
+		return false, err
+	}
+
+	if !c.admit(dr) {
+		log.Debugf("%s was not admitted to the cache", dr.Path)
+		storagePath = c.serveOnce(dr.GetUniqueName(), storagePath, progress)
+		return true, nil
 	}
 
+	if attempt.Info == nil {
+		attempt.Info = &ObjectInfo{Size: -1}
+	}
+	attempt.Info.ContentType = c.storedContentType(&attempt, storagePath)
+	storagePath = c.placeByContentType(dr, storagePath, attempt.Info.ContentType, progress)
+
+	c.setEntry(dr, storagePath, attempt.Info, attempt.verified, fetchCost)
+	c.makeRoom(dr.GetUniqueName())
 	c.Cache.Add(dr.GetUniqueName(), storagePath)
+	c.enforceBudgets(dr)
+
+	return true, nil
+}
+
+// validators returns the ETag and Last-Modified stored for a cached file, or
+// nil when we don't have any to make a conditional request with.
+func (c *FileCache) validators(dr *DownloadRecord) *ObjectInfo {
+	c.entriesLock.RLock()
+	defer c.entriesLock.RUnlock()
+
+	entry, ok := c.entries[dr.GetUniqueName()]
+	if !ok || (entry.info.ETag == "" && entry.info.LastModified.IsZero()) {
+		return nil
+	}
+
+	info := entry.info
+	return &info
+}
+
+// setEntry records the origin metadata for a freshly downloaded file, along
+// with its size on disk and how long it took to fetch
+func (c *FileCache) setEntry(dr *DownloadRecord, storagePath string, info *ObjectInfo, digest *Digest, fetchCost time.Duration) {
+	now := c.now()
+	entry := &cacheEntry{
+		validatedAt: now,
+		fetchCost:   fetchCost,
+		partition:   c.partitionOf(dr),
+		record:      dr.withoutSecrets(),
+		addedAt:     now,
+		digest:      digest,
+	}
+	if len(dr.Args) > 0 {
+		entry.identity = dr.HashedArgs
+	}
+	if info != nil {
+		entry.info = *info
+	}
+	if ttl := c.ttl(dr); ttl > 0 {
+		entry.expiresAt = now.Add(ttl)
+	}
+	if stat, err := os.Stat(storagePath); err == nil {
+		entry.size = stat.Size()
+	}
+
+	var sum string
+	// Encrypted files are never the same, and may belong to different tenants
+	if c.blobs != nil && c.keys == nil {
+		var err error
+		sum, err = contentSum(storagePath, digest)
+		if err != nil {
+			log.Warnf("Unable to hash '%s', storing it separately: %s", storagePath, err)
+		}
+	}
+
+	// The blob must not be deleted between linking to it and counting us
+	if sum != "" {
+		c.blobsLock.Lock()
+		entry.blob = c.linkBlob(storagePath, sum)
+	}
+
+	// Add before removing, so that a blob we share with our previous version
+	// isn't deleted
+	c.entriesLock.Lock()
+	c.addUsage(entry)
+	previous, replaced := c.entries[dr.GetUniqueName()]
+	if replaced {
+		c.removeUsage(previous)
+	}
+	c.entries[dr.GetUniqueName()] = entry
+	c.entriesLock.Unlock()
+
+	if sum != "" {
+		c.blobsLock.Unlock()
+	}
+	if replaced {
+		c.removeUnusedBlob(previous.blob)
+	}
+}
+
+// refresh marks a cached file as current after the origin reported that it
+// hasn't changed, restarting its TTL. The file's mtime is bumped too, unless
+// it is a blob shared with other keys, which weren't revalidated.
+func (c *FileCache) refresh(dr *DownloadRecord, storagePath string) error {
+	c.entriesLock.Lock()
+	entry, ok := c.entries[dr.GetUniqueName()]
+	if ok {
+		entry.validatedAt = c.now()
+		if ttl := c.ttl(dr); ttl > 0 {
+			entry.expiresAt = entry.validatedAt.Add(ttl)
+		}
+	}
+	shared := ok && entry.blob != ""
+	c.entriesLock.Unlock()
+
+	if !shared {
+		now := time.Now()
+		err := os.Chtimes(storagePath, now, now)
+		if err != nil {
+			return fmt.Errorf("could not refresh local file: %s", err)
+		}
+	}
+
+	// Not modified means recently used, as far as the cache is concerned
+	c.Cache.Get(dr.GetUniqueName())
 
 	return nil
 }
 
-// onEvictDelete is a callback that is triggered when the LRU cache expires an
-// entry.
+// onEvictDelete is a callback that is triggered when the eviction policy
+// expires an entry.
 func (c *FileCache) onEvictDelete(key interface{}, value interface{}) {
 	filename := key.(string)
 	storagePath := value.(string)
 
+	reason, decision, decided := c.takeEviction(filename)
+	if !decided {
+		decision = c.decideEviction(filename, storagePath, reason)
+	}
+	// Vetoes are heeded before files are evicted, too late for this one
+	if decision.Veto {
+		log.Warnf("Ignoring veto of '%s' eviction of '%s'", reason, key)
+	}
+
 	if c.OnEvict != nil {
 		c.OnEvict(key, value)
 	}
 
-	log.Debugf("Got eviction notice for '%s', removing", key)
+	var size int64
+	c.entriesLock.Lock()
+	entry, ok := c.entries[filename]
+	if ok {
+		size = c.removeUsage(entry)
+		delete(c.entries, filename)
+	}
+	c.entriesLock.Unlock()
 
-	err := os.Remove(storagePath)
-	if err != nil {
-		log.Errorf("Unable to evict '%s' at local path '%s': %s", filename, storagePath, err)
+	if ok {
+		c.removeUnusedBlob(entry.blob)
+	}
+
+	if c.deferIfPinned(filename, storagePath) {
+		log.Debugf("Got eviction notice for '%s' (%s), removing once released", key, reason)
 		return
 	}
+
+	if decision.Postpone > 0 {
+		log.Debugf("Got eviction notice for '%s' (%s), removing in %s", key, reason, decision.Postpone)
+		c.scheduleRemoval(filename, storagePath, decision.Postpone)
+		return
+	}
+
+	log.Debugf("Got eviction notice for '%s' (%s), removing", key, reason)
+	c.deleteFile(filename, storagePath, size)
 }
 
 // Purge clears all the files from the cache (via the onEvict callback for each key).
 func (c *FileCache) Purge() {
+	keys := c.Cache.Keys()
+	c.entriesLock.Lock()
+	for _, key := range keys {
+		if filename, ok := key.(string); ok {
+			c.reasons[filename] = EvictionPurge
+		}
+	}
+	c.entriesLock.Unlock()
+
 	c.Cache.Purge()
+
+	c.entriesLock.Lock()
+	for _, key := range keys {
+		if filename, ok := key.(string); ok {
+			delete(c.reasons, filename)
+		}
+	}
+	c.entriesLock.Unlock()
 }
 
 // PurgeAsync clears all the files from the cache and takes an optional channel
@@ -329,19 +899,42 @@ func (c *FileCache) PurgeAsync(doneChan chan struct{}) {
 // cache. This builds a cache structure of up to 256 directories, each beginning
 // with the first 2 letters of the FNV32 hash of the filename. This is then joined
 // to the base dir and MD5 hashed filename to form the cache path for each file.
-// It preserves the file extension (if present)
+// It preserves the file extension (if present), unless ExtensionFromContentType
+// is set, in which case cached files are where their content type put them.
+// Files the admission filter kept out of the cache are at a temporary path for
+// a while after they were fetched, which is returned instead.
 //
 // e.g. /base_dir/2b/b0804ec967f48520697662a204f5fe72
 //
+// Files stored by Compression or EncryptAtRest are still there, but can't be
+// read as they are. FileName fails for them instead.
 func (c *FileCache) GetFileName(dr *DownloadRecord) string {
-	hashedFilename := md5.Sum([]byte(dr.Path))
-	fnvHasher := fnv.New32()
-	// The current implementation of fnv.New32().Write never returns a non-nil error
-	_, err := fnvHasher.Write([]byte(dr.Path))
-	if err != nil {
-		log.Errorf("Failed to compute the fnv hash: %s", err)
+	if transient, ok := c.notAdmittedPath(dr); ok {
+		return transient
+	}
+	return c.storagePath(dr)
+}
+
+// FileName returns the path a file can be read from, as described for
+// GetFileName. It fails with ErrNoLocalPath when Compression or EncryptAtRest
+// is configured, since files are then stored in a form which only Open and
+// OpenStream can read.
+func (c *FileCache) FileName(dr *DownloadRecord) (string, error) {
+	if c.storesEncoded() {
+		return "", ErrNoLocalPath
+	}
+
+	return c.GetFileName(dr), nil
+}
+
+// storagePath returns where the file for a record is stored, as described for
+// GetFileName, leaving out files which weren't admitted to the cache
+func (c *FileCache) storagePath(dr *DownloadRecord) string {
+	if c.typedNames {
+		if storagePath, ok := c.Cache.Peek(dr.GetUniqueName()); ok {
+			return storagePath.(string)
+		}
 	}
-	hashedDir := fnvHasher.Sum(nil)
 
 	// If we don't find an original file extension, we'll default to this one
 	extension := c.DefaultExtension
@@ -352,6 +945,20 @@ func (c *FileCache) GetFileName(dr *DownloadRecord) string {
 		extension = dr.Path[lastDot:]
 	}
 
+	return c.fileName(dr, extension)
+}
+
+// fileName returns the storage path for a file with the given extension
+func (c *FileCache) fileName(dr *DownloadRecord, extension string) string {
+	hashedFilename := md5.Sum([]byte(dr.Path))
+	fnvHasher := fnv.New32()
+	// The current implementation of fnv.New32().Write never returns a non-nil error
+	_, err := fnvHasher.Write([]byte(dr.Path))
+	if err != nil {
+		log.Errorf("Failed to compute the fnv hash: %s", err)
+	}
+	hashedDir := fnvHasher.Sum(nil)
+
 	var fileName string
 	if len(dr.Args) != 0 {
 		// in order to avoid file cache collision on the same filename, if we
@@ -367,24 +974,35 @@ func (c *FileCache) GetFileName(dr *DownloadRecord) string {
 }
 
 // getHashedArgs computes the MD5 sum of the arguments existing in a DownloadRecord
-// matching HashableArgs array and return the hashed value as a hex-encoded string
+// matching HashableArgs array and return the hashed value as a hex-encoded string.
+// A single argument is hashed on its own. Several are hashed in order of their
+// names, each name and value prefixed with its length, so that the same
+// arguments always hash the same and different ones can't run into each other.
+// Files cached under several arguments before this was the case were named after
+// them in random order, so they are fetched again under their new names.
 func getHashedArgs(args map[string]string) string {
 	if len(args) == 0 {
 		return ""
 	}
 
-	var builder strings.Builder
-	for hashableArg := range HashableArgs {
-		if arg, ok := args[hashableArg]; ok {
-			_, err := builder.WriteString(arg)
-			if err != nil {
-				continue
-			}
+	names := make([]string, 0, len(args))
+	for name := range args {
+		if _, ok := HashableArgs[name]; ok {
+			names = append(names, name)
 		}
 	}
 
-	if builder.Len() == 0 {
+	var builder strings.Builder
+	switch len(names) {
+	case 0:
 		return ""
+	case 1:
+		builder.WriteString(args[names[0]])
+	default:
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(&builder, "%d:%s%d:%s", len(name), name, len(args[name]), args[name])
+		}
 	}
 
 	hashedArgs := md5.Sum([]byte(builder.String()))
@@ -438,6 +1056,21 @@ func NewDownloadRecord(url string, args map[string]string) (*DownloadRecord, err
 	}, nil
 }
 
+// withoutSecrets returns a copy of the record which is safe to keep around. Args
+// may hold secrets, like SSE-C keys, so the copy only keeps their names, which
+// is enough for it to name the same file.
+func (dr *DownloadRecord) withoutSecrets() DownloadRecord {
+	record := *dr
+	if len(dr.Args) > 0 {
+		record.Args = make(map[string]string, len(dr.Args))
+		for arg := range dr.Args {
+			record.Args[arg] = ""
+		}
+	}
+
+	return record
+}
+
 // GetUniqueName returns a *HOPEFULLY* unique name for the download record
 func (dr *DownloadRecord) GetUniqueName() string {
 	if len(dr.Args) > 0 {
@@ -1,6 +1,8 @@
 package filecache
 
 import (
+	"os"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
@@ -11,3 +13,9 @@ func TestFilecache(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Filecache Suite")
 }
+
+// stubDownloads makes the cache fetch records of the Dropbox manager with
+// download, for specs which need the hooks only downloaders get
+func stubDownloads(cache *FileCache, download func(dr *DownloadRecord, localFile *os.File) error) {
+	cache.downloaders[DownloadMangerDropbox] = download
+}
@@ -256,6 +256,113 @@ var _ = Describe("Filecache", func() {
 		})
 	})
 
+	Describe("Revalidate()", func() {
+		var (
+			dr          *DownloadRecord
+			storagePath string
+			validators  *ObjectInfo
+			notModified bool
+		)
+
+		BeforeEach(func() {
+			cache, err = New(10, os.TempDir(), DownloadTimeout(1*time.Millisecond))
+			Expect(err).ShouldNot(HaveOccurred())
+
+			validators = nil
+			notModified = true
+			downloadCount = 0
+			cache.DownloadFunc = func(dr *DownloadRecord, localPath string) error {
+				validators = dr.Validators
+				if dr.Validators != nil && notModified {
+					return ErrNotModified
+				}
+				downloadCount++
+				dr.Info = &ObjectInfo{ETag: `"v2"`}
+				return ioutil.WriteFile(localPath, []byte("new bytes"), 0644)
+			}
+
+			dr = &DownloadRecord{Path: "faramir.pdf"}
+			storagePath = cache.GetFileName(dr)
+			Expect(os.MkdirAll(filepath.Dir(storagePath), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(storagePath, []byte("old bytes"), 0644)).To(Succeed())
+			old := time.Now().Add(-1 * time.Hour)
+			Expect(os.Chtimes(storagePath, old, old)).To(Succeed())
+
+			cache.Cache.Add(dr.GetUniqueName(), storagePath)
+		})
+
+		AfterEach(func() {
+			os.Remove(storagePath)
+		})
+
+		It("only refreshes the entry when the origin reports it unchanged", func() {
+			cache.setEntry(dr, cache.GetFileName(dr), &ObjectInfo{ETag: `"v1"`}, nil, 0)
+
+			Expect(cache.Revalidate(dr)).To(Succeed())
+			Expect(validators).NotTo(BeNil())
+			Expect(validators.ETag).To(Equal(`"v1"`))
+			Expect(downloadCount).To(Equal(0))
+
+			content, _ := ioutil.ReadFile(storagePath)
+			Expect(string(content)).To(Equal("old bytes"))
+
+			stat, _ := os.Stat(storagePath)
+			Expect(stat.ModTime()).To(BeTemporally("~", time.Now(), time.Minute))
+		})
+
+		It("replaces the file and its validators when the origin changed", func() {
+			cache.setEntry(dr, cache.GetFileName(dr), &ObjectInfo{ETag: `"v1"`}, nil, 0)
+			notModified = false
+
+			Expect(cache.Revalidate(dr)).To(Succeed())
+			Expect(downloadCount).To(Equal(1))
+			Expect(cache.validators(dr).ETag).To(Equal(`"v2"`))
+
+			content, _ := ioutil.ReadFile(storagePath)
+			Expect(string(content)).To(Equal("new bytes"))
+		})
+
+		It("downloads the file again when there are no validators", func() {
+			Expect(cache.Revalidate(dr)).To(Succeed())
+			Expect(validators).To(BeNil())
+			Expect(downloadCount).To(Equal(1))
+		})
+
+		It("doesn't leak the validators into the caller's record", func() {
+			cache.setEntry(dr, cache.GetFileName(dr), &ObjectInfo{ETag: `"v1"`}, nil, 0)
+
+			Expect(cache.Revalidate(dr)).To(Succeed())
+			Expect(dr.Validators).To(BeNil())
+			Expect(dr.Info).To(BeNil())
+		})
+	})
+
+	Describe("download()", func() {
+		It("keeps the cached copy when the download fails", func() {
+			cache, err = New(10, os.TempDir())
+			Expect(err).ShouldNot(HaveOccurred())
+			cache.downloaders[DownloadMangerS3] = func(dr *DownloadRecord, localFile *os.File) error {
+				_, err := localFile.WriteString("partial")
+				Expect(err).ShouldNot(HaveOccurred())
+				return errors.New("connection reset")
+			}
+
+			dr := &DownloadRecord{Path: "boromir.pdf"}
+			storagePath := cache.GetFileName(dr)
+			Expect(os.MkdirAll(filepath.Dir(storagePath), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(storagePath, []byte("complete"), 0644)).To(Succeed())
+			defer os.Remove(storagePath)
+
+			Expect(cache.download(dr, storagePath)).NotTo(Succeed())
+
+			content, _ := ioutil.ReadFile(storagePath)
+			Expect(string(content)).To(Equal("complete"))
+
+			leftovers, _ := filepath.Glob(storagePath + ".download-*")
+			Expect(leftovers).To(BeEmpty())
+		})
+	})
+
 	Describe("Reload()", func() {
 		BeforeEach(func() {
 			cache, err = New(10, os.TempDir(), S3Downloader("gondor-north-1"), DownloadTimeout(1*time.Millisecond))
@@ -356,6 +463,13 @@ var _ = Describe("Filecache", func() {
 			Expect(dir2).To(Equal("dc"))
 		})
 
+		It("is what FileName returns for files stored as they are", func() {
+			dr := &DownloadRecord{Path: "james_joyce.pdf"}
+			fname, err := cache.FileName(dr)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fname).To(Equal(cache.GetFileName(dr)))
+		})
+
 		Context("With DowloadRecord with existing Args", func() {
 			It("should include the hashed arguments and extension with _ prefix", func() {
 				cache, _ = New(10, "mordor-south-1", DropboxDownloader(), DownloadTimeout(1*time.Millisecond))
@@ -441,5 +555,45 @@ var _ = Describe("Filecache", func() {
 
 			Expect(mockRecord.HashedArgs).To(Equal(want))
 		})
+
+		It("hashes several args the same whatever their order", func() {
+			HashableArgs["x-sse-key"] = struct{}{}
+			defer delete(HashableArgs, "x-sse-key")
+
+			args := map[string]string{
+				"DropboxAccessToken": "Frodo",
+				"X-SSE-Key":          "Baggins",
+			}
+			sum := md5.Sum([]byte("18:dropboxaccesstoken5:Frodo9:x-sse-key7:Baggins"))
+			want := fmt.Sprintf("%x", sum[:])
+
+			// Maps are iterated in a different order every time
+			for i := 0; i < 20; i++ {
+				mockRecord, _ := NewDownloadRecord(dropboxFilePath, args)
+				Expect(mockRecord.HashedArgs).To(Equal(want))
+			}
+		})
+
+		It("names files with several args after their sorted names and values", func() {
+			HashableArgs["x-sse-key"] = struct{}{}
+			defer delete(HashableArgs, "x-sse-key")
+
+			args := map[string]string{
+				"DropboxAccessToken": "Frodo",
+				"X-SSE-Key":          "Baggins",
+			}
+			mockRecord, _ := NewDownloadRecord(dropboxFilePath, args)
+
+			Expect(cache.GetFileName(mockRecord)).To(HaveSuffix("_d49edffa7149ca521844818a7160e1f9.bar"))
+		})
+
+		It("keeps several args from running into each other", func() {
+			HashableArgs["x-sse-key"] = struct{}{}
+			defer delete(HashableArgs, "x-sse-key")
+
+			split, _ := NewDownloadRecord(dropboxFilePath, map[string]string{"DropboxAccessToken": "Fro", "X-SSE-Key": "doBaggins"})
+			joined, _ := NewDownloadRecord(dropboxFilePath, map[string]string{"DropboxAccessToken": "Frodo", "X-SSE-Key": "Baggins"})
+			Expect(split.HashedArgs).NotTo(Equal(joined.HashedArgs))
+		})
 	})
 })
@@ -0,0 +1,136 @@
+package filecache
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/djherbis/times"
+	log "github.com/sirupsen/logrus"
+)
+
+// FreshnessMode selects what FetchNewerThan compares the caller's timestamp with
+type FreshnessMode int
+
+const (
+	// FreshnessLocal compares with when the file was last downloaded or
+	// revalidated, or with the local file's mtime for files added behind the
+	// cache's back. This is the default.
+	FreshnessLocal FreshnessMode = iota
+	// FreshnessOrigin compares with the origin's Last-Modified, as recorded
+	// when the file was downloaded. Entries without one fall back to
+	// FreshnessLocal.
+	FreshnessOrigin
+	// FreshnessOriginHead works like FreshnessOrigin, but when the entry looks
+	// stale it asks the origin for its current Last-Modified with a HEAD
+	// request and only downloads again if the origin actually has a newer
+	// object.
+	FreshnessOriginHead
+)
+
+// RecordStatFunc looks up the origin's metadata for a record without
+// downloading it
+type RecordStatFunc = func(dr *DownloadRecord) (*ObjectInfo, error)
+
+// Freshness sets how FetchNewerThan decides whether a cached file is new enough
+func Freshness(mode FreshnessMode) option {
+	return func(c *FileCache) error {
+		switch mode {
+		case FreshnessLocal, FreshnessOrigin, FreshnessOriginHead:
+			c.freshness = mode
+			return nil
+		default:
+			return fmt.Errorf("unknown freshness mode %d", mode)
+		}
+	}
+}
+
+// FetchNewerThanStatus works like FetchNewerThan, but returns the error instead
+// of logging it, and reports whether the file was refreshed, meaning that new
+// content was downloaded from the origin.
+func (c *FileCache) FetchNewerThanStatus(dr *DownloadRecord, timestamp time.Time) (refreshed bool, err error) {
+	c.recordAccess(dr)
+
+	if !c.Contains(dr) {
+		return c.maybeDownload(dr, false)
+	}
+
+	fresh, err := c.isNewerThan(dr, timestamp)
+	if err != nil {
+		// The file vanished from under us, so the entry is no good
+		log.Warnf("Unable to stat cached copy of %s, downloading it again: %s", dr.Path, err)
+		c.removeWithReason(dr.GetUniqueName(), EvictionReload)
+		return c.maybeDownload(dr, false)
+	}
+
+	// Need to check the cache again... could have changed
+	if fresh && c.Contains(dr) {
+		c.recordHit(dr)
+		return false, nil
+	}
+
+	return c.maybeDownload(dr, true)
+}
+
+// isNewerThan reports whether the cached copy of a file is newer than timestamp,
+// according to the configured FreshnessMode
+func (c *FileCache) isNewerThan(dr *DownloadRecord, timestamp time.Time) (bool, error) {
+	if c.freshness == FreshnessLocal {
+		return c.isLocalNewerThan(dr, timestamp)
+	}
+
+	var lastModified time.Time
+	if validators := c.validators(dr); validators != nil {
+		lastModified = validators.LastModified
+	}
+
+	if lastModified.IsZero() && c.freshness == FreshnessOrigin {
+		return c.isLocalNewerThan(dr, timestamp)
+	}
+
+	if !lastModified.IsZero() && timestamp.Before(lastModified) {
+		return true, nil
+	}
+
+	if c.freshness != FreshnessOriginHead {
+		return false, nil
+	}
+
+	// Our copy is older than the caller wants, but there's no point in
+	// downloading it again unless the origin has something newer
+	info, err := c.stat(dr)
+	if err != nil {
+		log.Warnf("Unable to HEAD %s, assuming it is stale: %s", dr.Path, err)
+		return false, nil
+	}
+
+	return !lastModified.IsZero() && !info.LastModified.IsZero() && !info.LastModified.After(lastModified), nil
+}
+
+// isLocalNewerThan compares the timestamp with when the cached file was last
+// downloaded or revalidated. That is recorded in its entry rather than read
+// from its mtime, since deduplicated files share one inode, and so one mtime,
+// with other keys. Files without an entry fall back to the mtime.
+func (c *FileCache) isLocalNewerThan(dr *DownloadRecord, timestamp time.Time) (bool, error) {
+	stat, err := times.Stat(c.storagePath(dr))
+	if err != nil {
+		return false, err
+	}
+
+	c.entriesLock.RLock()
+	entry, ok := c.entries[dr.GetUniqueName()]
+	c.entriesLock.RUnlock()
+	if ok {
+		return timestamp.Before(entry.validatedAt), nil
+	}
+
+	return timestamp.Before(stat.ModTime()), nil
+}
+
+// stat asks the record's backing store for the object's current metadata
+func (c *FileCache) stat(dr *DownloadRecord) (*ObjectInfo, error) {
+	if statter, ok := c.statters[dr.Manager]; ok {
+		return statter(dr)
+	}
+
+	return nil, fmt.Errorf("no stat function found for %q", dr.Path)
+}
@@ -0,0 +1,176 @@
+package filecache
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Freshness", func() {
+	var (
+		cache         *FileCache
+		dr            *DownloadRecord
+		storagePath   string
+		downloadCount int
+		statCount     int
+		originInfo    *ObjectInfo
+		lastWeek      = time.Now().Add(-7 * 24 * time.Hour)
+		yesterday     = time.Now().Add(-24 * time.Hour)
+	)
+
+	newCache := func(mode FreshnessMode) {
+		var err error
+		cache, err = New(10, os.TempDir(), Freshness(mode))
+		Expect(err).ShouldNot(HaveOccurred())
+
+		downloadCount = 0
+		statCount = 0
+		originInfo = &ObjectInfo{LastModified: lastWeek}
+
+		cache.DownloadFunc = func(dr *DownloadRecord, localPath string) error {
+			downloadCount++
+			dr.Info = &ObjectInfo{LastModified: originInfo.LastModified}
+			return ioutil.WriteFile(localPath, []byte("éowyn"), 0644)
+		}
+		cache.statters[DownloadMangerS3] = func(dr *DownloadRecord) (*ObjectInfo, error) {
+			statCount++
+			return originInfo, nil
+		}
+
+		dr = &DownloadRecord{Path: "rohan/eowyn.pdf"}
+		storagePath = cache.GetFileName(dr)
+		Expect(os.MkdirAll(filepath.Dir(storagePath), 0755)).To(Succeed())
+
+		// Downloaded just now, but the origin copy is from last week
+		_, err = cache.maybeDownload(dr, false)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(downloadCount).To(Equal(1))
+	}
+
+	AfterEach(func() {
+		os.Remove(storagePath)
+	})
+
+	It("rejects unknown modes", func() {
+		_, err := New(10, ".", Freshness(FreshnessMode(42)))
+		Expect(err).To(HaveOccurred())
+	})
+
+	Context("with FreshnessLocal", func() {
+		BeforeEach(func() { newCache(FreshnessLocal) })
+
+		It("trusts the local mtime", func() {
+			refreshed, err := cache.FetchNewerThanStatus(dr, yesterday)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(refreshed).To(BeFalse())
+			Expect(downloadCount).To(Equal(1))
+		})
+	})
+
+	Context("with FreshnessOrigin", func() {
+		BeforeEach(func() { newCache(FreshnessOrigin) })
+
+		It("compares with the origin's Last-Modified", func() {
+			refreshed, err := cache.FetchNewerThanStatus(dr, yesterday)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(refreshed).To(BeTrue())
+			Expect(downloadCount).To(Equal(2))
+		})
+
+		It("doesn't refresh entries the origin last modified after the timestamp", func() {
+			refreshed, err := cache.FetchNewerThanStatus(dr, lastWeek.Add(-time.Hour))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(refreshed).To(BeFalse())
+			Expect(downloadCount).To(Equal(1))
+			Expect(statCount).To(Equal(0))
+		})
+	})
+
+	Context("with callers joining a download in progress", func() {
+		BeforeEach(func() { newCache(FreshnessOrigin) })
+
+		// joined runs a revalidation which finishes with outcome, and returns
+		// what a second caller who joined it while it was in progress got
+		joined := func(outcome error) (bool, error) {
+			release := make(chan struct{})
+			cache.DownloadFunc = func(dr *DownloadRecord, localPath string) error {
+				<-release
+				return outcome
+			}
+
+			go cache.FetchNewerThanStatus(dr, yesterday)
+
+			type fetched struct {
+				downloaded bool
+				err        error
+			}
+			following := make(chan *downloadProgress, 1)
+			done := make(chan fetched, 1)
+			Eventually(func() bool {
+				cache.WaitLock.Lock()
+				defer cache.WaitLock.Unlock()
+				_, downloading := cache.Waiting[dr.GetUniqueName()]
+				return downloading
+			}).Should(BeTrue())
+			go func() {
+				downloaded, err := cache.fetch(dr, true, following)
+				done <- fetched{downloaded, err}
+			}()
+
+			<-following
+			close(release)
+			result := <-done
+			return result.downloaded, result.err
+		}
+
+		It("tells them when the origin reported no change", func() {
+			refreshed, err := joined(ErrNotModified)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(refreshed).To(BeFalse())
+		})
+
+		It("hands them the error of a failed download", func() {
+			refreshed, err := joined(errors.New("the beacons are unlit"))
+			Expect(err).To(MatchError("the beacons are unlit"))
+			Expect(refreshed).To(BeFalse())
+		})
+	})
+
+	Context("with FreshnessOriginHead", func() {
+		BeforeEach(func() { newCache(FreshnessOriginHead) })
+
+		It("doesn't download again when the origin has nothing newer", func() {
+			refreshed, err := cache.FetchNewerThanStatus(dr, yesterday)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(refreshed).To(BeFalse())
+			Expect(statCount).To(Equal(1))
+			Expect(downloadCount).To(Equal(1))
+		})
+
+		It("downloads again when the origin has a newer object", func() {
+			originInfo = &ObjectInfo{LastModified: time.Now()}
+
+			refreshed, err := cache.FetchNewerThanStatus(dr, yesterday)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(refreshed).To(BeTrue())
+			Expect(statCount).To(Equal(1))
+			Expect(downloadCount).To(Equal(2))
+			Expect(cache.validators(dr).LastModified).To(Equal(originInfo.LastModified))
+		})
+	})
+
+	It("downloads files which vanished from disk", func() {
+		newCache(FreshnessLocal)
+		Expect(os.Remove(storagePath)).To(Succeed())
+
+		refreshed, err := cache.FetchNewerThanStatus(dr, yesterday)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(refreshed).To(BeTrue())
+		Expect(downloadCount).To(Equal(2))
+	})
+})
@@ -0,0 +1,64 @@
+package filecache
+
+import (
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// IdentityQuota caps the bytes each identity may keep in the cache. Records
+// with Args are cached privately per HashedArgs, so each credential set gets
+// its own copies; once an identity goes over its quota, its own files are
+// evicted first, in the order the eviction policy picks, rather than anyone
+// else's. Records without Args are shared and not subject to the quota. With
+// ContentAddressed, files of an identity which have the same contents are
+// charged once.
+func IdentityQuota(bytes int64) option {
+	return func(c *FileCache) error {
+		if bytes <= 0 {
+			return errors.New("must provide a positive identity quota")
+		}
+
+		c.identityQuota = bytes
+
+		return nil
+	}
+}
+
+// IdentityUsage returns the bytes cached privately for each identity, keyed by
+// HashedArgs
+func (c *FileCache) IdentityUsage() map[string]int64 {
+	c.entriesLock.RLock()
+	defer c.entriesLock.RUnlock()
+
+	usage := make(map[string]int64, len(c.identities))
+	for identity, identityUsage := range c.identities {
+		usage[identity] = identityUsage.Bytes
+	}
+
+	return usage
+}
+
+// identityOverQuota reports whether an identity needs to give up files. The
+// last one is always kept.
+func (c *FileCache) identityOverQuota(identity string) bool {
+	c.entriesLock.RLock()
+	defer c.entriesLock.RUnlock()
+
+	usage, ok := c.identities[identity]
+	return ok && usage.Entries > 1 && usage.Bytes > c.identityQuota
+}
+
+// enforceIdentityQuota evicts an identity's own files until it fits in its
+// quota again
+func (c *FileCache) enforceIdentityQuota(identity string) {
+	order := c.newEvictionOrder(func(entry *cacheEntry) bool {
+		return entry.identity == identity
+	})
+	for c.identityOverQuota(identity) {
+		log.Debugf("Evicting to keep identity '%s' within its quota", identity)
+		if !order.evictNext(EvictionCapacity) {
+			return
+		}
+	}
+}
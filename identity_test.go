@@ -0,0 +1,93 @@
+package filecache
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Identity quotas", func() {
+	var (
+		cache   *FileCache
+		baseDir string
+	)
+
+	record := func(identity string, i int) *DownloadRecord {
+		return &DownloadRecord{
+			Path:       fmt.Sprintf("documents/file-%d.pdf", i),
+			Args:       map[string]string{"x-amz-meta-user": identity},
+			HashedArgs: identity,
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		baseDir, err = ioutil.TempDir("", "filecache-identity")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		cache, err = New(100, baseDir, IdentityQuota(250))
+		Expect(err).ShouldNot(HaveOccurred())
+		cache.DownloadFunc = func(dr *DownloadRecord, localPath string) error {
+			Expect(os.MkdirAll(filepath.Dir(localPath), 0755)).To(Succeed())
+			return ioutil.WriteFile(localPath, bytes.Repeat([]byte("x"), 100), 0644)
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(baseDir)
+	})
+
+	It("rejects empty quotas", func() {
+		_, err := New(10, baseDir, IdentityQuota(0))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("evicts a heavy user's own files first", func() {
+		light := record("samwise", 0)
+		Expect(cache.Fetch(light)).To(BeTrue())
+		shared := &DownloadRecord{Path: "documents/shared.pdf"}
+		Expect(cache.Fetch(shared)).To(BeTrue())
+
+		for i := 0; i < 5; i++ {
+			Expect(cache.Fetch(record("boromir", i))).To(BeTrue())
+		}
+
+		Expect(cache.Contains(light)).To(BeTrue())
+		Expect(cache.Contains(shared)).To(BeTrue())
+		Expect(cache.Contains(record("boromir", 0))).To(BeFalse())
+		Expect(cache.Contains(record("boromir", 4))).To(BeTrue())
+		Expect(cache.IdentityUsage()).To(Equal(map[string]int64{
+			"samwise": 100,
+			"boromir": 200,
+		}))
+	})
+
+	It("charges files of an identity with the same contents once", func() {
+		dedup, err := New(100, baseDir, IdentityQuota(250), ContentAddressed())
+		Expect(err).ShouldNot(HaveOccurred())
+		dedup.DownloadFunc = cache.DownloadFunc
+
+		for i := 0; i < 5; i++ {
+			Expect(dedup.Fetch(record("boromir", i))).To(BeTrue())
+		}
+		Expect(dedup.Fetch(record("faramir", 0))).To(BeTrue())
+
+		Expect(dedup.Contains(record("boromir", 0))).To(BeTrue())
+		Expect(dedup.IdentityUsage()).To(Equal(map[string]int64{
+			"boromir": 100,
+			"faramir": 100,
+		}))
+
+		dedup.Remove(record("boromir", 0))
+		Expect(dedup.IdentityUsage()).To(HaveKeyWithValue("boromir", int64(100)))
+		for i := 1; i < 5; i++ {
+			dedup.Remove(record("boromir", i))
+		}
+		Expect(dedup.IdentityUsage()).NotTo(HaveKey("boromir"))
+	})
+})
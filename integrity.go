@@ -0,0 +1,276 @@
+package filecache
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DigestAlgorithm names the way a Digest was computed
+type DigestAlgorithm string
+
+const (
+	DigestMD5    DigestAlgorithm = "md5"
+	DigestSHA1   DigestAlgorithm = "sha1"
+	DigestSHA256 DigestAlgorithm = "sha256"
+	DigestCRC32  DigestAlgorithm = "crc32"
+	DigestCRC32C DigestAlgorithm = "crc32c"
+	// DigestDropbox is Dropbox's content_hash: the SHA-256 of the SHA-256s of
+	// every 4MiB block of the file
+	DigestDropbox DigestAlgorithm = "dropbox"
+)
+
+// digestStrength ranks the algorithms, to pick the digest to keep when the
+// origin reports several
+var digestStrength = map[DigestAlgorithm]int{
+	DigestCRC32:   1,
+	DigestCRC32C:  1,
+	DigestMD5:     2,
+	DigestSHA1:    3,
+	DigestDropbox: 4,
+	DigestSHA256:  4,
+}
+
+// dropboxBlockSize is the size of the blocks hashed by DigestDropbox
+const dropboxBlockSize = 4 * 1024 * 1024
+
+// Digest is a checksum of a file's contents
+type Digest struct {
+	Algorithm DigestAlgorithm
+	Value     []byte
+}
+
+func (d Digest) String() string {
+	return fmt.Sprintf("%s:%s", d.Algorithm, hex.EncodeToString(d.Value))
+}
+
+// IntegrityError is returned when a downloaded file doesn't match the digest
+// reported by the origin or expected by the caller. The file is discarded.
+type IntegrityError struct {
+	Path     string
+	Expected Digest
+	Actual   Digest
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("integrity check failed for %s: expected %s, got %s", e.Path, e.Expected, e.Actual)
+}
+
+// newDigester returns a hash for the algorithm, or nil if it isn't supported
+func newDigester(algorithm DigestAlgorithm) hash.Hash {
+	switch algorithm {
+	case DigestMD5:
+		return md5.New()
+	case DigestSHA1:
+		return sha1.New()
+	case DigestSHA256:
+		return sha256.New()
+	case DigestCRC32:
+		return crc32.NewIEEE()
+	case DigestCRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case DigestDropbox:
+		return newDropboxHash()
+	default:
+		return nil
+	}
+}
+
+// dropboxHash computes Dropbox's content_hash
+type dropboxHash struct {
+	block     hash.Hash
+	blockLen  int
+	blockSums []byte
+}
+
+func newDropboxHash() *dropboxHash {
+	return &dropboxHash{block: sha256.New()}
+}
+
+func (h *dropboxHash) Write(b []byte) (int, error) {
+	written := len(b)
+	for len(b) > 0 {
+		n := dropboxBlockSize - h.blockLen
+		if n > len(b) {
+			n = len(b)
+		}
+		h.block.Write(b[:n])
+		h.blockLen += n
+		b = b[n:]
+
+		if h.blockLen == dropboxBlockSize {
+			h.blockSums = h.block.Sum(h.blockSums)
+			h.block.Reset()
+			h.blockLen = 0
+		}
+	}
+
+	return written, nil
+}
+
+func (h *dropboxHash) Sum(b []byte) []byte {
+	sums := h.blockSums
+	if h.blockLen > 0 {
+		sums = h.block.Sum(append([]byte(nil), sums...))
+	}
+	overall := sha256.Sum256(sums)
+	return append(b, overall[:]...)
+}
+
+func (h *dropboxHash) Reset() {
+	h.block.Reset()
+	h.blockLen = 0
+	h.blockSums = nil
+}
+
+func (h *dropboxHash) Size() int { return sha256.Size }
+
+func (h *dropboxHash) BlockSize() int { return dropboxBlockSize }
+
+// digestsFromHeader extracts the checksums an origin reported in an HTTP
+// response: Digest and Repr-Digest, Content-MD5, S3's x-amz-checksum-* and
+// the content_hash in Dropbox-API-Result. Composite checksums of multipart
+// objects can't be checked against the file and are skipped.
+func digestsFromHeader(header http.Header) []Digest {
+	var digests []Digest
+	add := func(algorithm DigestAlgorithm, encoded string, decode func(string) ([]byte, error)) {
+		if encoded == "" || strings.Contains(encoded, "-") {
+			return
+		}
+		value, err := decode(encoded)
+		if err != nil {
+			log.Debugf("Ignoring malformed %s checksum %q: %s", algorithm, encoded, err)
+			return
+		}
+		digests = append(digests, Digest{Algorithm: algorithm, Value: value})
+	}
+	base64Decode := base64.StdEncoding.DecodeString
+
+	// RFC 3230 Digest, and RFC 9530 Repr-Digest which wraps values in colons
+	for _, name := range []string{"Digest", "Repr-Digest"} {
+		for _, field := range header[http.CanonicalHeaderKey(name)] {
+			for _, pair := range strings.Split(field, ",") {
+				parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(parts) != 2 {
+					continue
+				}
+				value := strings.Trim(parts[1], ":")
+				switch strings.ToLower(parts[0]) {
+				case "md5":
+					add(DigestMD5, value, base64Decode)
+				case "sha":
+					add(DigestSHA1, value, base64Decode)
+				case "sha-256":
+					add(DigestSHA256, value, base64Decode)
+				}
+			}
+		}
+	}
+
+	add(DigestMD5, header.Get("Content-MD5"), base64Decode)
+	add(DigestSHA256, header.Get("X-Amz-Checksum-Sha256"), base64Decode)
+	add(DigestSHA1, header.Get("X-Amz-Checksum-Sha1"), base64Decode)
+	add(DigestCRC32, header.Get("X-Amz-Checksum-Crc32"), base64Decode)
+	add(DigestCRC32C, header.Get("X-Amz-Checksum-Crc32c"), base64Decode)
+
+	if result := header.Get("Dropbox-API-Result"); result != "" {
+		var metadata struct {
+			ContentHash string `json:"content_hash"`
+		}
+		if err := json.Unmarshal([]byte(result), &metadata); err == nil {
+			add(DigestDropbox, metadata.ContentHash, hex.DecodeString)
+		}
+	}
+
+	return digests
+}
+
+// verifyDownload checks a downloaded file against the digests reported by the
+// origin in dr.Info and the one expected by the caller, if any. It returns the
+// digest to keep for the file: the expected one, or else the strongest one
+// reported, or nil when there was nothing to check against.
+func verifyDownload(dr *DownloadRecord, file *os.File) (*Digest, error) {
+	if dr.ExpectedDigest != nil && newDigester(dr.ExpectedDigest.Algorithm) == nil {
+		return nil, fmt.Errorf("unsupported digest algorithm %q", dr.ExpectedDigest.Algorithm)
+	}
+
+	var wanted []Digest
+	if dr.Info != nil {
+		wanted = append(wanted, dr.Info.Digests...)
+	}
+	if dr.ExpectedDigest != nil {
+		wanted = append(wanted, *dr.ExpectedDigest)
+	}
+
+	digesters := make(map[DigestAlgorithm]hash.Hash)
+	var writers []io.Writer
+	for _, digest := range wanted {
+		if _, ok := digesters[digest.Algorithm]; ok {
+			continue
+		}
+		digester := newDigester(digest.Algorithm)
+		if digester == nil {
+			log.Debugf("Unable to verify %s checksum of %s", digest.Algorithm, dr.Path)
+			continue
+		}
+		digesters[digest.Algorithm] = digester
+		writers = append(writers, digester)
+	}
+	if len(writers) == 0 {
+		return nil, nil
+	}
+
+	_, err := io.Copy(io.MultiWriter(writers...), io.NewSectionReader(file, 0, 1<<62))
+	if err != nil {
+		return nil, fmt.Errorf("could not read download to verify it: %s", err)
+	}
+
+	var verified *Digest
+	for i, digest := range wanted {
+		digester, ok := digesters[digest.Algorithm]
+		if !ok {
+			continue
+		}
+		actual := Digest{Algorithm: digest.Algorithm, Value: digester.Sum(nil)}
+		if !bytes.Equal(actual.Value, digest.Value) {
+			return nil, &IntegrityError{Path: dr.Path, Expected: digest, Actual: actual}
+		}
+
+		if verified == nil || digestStrength[digest.Algorithm] > digestStrength[verified.Algorithm] {
+			verified = &wanted[i]
+		}
+	}
+	if dr.ExpectedDigest != nil {
+		expected := *dr.ExpectedDigest
+		verified = &expected
+	}
+
+	return verified, nil
+}
+
+// VerifiedDigest returns the digest a cached file was verified against when it
+// was downloaded, if any
+func (c *FileCache) VerifiedDigest(dr *DownloadRecord) (Digest, bool) {
+	c.entriesLock.RLock()
+	defer c.entriesLock.RUnlock()
+
+	entry, ok := c.entries[dr.GetUniqueName()]
+	if !ok || entry.digest == nil {
+		return Digest{}, false
+	}
+
+	return *entry.digest, true
+}
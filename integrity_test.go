@@ -0,0 +1,151 @@
+package filecache
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Integrity", func() {
+	contents := []byte("one ring to rule them all")
+	sha := sha256.Sum256(contents)
+	sum := md5.Sum(contents)
+
+	Describe("digestsFromHeader()", func() {
+		It("reads the checksums origins report", func() {
+			header := http.Header{}
+			header.Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sha[:])+", unixsum=30637")
+			header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+			header.Set("X-Amz-Checksum-Crc32c", "yZRlqg==")
+			header.Set("Dropbox-API-Result", `{"content_hash": "`+hex.EncodeToString(sha[:])+`"}`)
+
+			Expect(digestsFromHeader(header)).To(Equal([]Digest{
+				{Algorithm: DigestSHA256, Value: sha[:]},
+				{Algorithm: DigestMD5, Value: sum[:]},
+				{Algorithm: DigestCRC32C, Value: []byte{0xc9, 0x94, 0x65, 0xaa}},
+				{Algorithm: DigestDropbox, Value: sha[:]},
+			}))
+		})
+
+		It("skips composite checksums of multipart objects", func() {
+			header := http.Header{}
+			header.Set("X-Amz-Checksum-Sha256", base64.StdEncoding.EncodeToString(sha[:])+"-3")
+
+			Expect(digestsFromHeader(header)).To(BeEmpty())
+		})
+	})
+
+	Describe("etagDigest()", func() {
+		It("uses the ETag of single part objects as their MD5", func() {
+			header := http.Header{}
+			header.Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+
+			digest, ok := etagDigest(header)
+			Expect(ok).To(BeTrue())
+			Expect(digest).To(Equal(Digest{Algorithm: DigestMD5, Value: sum[:]}))
+		})
+
+		It("ignores the ETags of multipart and encrypted objects", func() {
+			header := http.Header{}
+			header.Set("ETag", `"`+hex.EncodeToString(sum[:])+`-2"`)
+			_, ok := etagDigest(header)
+			Expect(ok).To(BeFalse())
+
+			header.Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+			header.Set("X-Amz-Server-Side-Encryption", "aws:kms")
+			_, ok = etagDigest(header)
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	It("computes Dropbox content hashes block by block", func() {
+		block := sha256.Sum256(contents)
+		expected := sha256.Sum256(block[:])
+
+		hash := newDropboxHash()
+		hash.Write(contents)
+		Expect(hash.Sum(nil)).To(Equal(expected[:]))
+	})
+
+	Describe("downloads", func() {
+		var (
+			cache   *FileCache
+			baseDir string
+			info    *ObjectInfo
+		)
+
+		BeforeEach(func() {
+			var err error
+			baseDir, err = ioutil.TempDir("", "filecache-integrity")
+			Expect(err).ShouldNot(HaveOccurred())
+
+			info = nil
+			cache, err = New(10, baseDir)
+			Expect(err).ShouldNot(HaveOccurred())
+			stubDownloads(cache, func(dr *DownloadRecord, localFile *os.File) error {
+				dr.Info = info
+				_, err := localFile.Write(contents)
+				return err
+			})
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(baseDir)
+		})
+
+		It("keeps the strongest digest reported by the origin", func() {
+			info = &ObjectInfo{Digests: []Digest{
+				{Algorithm: DigestMD5, Value: sum[:]},
+				{Algorithm: DigestSHA256, Value: sha[:]},
+			}}
+			dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "mordor/ring.pdf"}
+
+			Expect(cache.Fetch(dr)).To(BeTrue())
+			digest, ok := cache.VerifiedDigest(dr)
+			Expect(ok).To(BeTrue())
+			Expect(digest).To(Equal(Digest{Algorithm: DigestSHA256, Value: sha[:]}))
+		})
+
+		It("checks the digest the caller expects", func() {
+			dr := &DownloadRecord{
+				Manager:        DownloadMangerDropbox,
+				Path:           "mordor/ring.pdf",
+				ExpectedDigest: &Digest{Algorithm: DigestMD5, Value: sum[:]},
+			}
+
+			Expect(cache.Fetch(dr)).To(BeTrue())
+			digest, ok := cache.VerifiedDigest(dr)
+			Expect(ok).To(BeTrue())
+			Expect(digest).To(Equal(Digest{Algorithm: DigestMD5, Value: sum[:]}))
+		})
+
+		It("rejects files which don't match", func() {
+			info = &ObjectInfo{Digests: []Digest{{Algorithm: DigestSHA256, Value: sum[:]}}}
+			dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "mordor/ring.pdf"}
+
+			_, err := cache.maybeDownload(dr, false)
+			integrityErr, ok := err.(*IntegrityError)
+			Expect(ok).To(BeTrue())
+			Expect(integrityErr.Expected.Value).To(Equal(sum[:]))
+			Expect(integrityErr.Actual.Value).To(Equal(sha[:]))
+
+			Expect(cache.Contains(dr)).To(BeFalse())
+			Expect(cache.GetFileName(dr)).ShouldNot(BeAnExistingFile())
+		})
+
+		It("doesn't record a digest when there is nothing to check", func() {
+			dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "mordor/ring.pdf"}
+
+			Expect(cache.Fetch(dr)).To(BeTrue())
+			_, ok := cache.VerifiedDigest(dr)
+			Expect(ok).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,168 @@
+package filecache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// CachedFile is an open, read-only handle to a cached file. It stays valid even
+// if the file is evicted or reloaded while it is open. Files stored compressed
+// or encrypted are decompressed and decrypted as they are read.
+type CachedFile struct {
+	stored  *storedFile
+	info    os.FileInfo
+	decoder io.ReadCloser // Positioned at offset, for compressed files
+	offset  int64
+	kind    string
+}
+
+// Name returns the path the file was opened from
+func (f *CachedFile) Name() string {
+	return f.stored.file.Name()
+}
+
+// Size returns the size of the file's contents in bytes
+func (f *CachedFile) Size() int64 {
+	return f.stored.size
+}
+
+// ModTime returns when the file was last downloaded or refreshed
+func (f *CachedFile) ModTime() time.Time {
+	return f.info.ModTime()
+}
+
+// ContentType returns the MIME type of the file's contents, to serve it with
+func (f *CachedFile) ContentType() string {
+	return f.kind
+}
+
+func (f *CachedFile) Read(b []byte) (int, error) {
+	if f.stored.codec == nil {
+		if f.offset >= f.stored.size {
+			return 0, io.EOF
+		}
+		n, err := f.stored.data.ReadAt(b, f.offset)
+		f.offset += int64(n)
+		if err == io.EOF && n > 0 {
+			err = nil
+		}
+		return n, err
+	}
+
+	if f.decoder == nil {
+		if f.offset >= f.stored.size {
+			return 0, io.EOF
+		}
+		decoder, err := f.stored.decoder(f.offset)
+		if err != nil {
+			return 0, err
+		}
+		f.decoder = decoder
+	}
+
+	n, err := f.decoder.Read(b)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *CachedFile) ReadAt(b []byte, offset int64) (int, error) {
+	if f.stored.codec == nil {
+		return f.stored.data.ReadAt(b, offset)
+	}
+	if offset >= f.stored.size {
+		return 0, io.EOF
+	}
+
+	decoder, err := f.stored.decoder(offset)
+	if err != nil {
+		return 0, err
+	}
+	defer decoder.Close()
+
+	n, err := io.ReadFull(decoder, b)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *CachedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.stored.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek to a negative position")
+	}
+
+	if offset != f.offset && f.decoder != nil {
+		f.decoder.Close()
+		f.decoder = nil
+	}
+	f.offset = offset
+
+	return offset, nil
+}
+
+// Close closes the file
+func (f *CachedFile) Close() error {
+	if f.decoder != nil {
+		f.decoder.Close()
+	}
+	return f.stored.file.Close()
+}
+
+// Open fetches a file like Fetch, and opens it for reading. The file is pinned
+// until it is open, so that it can't be evicted in between. If ctx is done
+// first, Open returns straight away while the download carries on in the
+// background. The caller must Close the returned file.
+func (c *FileCache) Open(ctx context.Context, dr *DownloadRecord) (*CachedFile, error) {
+	type pinned struct {
+		lease *Lease
+		err   error
+	}
+
+	done := make(chan pinned, 1)
+	go func() {
+		lease, err := c.Pin(dr, 0)
+		done <- pinned{lease, err}
+	}()
+
+	var result pinned
+	select {
+	case <-ctx.Done():
+		go func() {
+			if result := <-done; result.lease != nil {
+				result.lease.Release()
+			}
+		}()
+		return nil, ctx.Err()
+	case result = <-done:
+	}
+
+	if result.err != nil {
+		return nil, result.err
+	}
+	defer result.lease.Release()
+
+	stored, err := c.openStored(dr, result.lease.path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open cached copy of %s: %s", dr.Path, err)
+	}
+
+	info, err := stored.file.Stat()
+	if err != nil {
+		stored.file.Close()
+		return nil, fmt.Errorf("could not stat cached copy of %s: %s", dr.Path, err)
+	}
+
+	kind, _ := c.ContentType(dr)
+
+	return &CachedFile{stored: stored, info: info, kind: kind}, nil
+}
@@ -0,0 +1,91 @@
+package filecache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Open", func() {
+	var (
+		cache   *FileCache
+		baseDir string
+		release chan struct{}
+	)
+
+	BeforeEach(func() {
+		var err error
+		baseDir, err = ioutil.TempDir("", "filecache-open")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		release = nil
+		cache, err = New(1, baseDir)
+		Expect(err).ShouldNot(HaveOccurred())
+		cache.DownloadFunc = func(dr *DownloadRecord, localPath string) error {
+			if release != nil {
+				<-release
+			}
+			if dr.Path == "weathertop/missing.pdf" {
+				return errors.New("not found")
+			}
+			Expect(os.MkdirAll(filepath.Dir(localPath), 0755)).To(Succeed())
+			return ioutil.WriteFile(localPath, []byte("amon sûl"), 0644)
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(baseDir)
+	})
+
+	It("opens the cached file", func() {
+		file, err := cache.Open(context.Background(), &DownloadRecord{Path: "weathertop/amon-sul.pdf"})
+		Expect(err).ShouldNot(HaveOccurred())
+		defer file.Close()
+
+		var _ io.ReadSeeker = file
+		Expect(file.Size()).To(Equal(int64(len("amon sûl"))))
+		Expect(file.ModTime()).To(BeTemporally("~", time.Now(), time.Minute))
+
+		_, err = file.Seek(4, io.SeekStart)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(ioutil.ReadAll(file)).To(Equal([]byte(" sûl")))
+	})
+
+	It("stays readable after the file is evicted", func() {
+		dr := &DownloadRecord{Path: "weathertop/amon-sul.pdf"}
+		file, err := cache.Open(context.Background(), dr)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer file.Close()
+
+		Expect(cache.Fetch(&DownloadRecord{Path: "weathertop/other.pdf"})).To(BeTrue())
+		Expect(cache.GetFileName(dr)).ShouldNot(BeAnExistingFile())
+
+		Expect(ioutil.ReadAll(file)).To(Equal([]byte("amon sûl")))
+	})
+
+	It("reports download errors", func() {
+		_, err := cache.Open(context.Background(), &DownloadRecord{Path: "weathertop/missing.pdf"})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("gives up when the context is done", func() {
+		release = make(chan struct{})
+		dr := &DownloadRecord{Path: "weathertop/amon-sul.pdf"}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := cache.Open(ctx, dr)
+		Expect(err).To(Equal(context.DeadlineExceeded))
+
+		close(release)
+		Eventually(func() bool { return cache.Contains(dr) }).Should(BeTrue())
+		Eventually(func() bool { return cache.isPinned(dr.GetUniqueName()) }).Should(BeFalse())
+	})
+})
@@ -0,0 +1,152 @@
+package filecache
+
+import (
+	"errors"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PartitionFunc maps a DownloadRecord to the capacity partition its file is
+// accounted to, e.g. a tenant's bucket
+type PartitionFunc = func(dr *DownloadRecord) string
+
+// PartitionByPathPrefix puts records in one partition per first path segment,
+// which is the bucket for S3 and "dropbox" for Dropbox
+func PartitionByPathPrefix(dr *DownloadRecord) string {
+	return strings.SplitN(dr.Path, "/", 2)[0]
+}
+
+// PartitionBudget limits how much of the cache a partition may use. Zero
+// fields don't impose a limit.
+type PartitionBudget struct {
+	MaxBytes   int64
+	MaxEntries int
+}
+
+// PartitionUsage is how much of the cache a partition is currently using
+type PartitionUsage struct {
+	Bytes   int64
+	Entries int
+}
+
+// Partitions splits the cache into capacity partitions so that a single noisy
+// tenant can't take it over. Every partition is held to its entry in budgets,
+// or to defaultBudget when it has none. Once a partition goes over its budget,
+// files are evicted from that partition only, in the order the eviction policy
+// picks, until it fits again or SharedOverflow can absorb the excess. The
+// overall size of the cache and MaxBytes still apply on top of partitions, and
+// aren't scoped to them: when the cache as a whole is full, files are evicted
+// from whichever partition the policy picks, so a partition within its budget
+// can still push out another's files. Keep the combined budgets within the
+// size of the cache to avoid it.
+func Partitions(partition PartitionFunc, defaultBudget PartitionBudget, budgets map[string]PartitionBudget) option {
+	return func(c *FileCache) error {
+		if partition == nil {
+			return errors.New("nil partition function")
+		}
+
+		c.partitionFunc = partition
+		c.partitions = make(map[string]*PartitionUsage)
+		c.defaultBudget = defaultBudget
+		c.partitionBudgets = make(map[string]PartitionBudget, len(budgets))
+		for name, budget := range budgets {
+			c.partitionBudgets[name] = budget
+		}
+
+		return nil
+	}
+}
+
+// SharedOverflow lets partitions go over their own budget, as long as their
+// combined excess fits in the given shared budget. Partitions compete for the
+// overflow on a first come, first served basis.
+func SharedOverflow(budget PartitionBudget) option {
+	return func(c *FileCache) error {
+		c.overflow = budget
+		return nil
+	}
+}
+
+// PartitionUsage returns the current usage of every partition with files in
+// the cache
+func (c *FileCache) PartitionUsage() map[string]PartitionUsage {
+	c.entriesLock.RLock()
+	defer c.entriesLock.RUnlock()
+
+	usage := make(map[string]PartitionUsage, len(c.partitions))
+	for name, partitionUsage := range c.partitions {
+		usage[name] = *partitionUsage
+	}
+
+	return usage
+}
+
+// partitionOf returns the partition a record is accounted to
+func (c *FileCache) partitionOf(dr *DownloadRecord) string {
+	if c.partitionFunc == nil {
+		return ""
+	}
+	return c.partitionFunc(dr)
+}
+
+// partitionBudget returns the budget of a partition
+func (c *FileCache) partitionBudget(partition string) PartitionBudget {
+	if budget, ok := c.partitionBudgets[partition]; ok {
+		return budget
+	}
+	return c.defaultBudget
+}
+
+// excess returns how far usage goes over budget, in bytes and in entries
+func excess(usage PartitionUsage, budget PartitionBudget) (bytes int64, entries int) {
+	if budget.MaxBytes > 0 && usage.Bytes > budget.MaxBytes {
+		bytes = usage.Bytes - budget.MaxBytes
+	}
+	if budget.MaxEntries > 0 && usage.Entries > budget.MaxEntries {
+		entries = usage.Entries - budget.MaxEntries
+	}
+	return bytes, entries
+}
+
+// partitionNeedsEviction reports whether a partition is over its budget by
+// more than the shared overflow can absorb
+func (c *FileCache) partitionNeedsEviction(partition string) bool {
+	c.entriesLock.RLock()
+	defer c.entriesLock.RUnlock()
+
+	usage, ok := c.partitions[partition]
+	if !ok || usage.Entries <= 1 {
+		return false
+	}
+
+	overBytes, overEntries := excess(*usage, c.partitionBudget(partition))
+	if overBytes == 0 && overEntries == 0 {
+		return false
+	}
+
+	var totalBytes int64
+	var totalEntries int
+	for name, other := range c.partitions {
+		bytes, entries := excess(*other, c.partitionBudget(name))
+		totalBytes += bytes
+		totalEntries += entries
+	}
+
+	return (overBytes > 0 && totalBytes > c.overflow.MaxBytes) ||
+		(overEntries > 0 && totalEntries > c.overflow.MaxEntries)
+}
+
+// enforcePartitionBudget evicts files from a partition until it fits in its
+// budget and the shared overflow, always keeping at least one file
+func (c *FileCache) enforcePartitionBudget(partition string) {
+	order := c.newEvictionOrder(func(entry *cacheEntry) bool {
+		return entry.partition == partition
+	})
+	for c.partitionNeedsEviction(partition) {
+		log.Debugf("Evicting to keep partition '%s' within its budget", partition)
+		if !order.evictNext(EvictionCapacity) {
+			return
+		}
+	}
+}
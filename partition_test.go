@@ -0,0 +1,91 @@
+package filecache
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Partitions", func() {
+	var baseDir string
+
+	newCache := func(opts ...option) *FileCache {
+		cache, err := New(100, baseDir, opts...)
+		Expect(err).ShouldNot(HaveOccurred())
+		cache.DownloadFunc = func(dr *DownloadRecord, localPath string) error {
+			Expect(os.MkdirAll(filepath.Dir(localPath), 0755)).To(Succeed())
+			return ioutil.WriteFile(localPath, bytes.Repeat([]byte("x"), 100), 0644)
+		}
+		return cache
+	}
+
+	fetch := func(cache *FileCache, bucket string, count int) []*DownloadRecord {
+		var records []*DownloadRecord
+		for i := 0; i < count; i++ {
+			dr := &DownloadRecord{Path: fmt.Sprintf("%s/file-%d.pdf", bucket, i)}
+			Expect(cache.Fetch(dr)).To(BeTrue())
+			records = append(records, dr)
+		}
+		return records
+	}
+
+	BeforeEach(func() {
+		var err error
+		baseDir, err = ioutil.TempDir("", "filecache-partition")
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(baseDir)
+	})
+
+	It("partitions by the first path segment", func() {
+		Expect(PartitionByPathPrefix(&DownloadRecord{Path: "gondor/minas-tirith.pdf"})).To(Equal("gondor"))
+		Expect(PartitionByPathPrefix(&DownloadRecord{Path: "rohan"})).To(Equal("rohan"))
+	})
+
+	It("rejects a nil partition function", func() {
+		_, err := New(10, baseDir, Partitions(nil, PartitionBudget{}, nil))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("only evicts from the partition which is over budget", func() {
+		cache := newCache(Partitions(PartitionByPathPrefix, PartitionBudget{MaxEntries: 2}, map[string]PartitionBudget{
+			"gondor": {MaxBytes: 300},
+		}))
+
+		quiet := fetch(cache, "rohan", 2)
+		noisy := fetch(cache, "mordor", 5)
+		fetch(cache, "gondor", 4)
+
+		for _, dr := range quiet {
+			Expect(cache.Contains(dr)).To(BeTrue())
+		}
+		Expect(cache.Contains(noisy[0])).To(BeFalse())
+		Expect(cache.Contains(noisy[4])).To(BeTrue())
+		Expect(cache.PartitionUsage()).To(Equal(map[string]PartitionUsage{
+			"rohan":  {Bytes: 200, Entries: 2},
+			"mordor": {Bytes: 200, Entries: 2},
+			"gondor": {Bytes: 300, Entries: 3},
+		}))
+	})
+
+	It("lets partitions share the overflow", func() {
+		cache := newCache(
+			Partitions(PartitionByPathPrefix, PartitionBudget{MaxEntries: 2}, nil),
+			SharedOverflow(PartitionBudget{MaxEntries: 3}),
+		)
+
+		fetch(cache, "mordor", 4)
+		fetch(cache, "isengard", 4)
+
+		usage := cache.PartitionUsage()
+		Expect(usage["mordor"].Entries).To(Equal(4))
+		Expect(usage["isengard"].Entries).To(Equal(3))
+	})
+})
@@ -0,0 +1,201 @@
+package filecache
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// pin counts the leases held on a file
+type pin struct {
+	count      int
+	pending    []string // Files which left the cache while pinned
+	transients []string // Files to delete once released, newest last
+}
+
+// Lease is a reference to a cached file which stops it from being evicted or
+// deleted until it is released or expires
+type Lease struct {
+	cache   *FileCache
+	key     string
+	path    string
+	once    sync.Once
+	expires *time.Timer
+}
+
+// Path returns the local path of the leased file. Under Compression or
+// EncryptAtRest, the file there can't be read as it is, see FileName.
+func (l *Lease) Path() string {
+	return l.path
+}
+
+// FileName returns the path the leased file can be read from. It fails with
+// ErrNoLocalPath when files are stored compressed or encrypted.
+func (l *Lease) FileName() (string, error) {
+	if l.cache.storesEncoded() {
+		return "", ErrNoLocalPath
+	}
+
+	return l.path, nil
+}
+
+// Release gives the lease up. Files which were removed from the cache while
+// leased are deleted once their last lease is released. Releasing more than
+// once is harmless.
+func (l *Lease) Release() {
+	l.once.Do(func() {
+		if l.expires != nil {
+			l.expires.Stop()
+		}
+		l.cache.unpin(l.key)
+	})
+}
+
+// Pin fetches a file like Fetch, and leases it so that it stays on disk until
+// the lease is released. Leases with a positive ttl are released automatically
+// once it is over, in case their holder forgets. Evictions due to capacity,
+// disk pressure or expiry skip pinned files; Remove, Reload and Purge take
+// them out of the cache but leave them on disk until they are released.
+func (c *FileCache) Pin(dr *DownloadRecord, ttl time.Duration) (*Lease, error) {
+	key := dr.GetUniqueName()
+
+	// Pin before fetching, so nothing can evict the file in between
+	c.pin(key)
+
+	c.recordAccess(dr)
+	if c.Contains(dr) {
+		c.recordHit(dr)
+	} else if _, err := c.maybeDownload(dr, false); err != nil {
+		c.unpin(key)
+		return nil, err
+	}
+
+	path := c.storagePath(dr)
+	// It was set aside for the holders of leases, like us, if it wasn't admitted
+	if transient, ok := c.notAdmittedPath(dr); ok {
+		path = transient
+	}
+
+	lease := &Lease{cache: c, key: key, path: path}
+	if ttl > 0 {
+		lease.expires = time.AfterFunc(ttl, func() {
+			log.Warnf("Lease on '%s' expired without being released", key)
+			lease.Release()
+		})
+	}
+
+	return lease, nil
+}
+
+// pin takes a lease on key
+func (c *FileCache) pin(key string) {
+	c.pinsLock.Lock()
+	defer c.pinsLock.Unlock()
+
+	p, ok := c.pins[key]
+	if !ok {
+		p = &pin{}
+		c.pins[key] = p
+	}
+	p.count++
+}
+
+// holdTransient hands a file of key which isn't its cached copy, like a
+// download which wasn't admitted to the cache, over to the holders of leases
+// on key, to be deleted once they are all released. Reports whether there are
+// any.
+func (c *FileCache) holdTransient(key, path string) bool {
+	c.pinsLock.Lock()
+	defer c.pinsLock.Unlock()
+
+	p, ok := c.pins[key]
+	if !ok {
+		return false
+	}
+	p.transients = append(p.transients, path)
+
+	return true
+}
+
+// transient returns the latest download of key which wasn't admitted to the
+// cache, if it is still held
+func (c *FileCache) transient(key string) (string, bool) {
+	c.pinsLock.Lock()
+	defer c.pinsLock.Unlock()
+
+	p, ok := c.pins[key]
+	if !ok || len(p.transients) == 0 {
+		return "", false
+	}
+
+	return p.transients[len(p.transients)-1], true
+}
+
+// isPinned reports whether anyone holds a lease on key
+func (c *FileCache) isPinned(key string) bool {
+	c.pinsLock.Lock()
+	defer c.pinsLock.Unlock()
+
+	_, ok := c.pins[key]
+	return ok
+}
+
+// anyPinned reports whether anyone holds a lease on any file
+func (c *FileCache) anyPinned() bool {
+	c.pinsLock.Lock()
+	defer c.pinsLock.Unlock()
+
+	return len(c.pins) > 0
+}
+
+// deferIfPinned arranges for a file which left the cache to be deleted when
+// its last lease is released, and reports whether it is pinned
+func (c *FileCache) deferIfPinned(key, storagePath string) bool {
+	c.pinsLock.Lock()
+	defer c.pinsLock.Unlock()
+
+	p, ok := c.pins[key]
+	if !ok {
+		return false
+	}
+	for _, pending := range p.pending {
+		if pending == storagePath {
+			return true
+		}
+	}
+	p.pending = append(p.pending, storagePath)
+
+	return true
+}
+
+// unpin releases a lease on key, deleting the file if it left the cache while
+// it was pinned
+func (c *FileCache) unpin(key string) {
+	c.pinsLock.Lock()
+	p, ok := c.pins[key]
+	if !ok {
+		c.pinsLock.Unlock()
+		return
+	}
+	p.count--
+	if p.count > 0 {
+		c.pinsLock.Unlock()
+		return
+	}
+	delete(c.pins, key)
+	c.pinsLock.Unlock()
+
+	for _, transient := range p.transients {
+		err := os.Remove(transient)
+		if err != nil && !os.IsNotExist(err) {
+			log.Errorf("Unable to remove '%s': %s", transient, err)
+		}
+	}
+
+	// Unless they were downloaded again in the meantime
+	for _, pending := range p.pending {
+		c.removeIfUncached(key, pending)
+	}
+}
@@ -0,0 +1,102 @@
+package filecache
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Pinning", func() {
+	var (
+		cache   *FileCache
+		baseDir string
+	)
+
+	record := func(i int) *DownloadRecord {
+		return &DownloadRecord{Path: fmt.Sprintf("lorien/mallorn-%d.pdf", i)}
+	}
+
+	BeforeEach(func() {
+		var err error
+		baseDir, err = ioutil.TempDir("", "filecache-pin")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		cache, err = New(2, baseDir)
+		Expect(err).ShouldNot(HaveOccurred())
+		cache.DownloadFunc = func(dr *DownloadRecord, localPath string) error {
+			if dr.Path == "lorien/missing.pdf" {
+				return errors.New("not found")
+			}
+			Expect(os.MkdirAll(filepath.Dir(localPath), 0755)).To(Succeed())
+			return ioutil.WriteFile(localPath, []byte(dr.Path), 0644)
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(baseDir)
+	})
+
+	It("returns the local path of the file", func() {
+		lease, err := cache.Pin(record(0), 0)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer lease.Release()
+
+		Expect(lease.Path()).To(Equal(cache.GetFileName(record(0))))
+		Expect(ioutil.ReadFile(lease.Path())).To(Equal([]byte(record(0).Path)))
+	})
+
+	It("doesn't evict pinned files", func() {
+		lease, err := cache.Pin(record(0), 0)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		for i := 1; i < 5; i++ {
+			Expect(cache.Fetch(record(i))).To(BeTrue())
+		}
+		Expect(cache.Contains(record(0))).To(BeTrue())
+
+		lease.Release()
+		for i := 5; i < 7; i++ {
+			Expect(cache.Fetch(record(i))).To(BeTrue())
+		}
+		Expect(cache.Contains(record(0))).To(BeFalse())
+		Expect(lease.Path()).ShouldNot(BeAnExistingFile())
+	})
+
+	It("keeps removed files on disk until their last lease is released", func() {
+		first, err := cache.Pin(record(0), 0)
+		Expect(err).ShouldNot(HaveOccurred())
+		second, err := cache.Pin(record(0), 0)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		cache.Remove(record(0))
+		Expect(cache.Contains(record(0))).To(BeFalse())
+		Expect(first.Path()).To(BeAnExistingFile())
+
+		first.Release()
+		first.Release()
+		Expect(first.Path()).To(BeAnExistingFile())
+
+		second.Release()
+		Expect(first.Path()).ShouldNot(BeAnExistingFile())
+	})
+
+	It("releases expired leases", func() {
+		lease, err := cache.Pin(record(0), 20*time.Millisecond)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Eventually(func() bool { return cache.isPinned(lease.key) }).Should(BeFalse())
+	})
+
+	It("doesn't pin files which couldn't be fetched", func() {
+		dr := &DownloadRecord{Path: "lorien/missing.pdf"}
+		_, err := cache.Pin(dr, 0)
+		Expect(err).To(HaveOccurred())
+		Expect(cache.isPinned(dr.GetUniqueName())).To(BeFalse())
+	})
+})
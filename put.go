@@ -0,0 +1,144 @@
+package filecache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RecordUploaderFunc uploads body to the backing store of a DownloadRecord. It
+// may fill in dr.Info with the metadata of the stored object.
+type RecordUploaderFunc = func(ctx context.Context, dr *DownloadRecord, body io.ReadSeeker) error
+
+// Put uploads the contents of r through the record's backing store and then
+// installs the same bytes in the cache, so that reads straight after the write
+// are served locally. The data is staged next to its final location and only
+// moved into place once the upload succeeded, so readers see either the old
+// file or the new one. Downloads of the same record wait for the Put, and the
+// Put waits for any download which is already in progress.
+func (c *FileCache) Put(ctx context.Context, dr *DownloadRecord, r io.Reader) error {
+	uploader, ok := c.uploaders[dr.Manager]
+	if !ok {
+		return fmt.Errorf("no uploader found for %q", dr.Path)
+	}
+
+	if err := c.checkDiskSpace(); err != nil {
+		log.Warn(err)
+	}
+
+	// The path can change while another goroutine holds the record, so it is
+	// only worked out once we do
+	storagePath, release := c.claimWaiting(dr)
+	defer release()
+
+	directory := filepath.Dir(storagePath)
+	err := os.MkdirAll(directory, 0755)
+	if err != nil {
+		return fmt.Errorf("could not create local directory: %s", err)
+	}
+
+	localFile, err := ioutil.TempFile(c.stagingDir(storagePath), filepath.Base(storagePath)+".upload-")
+	if err != nil {
+		return fmt.Errorf("could not create local file: %s", err)
+	}
+	defer os.Remove(localFile.Name()) // Fails harmlessly once renamed
+	defer localFile.Close()
+
+	_, err = io.Copy(localFile, r)
+	if err != nil {
+		return fmt.Errorf("could not stage upload of %s: %s", dr.Path, err)
+	}
+
+	err = c.checkSize(dr, localFile)
+	if err != nil {
+		return err
+	}
+
+	err = c.validate(dr, localFile)
+	if err != nil {
+		return err
+	}
+
+	_, err = localFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("could not rewind staged upload of %s: %s", dr.Path, err)
+	}
+
+	// Don't hand our bookkeeping back to the caller through their record
+	attempt := *dr
+	attempt.Validators = nil
+	attempt.Info = nil
+
+	err = uploader(ctx, &attempt, localFile)
+	if err != nil {
+		return fmt.Errorf("could not upload %s: %s", dr.Path, err)
+	}
+
+	storedPath, err := c.compress(dr, localFile)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(storedPath) // Fails harmlessly once renamed
+
+	storedPath, err = c.encrypt(dr, storedPath, storagePath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(storedPath) // Fails harmlessly once renamed
+
+	err = os.Rename(storedPath, storagePath)
+	if err != nil {
+		return fmt.Errorf("could not move upload into place: %s", err)
+	}
+
+	if attempt.Info == nil {
+		attempt.Info = &ObjectInfo{Size: -1}
+	}
+	attempt.Info.ContentType = c.storedContentType(&attempt, storagePath)
+	storagePath = c.placeByContentType(dr, storagePath, attempt.Info.ContentType, nil)
+
+	// We never timed a download of this one, so its cost is estimated
+	c.setEntry(dr, storagePath, attempt.Info, nil, 0)
+	c.makeRoom(dr.GetUniqueName())
+	c.Cache.Add(dr.GetUniqueName(), storagePath)
+	c.enforceBudgets(dr)
+
+	log.Debugf("Uploaded %s and added it to the cache", dr.Path)
+
+	return nil
+}
+
+// claimWaiting registers us in Waiting as the goroutine fetching a record,
+// first waiting for anyone who got there before us, and returns where the
+// record is stored now that nobody else can move it. The returned function
+// releases the claim and wakes up everyone waiting on us, deleting the file at
+// that path if we replaced it under another name, or once it is released if
+// it is pinned, as fetch does.
+func (c *FileCache) claimWaiting(dr *DownloadRecord) (string, func()) {
+	for {
+		c.WaitLock.Lock()
+		waitChan, ok := c.Waiting[dr.GetUniqueName()]
+		if !ok {
+			break
+		}
+		c.WaitLock.Unlock()
+
+		log.Debugf("Awaiting download of %s", dr.Path)
+		<-waitChan
+	}
+
+	c.Waiting[dr.GetUniqueName()] = make(chan struct{})
+	c.WaitLock.Unlock()
+
+	previousPath := c.storagePath(dr)
+	return previousPath, func() {
+		c.WaitLock.Lock()
+		// Removing an evicted copy left for us to replace, if we didn't
+		c.releaseWaiting(dr.GetUniqueName(), previousPath)
+	}
+}
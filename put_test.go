@@ -0,0 +1,142 @@
+package filecache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Put()", func() {
+	var (
+		cache       *FileCache
+		dr          *DownloadRecord
+		uploaded    []byte
+		uploadError error
+		didDownload bool
+	)
+
+	BeforeEach(func() {
+		var err error
+		cache, err = New(10, os.TempDir())
+		Expect(err).ShouldNot(HaveOccurred())
+
+		uploaded = nil
+		uploadError = nil
+		didDownload = false
+
+		cache.uploaders[DownloadMangerS3] = func(ctx context.Context, dr *DownloadRecord, body io.ReadSeeker) error {
+			if uploadError != nil {
+				return uploadError
+			}
+			uploaded, err = ioutil.ReadAll(body)
+			dr.Info = &ObjectInfo{ETag: `"gimli"`}
+			return err
+		}
+		cache.DownloadFunc = func(dr *DownloadRecord, localPath string) error {
+			didDownload = true
+			return nil
+		}
+
+		dr = &DownloadRecord{Path: "erebor/gimli.pdf"}
+	})
+
+	AfterEach(func() {
+		os.Remove(cache.GetFileName(dr))
+	})
+
+	It("uploads the data and serves it from the cache", func() {
+		Expect(cache.Put(context.Background(), dr, strings.NewReader("axe"))).To(Succeed())
+		Expect(string(uploaded)).To(Equal("axe"))
+
+		Expect(cache.Fetch(dr)).To(BeTrue())
+		Expect(didDownload).To(BeFalse())
+
+		content, err := ioutil.ReadFile(cache.GetFileName(dr))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(string(content)).To(Equal("axe"))
+		Expect(cache.validators(dr).ETag).To(Equal(`"gimli"`))
+	})
+
+	It("leaves the cache alone when the upload fails", func() {
+		uploadError = errors.New("access denied")
+
+		Expect(cache.Put(context.Background(), dr, strings.NewReader("axe"))).NotTo(Succeed())
+		Expect(cache.Contains(dr)).To(BeFalse())
+
+		_, err := os.Stat(cache.GetFileName(dr))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("replaces a cached copy", func() {
+		Expect(cache.Put(context.Background(), dr, strings.NewReader("axe"))).To(Succeed())
+		Expect(cache.Put(context.Background(), dr, bytes.NewReader([]byte("helmet")))).To(Succeed())
+
+		content, err := ioutil.ReadFile(cache.GetFileName(dr))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(string(content)).To(Equal("helmet"))
+	})
+
+	It("keeps a pinned copy it replaces under another name until it is released", func() {
+		cache.typedNames = true
+		dr.Path = "erebor/gimli"
+		Expect(cache.Put(context.Background(), dr, strings.NewReader("%PDF-1.4 axe"))).To(Succeed())
+		pinned := cache.GetFileName(dr)
+		Expect(pinned).To(HaveSuffix(".pdf"))
+
+		lease, err := cache.Pin(dr, 0)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Expect(cache.Put(context.Background(), dr, strings.NewReader("helmet"))).To(Succeed())
+		Expect(cache.GetFileName(dr)).To(HaveSuffix(".txt"))
+		Expect(pinned).To(BeAnExistingFile())
+
+		lease.Release()
+		Expect(pinned).NotTo(BeAnExistingFile())
+	})
+
+	It("fails for backends that can't store files", func() {
+		dr.Manager = DownloadMangerDropbox
+		Expect(cache.Put(context.Background(), dr, strings.NewReader("axe"))).NotTo(Succeed())
+	})
+
+	It("makes downloads of the same record wait for it", func() {
+		block := make(chan struct{})
+		cache.uploaders[DownloadMangerS3] = func(ctx context.Context, dr *DownloadRecord, body io.ReadSeeker) error {
+			<-block
+			return nil
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer GinkgoRecover()
+			Expect(cache.Put(context.Background(), dr, strings.NewReader("axe"))).To(Succeed())
+		}()
+
+		Eventually(func() bool {
+			cache.WaitLock.Lock()
+			defer cache.WaitLock.Unlock()
+			_, ok := cache.Waiting[dr.GetUniqueName()]
+			return ok
+		}).Should(BeTrue())
+
+		fetched := make(chan bool)
+		go func() { fetched <- cache.Fetch(dr) }()
+		Consistently(fetched).ShouldNot(Receive())
+
+		close(block)
+		Eventually(fetched).Should(Receive(BeTrue()))
+		wg.Wait()
+
+		Expect(didDownload).To(BeFalse())
+	})
+})
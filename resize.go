@@ -0,0 +1,112 @@
+package filecache
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// resizablePolicy is implemented by the eviction policies which can change
+// size in place. All the built-in ones can.
+type resizablePolicy interface {
+	// Resize changes the size of the policy, evicting entries which don't fit
+	// anymore through the usual callback, and returns how many it evicted
+	Resize(size int) (int, error)
+}
+
+// resizableAdmission is implemented by the admission policies which are sized
+// for the cache, like TinyLFU
+type resizableAdmission interface {
+	// Resize sizes the policy for a cache holding size files
+	Resize(size int)
+}
+
+// Resize changes the number of files the cache holds. When shrinking, files
+// are evicted in the order the eviction policy picks, through the usual
+// eviction path. The TinyLFU admission filter is resized along with it. It is
+// safe to call while fetches are in progress. Returns how many files were
+// evicted.
+func (c *FileCache) Resize(size int) (evicted int, err error) {
+	if size <= 0 {
+		return 0, errors.New("must provide a positive size")
+	}
+
+	policy, ok := c.Cache.(resizablePolicy)
+	if !ok {
+		return 0, fmt.Errorf("eviction policy %T can't be resized", c.Cache)
+	}
+
+	// Concurrent resizes apply in order. The eviction callbacks read the
+	// limits, so limitsLock can't be held while the policy evicts.
+	c.resizeLock.Lock()
+	defer c.resizeLock.Unlock()
+
+	// Fetches make room under the new size, so a shrinking one applies first
+	c.limitsLock.Lock()
+	previous := c.size
+	if size < c.size {
+		c.size = size
+	}
+	c.limitsLock.Unlock()
+
+	// Evict what we can ourselves, so that pinned files and vetoed evictions
+	// are skipped. The policy drops whatever still doesn't fit.
+	order := c.newEvictionOrder(nil)
+	for c.Cache.Len() > size && order.evictNext(EvictionCapacity) {
+		evicted++
+	}
+
+	dropped, err := policy.Resize(size)
+	evicted += dropped
+	if err != nil {
+		c.limitsLock.Lock()
+		c.size = previous
+		c.limitsLock.Unlock()
+		return evicted, fmt.Errorf("invalid size: %s", err)
+	}
+
+	c.limitsLock.Lock()
+	c.size = size
+	c.limitsLock.Unlock()
+
+	if admission, ok := c.admission.(resizableAdmission); ok {
+		admission.Resize(size)
+	}
+
+	log.Debugf("Resized cache to %d files, evicting %d", size, evicted)
+
+	return evicted, nil
+}
+
+// ResizeBytes changes the byte budget set with MaxBytes, evicting files until
+// the cache fits in it. Zero removes the byte budget. It is safe to call while
+// fetches are in progress.
+func (c *FileCache) ResizeBytes(maxBytes int64) error {
+	if maxBytes < 0 {
+		return errors.New("negative byte budget")
+	}
+
+	c.limitsLock.Lock()
+	c.maxBytes = maxBytes
+	c.limitsLock.Unlock()
+
+	log.Debugf("Resized cache to %d bytes", maxBytes)
+	c.enforceMaxBytes()
+
+	return nil
+}
+
+// capacity returns the number of files the cache holds
+func (c *FileCache) capacity() int {
+	c.limitsLock.RLock()
+	defer c.limitsLock.RUnlock()
+	return c.size
+}
+
+// byteBudget returns the byte budget of the cache, zero if it has none
+func (c *FileCache) byteBudget() int64 {
+	c.limitsLock.RLock()
+	defer c.limitsLock.RUnlock()
+	return c.maxBytes
+}
@@ -0,0 +1,150 @@
+package filecache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Resize", func() {
+	var baseDir string
+
+	newCache := func(policyType EvictionPolicyType, opts ...option) *FileCache {
+		cache, err := New(4, baseDir, append([]option{Eviction(policyType)}, opts...)...)
+		Expect(err).ShouldNot(HaveOccurred())
+		cache.DownloadFunc = func(dr *DownloadRecord, localPath string) error {
+			Expect(os.MkdirAll(filepath.Dir(localPath), 0755)).To(Succeed())
+			return ioutil.WriteFile(localPath, []byte("0123456789"), 0644)
+		}
+		return cache
+	}
+
+	record := func(i int) *DownloadRecord {
+		return &DownloadRecord{Path: fmt.Sprintf("fangorn/ent-%d.pdf", i)}
+	}
+
+	BeforeEach(func() {
+		var err error
+		baseDir, err = ioutil.TempDir("", "filecache-resize")
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(baseDir)
+	})
+
+	for _, policyType := range []EvictionPolicyType{EvictLRU, EvictARC, Evict2Q, EvictLFU, EvictCostAware} {
+		policyType := policyType
+
+		It(fmt.Sprintf("grows and shrinks policy %d", policyType), func() {
+			cache := newCache(policyType)
+			for i := 0; i < 4; i++ {
+				Expect(cache.Fetch(record(i))).To(BeTrue())
+			}
+
+			evicted, err := cache.Resize(8)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(evicted).To(Equal(0))
+			for i := 4; i < 8; i++ {
+				Expect(cache.Fetch(record(i))).To(BeTrue())
+			}
+			Expect(cache.Cache.Len()).To(Equal(8))
+
+			evicted, err = cache.Resize(2)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(evicted).To(Equal(6))
+			Expect(cache.Cache.Len()).To(Equal(2))
+			Expect(cache.UsedBytes()).To(Equal(int64(20)))
+
+			onDisk := 0
+			for i := 0; i < 8; i++ {
+				if _, err := os.Stat(cache.GetFileName(record(i))); err == nil {
+					onDisk++
+				}
+			}
+			Expect(onDisk).To(Equal(2))
+		})
+	}
+
+	It("keeps the newest files when shrinking an LRU", func() {
+		cache := newCache(EvictLRU)
+		for i := 0; i < 4; i++ {
+			Expect(cache.Fetch(record(i))).To(BeTrue())
+		}
+
+		_, err := cache.Resize(2)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(cache.Contains(record(2))).To(BeTrue())
+		Expect(cache.Contains(record(3))).To(BeTrue())
+	})
+
+	It("shrinks when every eviction is vetoed", func() {
+		veto := func(*EvictionEvent) EvictionDecision { return EvictionDecision{Veto: true} }
+		cache := newCache(EvictLRU, EvictionHandler(veto))
+		for i := 0; i < 4; i++ {
+			Expect(cache.Fetch(record(i))).To(BeTrue())
+		}
+
+		_, err := cache.Resize(2)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(cache.Cache.Len()).To(Equal(2))
+	})
+
+	It("rejects invalid sizes", func() {
+		cache := newCache(EvictLRU)
+		_, err := cache.Resize(0)
+		Expect(err).To(HaveOccurred())
+		Expect(cache.ResizeBytes(-1)).ShouldNot(Succeed())
+	})
+
+	It("rejects policies which can't be resized", func() {
+		cache := newCache(EvictLRU)
+		cache.Cache = struct{ EvictionPolicy }{cache.Cache}
+		_, err := cache.Resize(2)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("resizes the byte budget", func() {
+		cache := newCache(EvictLRU, MaxBytes(100))
+		for i := 0; i < 4; i++ {
+			Expect(cache.Fetch(record(i))).To(BeTrue())
+		}
+
+		Expect(cache.ResizeBytes(25)).To(Succeed())
+		Expect(cache.UsedBytes()).To(Equal(int64(20)))
+
+		Expect(cache.ResizeBytes(0)).To(Succeed())
+		for i := 4; i < 8; i++ {
+			Expect(cache.Fetch(record(i))).To(BeTrue())
+		}
+		Expect(cache.UsedBytes()).To(Equal(int64(40)))
+	})
+
+	It("is safe while fetches are in progress", func() {
+		cache := newCache(EvictLRU)
+
+		var wg sync.WaitGroup
+		for worker := 0; worker < 4; worker++ {
+			wg.Add(1)
+			go func(worker int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					cache.Fetch(record(worker*50 + i))
+				}
+			}(worker)
+		}
+		for size := 1; size < 20; size++ {
+			_, err := cache.Resize(size)
+			Expect(err).ShouldNot(HaveOccurred())
+		}
+		wg.Wait()
+
+		Expect(cache.Cache.Len()).To(BeNumerically("<=", 19))
+	})
+})
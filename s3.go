@@ -2,15 +2,19 @@ package filecache
 
 import (
 	"context"
-	"errors"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
-	"os"
+	"io"
+	"net/http"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -18,12 +22,60 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// sseCustomerKeyLength is the size in bytes of the AES256 keys S3 accepts for
+// SSE-C requests
+const sseCustomerKeyLength = 32
+
+// SSECustomerKeyProvider supplies the customer key needed to read objects stored
+// with server-side encryption with customer-provided keys (SSE-C). Returning a
+// nil key means the object is not encrypted with SSE-C.
+type SSECustomerKeyProvider interface {
+	SSECustomerKey(dr *DownloadRecord) ([]byte, error)
+}
+
+// SSECustomerKeyFunc allows an ordinary function to be used as an
+// SSECustomerKeyProvider
+type SSECustomerKeyFunc func(dr *DownloadRecord) ([]byte, error)
+
+// SSECustomerKey calls f(dr)
+func (f SSECustomerKeyFunc) SSECustomerKey(dr *DownloadRecord) ([]byte, error) {
+	return f(dr)
+}
+
+// ArgsSSECustomerKey returns a provider which reads a base64-encoded customer
+// key from the named DownloadRecord argument. The argument has to be registered
+// in HashableArgs, otherwise NewDownloadRecord drops it, and this also keeps
+// records encrypted with different keys apart in the cache.
+func ArgsSSECustomerKey(arg string) SSECustomerKeyProvider {
+	arg = strings.ToLower(arg)
+
+	return SSECustomerKeyFunc(func(dr *DownloadRecord) ([]byte, error) {
+		encodedKey, ok := dr.Args[arg]
+		if !ok || encodedKey == "" {
+			return nil, nil
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encodedKey)
+		if err != nil {
+			// Don't include the decoding error, it may quote the key material
+			return nil, fmt.Errorf("could not base64 decode SSE-C key from arg %q", arg)
+		}
+
+		return key, nil
+	})
+}
+
 // Manages a cache of s3manager.Downloader s that have been configured
 // for their correct region.
 type S3RegionManagedDownloader struct {
 	sync.RWMutex
-	DefaultRegion   string
-	DownloaderCache map[string]*s3manager.Downloader // Map buckets to regions
+	DefaultRegion          string
+	DownloaderCache        map[string]*s3manager.Downloader // Map buckets (and identities) to regions
+	BucketRegions          map[string]string                // Optional, regions of buckets which needn't be looked up
+	SSECustomerKeyProvider SSECustomerKeyProvider           // Optional, enables SSE-C
+	CredentialResolver     S3CredentialResolver             // Optional, defaults to ambient credentials
+	AllowEmpty             bool                             // Accept 0-byte objects, rejected by default
+	credentialCache        map[string]*credentials.Credentials
 }
 
 // NewS3RegionManagedDownloader returns a configured instance where the default
@@ -34,6 +86,7 @@ func NewS3RegionManagedDownloader(defaultRegion string) *S3RegionManagedDownload
 	return &S3RegionManagedDownloader{
 		DefaultRegion:   defaultRegion,
 		DownloaderCache: make(map[string]*s3manager.Downloader),
+		credentialCache: make(map[string]*credentials.Credentials),
 	}
 }
 
@@ -44,28 +97,39 @@ func NewS3RegionManagedDownloader(defaultRegion string) *S3RegionManagedDownload
 // penalty of roundtrips to Amazon to look up the region fo the requested
 // S3 bucket.
 func (m *S3RegionManagedDownloader) GetDownloader(ctx context.Context, bucket string) (*s3manager.Downloader, error) {
+	return m.GetIdentityDownloader(ctx, nil, bucket)
+}
+
+// GetIdentityDownloader works like GetDownloader, but the returned downloader
+// signs its requests as the given identity. Downloaders are cached per identity
+// and bucket, so they are never shared between identities. A nil identity uses
+// the ambient process credentials.
+func (m *S3RegionManagedDownloader) GetIdentityDownloader(ctx context.Context, identity *S3Identity, bucket string) (*s3manager.Downloader, error) {
+	cacheKey := downloaderCacheKey(identity, bucket)
 
 	m.RLock()
 	// Look it up in the cache first
-	if dLoader, ok := m.DownloaderCache[bucket]; ok {
+	if dLoader, ok := m.DownloaderCache[cacheKey]; ok {
 		m.RUnlock()
 		return dLoader, nil
 	}
 	m.RUnlock()
 
-	// We need an arbitrary, region-less session
-	sess := session.Must(session.NewSession())
-
-	region, err := s3manager.GetBucketRegion(ctx, sess, bucket, m.DefaultRegion)
+	region, err := m.bucketRegion(ctx, bucket)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
-			return nil, fmt.Errorf("Region for %s not found", bucket)
-		}
 		return nil, err
 	}
-	log.Debugf("Bucket '%s' is in region: %s", bucket, region)
 
-	sess, err = session.NewSession(&aws.Config{Region: aws.String(region)})
+	config := &aws.Config{Region: aws.String(region)}
+	if identity != nil {
+		creds, err := m.identityCredentials(identity, region)
+		if err != nil {
+			return nil, err
+		}
+		config.Credentials = creds
+	}
+
+	sess, err := session.NewSession(config)
 	if err != nil {
 		return nil, fmt.Errorf("Could not create S3 session for region '%s': %s", region, err)
 	}
@@ -73,39 +137,100 @@ func (m *S3RegionManagedDownloader) GetDownloader(ctx context.Context, bucket st
 	// Configure and then cache the downloader
 	dLoader := s3manager.NewDownloader(sess)
 	m.Lock()
-	m.DownloaderCache[bucket] = dLoader
+	m.DownloaderCache[cacheKey] = dLoader
 	m.Unlock()
 
 	return dLoader, nil
 }
 
+// bucketRegion returns the region a bucket lives in, from BucketRegions or
+// else by asking S3. The lookup is unsigned, so it needs no credentials.
+func (m *S3RegionManagedDownloader) bucketRegion(ctx context.Context, bucket string) (string, error) {
+	if region, ok := m.BucketRegions[bucket]; ok {
+		return region, nil
+	}
+
+	// We need an arbitrary, region-less session
+	sess, err := session.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("Could not create S3 session: %s", err)
+	}
+
+	region, err := s3manager.GetBucketRegion(ctx, sess, bucket, m.DefaultRegion)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+			return "", fmt.Errorf("Region for %s not found", bucket)
+		}
+		return "", err
+	}
+	log.Debugf("Bucket '%s' is in region: %s", bucket, region)
+
+	return region, nil
+}
+
 // Download will download a file from the specified S3 bucket into localFile
-func (m *S3RegionManagedDownloader) Download(dr *DownloadRecord, localFile *os.File, downloadTimeout time.Duration) error {
-	fname := dr.Path
+func (m *S3RegionManagedDownloader) Download(dr *DownloadRecord, localFile io.WriterAt, downloadTimeout time.Duration) error {
+	bucket, fname, err := splitS3Path(dr.Path)
+	if err != nil {
+		return err
+	}
 
-	// The S3 bucket is the first part of the path, everything else is filename
-	parts := strings.Split(fname, "/")
-	if len(parts) < 2 {
-		return fmt.Errorf("Not enough path to fetch a file! Expected <bucket>/<filename>")
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(fname),
+	}
+
+	// Resolve the SSE-C key before talking to S3 so a bad key fails fast
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5, err = m.sseCustomerKey(dr)
+	if err != nil {
+		return err
+	}
+
+	if dr.Validators != nil {
+		if dr.Validators.ETag != "" {
+			input.IfNoneMatch = aws.String(dr.Validators.ETag)
+		}
+		if !dr.Validators.LastModified.IsZero() {
+			input.IfModifiedSince = aws.Time(dr.Validators.LastModified)
+		}
 	}
-	bucket := parts[0]
-	fname = strings.Join(parts[1:], "/")
 
 	ctx, cancelFunc := context.WithTimeout(context.Background(), downloadTimeout)
 	defer cancelFunc()
 
+	identity, err := m.resolveIdentity(dr, bucket)
+	if err != nil {
+		return err
+	}
+
 	log.Debugf("Getting downloader for %s", bucket)
-	downloader, err := m.GetDownloader(ctx, bucket)
+	downloader, err := m.GetIdentityDownloader(ctx, identity, bucket)
 	if err != nil {
 		return fmt.Errorf("Unable to get downloader for %s: %s", bucket, err)
 	}
 
-	var requestID, hostID string
+	// Parts may be downloaded concurrently, so guard what we capture
+	var (
+		inspectLock       sync.Mutex
+		requestID, hostID string
+		info              *ObjectInfo
+	)
 	requestInspectorFunc := func(r *request.Request) {
+		// Ask for the object's checksums, which this SDK has no field for
+		r.HTTPRequest.Header.Set("X-Amz-Checksum-Mode", "ENABLED")
 		r.Handlers.Complete.PushBack(func(req *request.Request) {
+			inspectLock.Lock()
+			defer inspectLock.Unlock()
+
 			requestID = req.RequestID
 			if req.HTTPResponse != nil && req.HTTPResponse.Header != nil {
 				hostID = req.HTTPResponse.Header.Get("X-Amz-Id-2")
+				if req.Error == nil && info == nil {
+					info = objectInfoFromHeader(req.HTTPResponse.Header)
+					if digest, ok := etagDigest(req.HTTPResponse.Header); ok {
+						info.Digests = append(info.Digests, digest)
+					}
+				}
 			}
 		})
 	}
@@ -114,15 +239,16 @@ func (m *S3RegionManagedDownloader) Download(dr *DownloadRecord, localFile *os.F
 	numBytes, err := downloader.DownloadWithContext(
 		ctx,
 		localFile,
-		&s3.GetObjectInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(fname),
-		},
+		input,
 		s3manager.WithDownloaderRequestOptions(
 			requestInspectorFunc,
 		),
 	)
 	if err != nil {
+		if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusNotModified {
+			return ErrNotModified
+		}
+
 		errMessage := err.Error()
 		if s3Err, ok := err.(s3.RequestFailure); ok {
 			errMessage = fmt.Sprintf(
@@ -137,9 +263,174 @@ func (m *S3RegionManagedDownloader) Download(dr *DownloadRecord, localFile *os.F
 		time.Since(startTime).Seconds()*1000, bucket, fname, numBytes, requestID, hostID,
 	)
 
-	if numBytes < 1 {
-		return errors.New("0 length file received from S3")
+	if numBytes < 1 && !m.AllowEmpty {
+		return ErrEmptyObject
+	}
+
+	dr.Info = info
+
+	return nil
+}
+
+// Stat looks up the metadata of the file at the specified S3 location with a
+// HEAD request, without downloading it
+func (m *S3RegionManagedDownloader) Stat(dr *DownloadRecord, timeout time.Duration) (*ObjectInfo, error) {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), timeout)
+	defer cancelFunc()
+
+	return m.stat(ctx, dr)
+}
+
+// stat implements Stat for a caller supplied context
+func (m *S3RegionManagedDownloader) stat(ctx context.Context, dr *DownloadRecord) (*ObjectInfo, error) {
+	bucket, fname, err := splitS3Path(dr.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(fname),
+	}
+
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5, err = m.sseCustomerKey(dr)
+	if err != nil {
+		return nil, err
+	}
+
+	identity, err := m.resolveIdentity(dr, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	downloader, err := m.GetIdentityDownloader(ctx, identity, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get downloader for %s: %s", bucket, err)
+	}
+
+	output, err := downloader.S3.HeadObjectWithContext(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("Could not HEAD s3://%s/%s: %s", bucket, fname, err)
+	}
+
+	size := int64(-1)
+	if output.ContentLength != nil {
+		size = *output.ContentLength
+	}
+
+	return &ObjectInfo{
+		ETag:         aws.StringValue(output.ETag),
+		LastModified: aws.TimeValue(output.LastModified),
+		ContentType:  aws.StringValue(output.ContentType),
+		Size:         size,
+	}, nil
+}
+
+// Upload stores body at the specified S3 location, using the same identity and
+// SSE-C key as downloads of the record would, and fills in dr.Info with the
+// metadata of the new object
+func (m *S3RegionManagedDownloader) Upload(ctx context.Context, dr *DownloadRecord, body io.Reader) error {
+	bucket, fname, err := splitS3Path(dr.Path)
+	if err != nil {
+		return err
+	}
+
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(fname),
+		Body:   body,
 	}
 
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5, err = m.sseCustomerKey(dr)
+	if err != nil {
+		return err
+	}
+
+	identity, err := m.resolveIdentity(dr, bucket)
+	if err != nil {
+		return err
+	}
+
+	downloader, err := m.GetIdentityDownloader(ctx, identity, bucket)
+	if err != nil {
+		return fmt.Errorf("Unable to get downloader for %s: %s", bucket, err)
+	}
+
+	startTime := time.Now()
+	_, err = s3manager.NewUploaderWithClient(downloader.S3).UploadWithContext(ctx, input)
+	if err != nil {
+		return fmt.Errorf("Could not upload to S3: %s", err)
+	}
+
+	log.Infof("Took %.2fms to upload s3://%s/%s", time.Since(startTime).Seconds()*1000, bucket, fname)
+
+	// Uploads don't tell us the Last-Modified, so look it up to be able to
+	// revalidate the cached copy later on
+	info, err := m.stat(ctx, dr)
+	if err != nil {
+		log.Warnf("Unable to look up metadata of uploaded s3://%s/%s: %s", bucket, fname, err)
+		return nil
+	}
+	dr.Info = info
+
 	return nil
 }
+
+// etagDigest returns the MD5 of an object from its S3 ETag. That only holds for
+// objects uploaded in one part and without SSE-KMS or SSE-C encryption.
+func etagDigest(header http.Header) (Digest, bool) {
+	if header.Get("X-Amz-Server-Side-Encryption") == "aws:kms" ||
+		header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != "" {
+		return Digest{}, false
+	}
+
+	value, err := hex.DecodeString(strings.Trim(header.Get("ETag"), `"`))
+	if err != nil || len(value) != md5.Size {
+		return Digest{}, false
+	}
+
+	return Digest{Algorithm: DigestMD5, Value: value}, true
+}
+
+// splitS3Path splits a record path into the S3 bucket, which is the first part
+// of the path, and the key, which is everything else
+func splitS3Path(path string) (bucket, key string, err error) {
+	parts := strings.Split(path, "/")
+	if len(parts) < 2 {
+		return "", "", fmt.Errorf("Not enough path to fetch a file! Expected <bucket>/<filename>")
+	}
+
+	return parts[0], strings.Join(parts[1:], "/"), nil
+}
+
+// sseCustomerKey looks up the SSE-C key for the record and returns the values
+// for the SSECustomerAlgorithm, SSECustomerKey and SSECustomerKeyMD5 request
+// fields. All of them are nil when SSE-C is not in use. The key itself must
+// never be logged or included in error messages.
+func (m *S3RegionManagedDownloader) sseCustomerKey(dr *DownloadRecord) (algorithm, key, keyMD5 *string, err error) {
+	if m.SSECustomerKeyProvider == nil {
+		return nil, nil, nil, nil
+	}
+
+	rawKey, err := m.SSECustomerKeyProvider.SSECustomerKey(dr)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("could not get SSE-C key for %q: %s", dr.Path, err)
+	}
+
+	if rawKey == nil {
+		return nil, nil, nil, nil
+	}
+
+	if len(rawKey) != sseCustomerKeyLength {
+		return nil, nil, nil, fmt.Errorf(
+			"invalid SSE-C key for %q: expected %d bytes, got %d", dr.Path, sseCustomerKeyLength, len(rawKey),
+		)
+	}
+
+	keySum := md5.Sum(rawKey)
+
+	return aws.String(s3.ServerSideEncryptionAes256),
+		aws.String(string(rawKey)),
+		aws.String(base64.StdEncoding.EncodeToString(keySum[:])),
+		nil
+}
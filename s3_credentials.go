@@ -0,0 +1,162 @@
+package filecache
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// S3Identity describes an AWS identity used to access one or more buckets
+type S3Identity struct {
+	// Name uniquely identifies the identity. Credentials, sessions and
+	// downloaders are cached by Name, so different identities must never
+	// share one.
+	Name string
+
+	// Credentials are used directly, or as the source credentials when
+	// assuming RoleARN. Leave nil to use the ambient process credentials.
+	Credentials *credentials.Credentials
+
+	// RoleARN, when set, is assumed via STS. The temporary credentials are
+	// cached and refreshed by the AWS SDK before they expire.
+	RoleARN         string
+	ExternalID      string
+	RoleSessionName string
+	Duration        time.Duration
+}
+
+// S3CredentialResolver picks the identity used to access a bucket on behalf of
+// a DownloadRecord. A nil identity means the ambient process credentials.
+type S3CredentialResolver interface {
+	ResolveIdentity(dr *DownloadRecord, bucket string) (*S3Identity, error)
+}
+
+// S3CredentialResolverFunc allows an ordinary function to be used as an
+// S3CredentialResolver
+type S3CredentialResolverFunc func(dr *DownloadRecord, bucket string) (*S3Identity, error)
+
+// ResolveIdentity calls f(dr, bucket)
+func (f S3CredentialResolverFunc) ResolveIdentity(dr *DownloadRecord, bucket string) (*S3Identity, error) {
+	return f(dr, bucket)
+}
+
+// BucketCredentials returns a resolver which maps bucket names to identities.
+// Buckets which are not in the map use the ambient process credentials.
+func BucketCredentials(identities map[string]*S3Identity) S3CredentialResolver {
+	return S3CredentialResolverFunc(func(dr *DownloadRecord, bucket string) (*S3Identity, error) {
+		return identities[bucket], nil
+	})
+}
+
+// ArgsCredentials returns a resolver which looks up the identity named by a
+// credential hint in the record's Args. Records without the hint use the
+// ambient process credentials, while unknown hints are rejected. The argument
+// has to be registered in HashableArgs so that it survives NewDownloadRecord
+// and keeps the cache entries of different identities apart.
+func ArgsCredentials(arg string, identities map[string]*S3Identity) S3CredentialResolver {
+	arg = strings.ToLower(arg)
+
+	return S3CredentialResolverFunc(func(dr *DownloadRecord, bucket string) (*S3Identity, error) {
+		hint, ok := dr.Args[arg]
+		if !ok || hint == "" {
+			return nil, nil
+		}
+
+		identity, ok := identities[hint]
+		if !ok {
+			return nil, fmt.Errorf("unknown credential hint for bucket %s", bucket)
+		}
+
+		return identity, nil
+	})
+}
+
+// resolveIdentity asks the configured resolver, if any, for the identity to use
+func (m *S3RegionManagedDownloader) resolveIdentity(dr *DownloadRecord, bucket string) (*S3Identity, error) {
+	if m.CredentialResolver == nil {
+		return nil, nil
+	}
+
+	identity, err := m.CredentialResolver.ResolveIdentity(dr, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve credentials for %s: %s", bucket, err)
+	}
+
+	if identity != nil && identity.Name == "" {
+		return nil, errors.New("S3 identity has an empty name")
+	}
+
+	return identity, nil
+}
+
+// identityCredentials returns the cached credentials for an identity, building
+// them on first use. Assumed role credentials are shared by every bucket the
+// identity accesses. Roles are assumed through STS in the DefaultRegion, or in
+// the region of the bucket which needed them first if there is none.
+func (m *S3RegionManagedDownloader) identityCredentials(identity *S3Identity, bucketRegion string) (*credentials.Credentials, error) {
+	m.RLock()
+	creds, ok := m.credentialCache[identity.Name]
+	m.RUnlock()
+	if ok {
+		return creds, nil
+	}
+
+	creds = identity.Credentials
+	if identity.RoleARN != "" {
+		region := m.DefaultRegion
+		if region == "" {
+			region = bucketRegion
+		}
+
+		sess, err := session.NewSession(&aws.Config{
+			Region:      aws.String(region),
+			Credentials: identity.Credentials,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not create STS session for identity %q: %s", identity.Name, err)
+		}
+
+		creds = stscreds.NewCredentials(sess, identity.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+			if identity.ExternalID != "" {
+				p.ExternalID = aws.String(identity.ExternalID)
+			}
+			if identity.RoleSessionName != "" {
+				p.RoleSessionName = identity.RoleSessionName
+			}
+			if identity.Duration > 0 {
+				p.Duration = identity.Duration
+			}
+		})
+	}
+
+	m.Lock()
+	if m.credentialCache == nil {
+		m.credentialCache = make(map[string]*credentials.Credentials)
+	}
+	// Another goroutine may have beaten us to it, keep theirs
+	if cached, ok := m.credentialCache[identity.Name]; ok {
+		creds = cached
+	} else {
+		m.credentialCache[identity.Name] = creds
+	}
+	m.Unlock()
+
+	return creds, nil
+}
+
+// downloaderCacheKey keys downloaders by identity as well as bucket so one
+// tenant's session is never reused for another tenant's bucket. Bucket names
+// can't contain slashes, so the key is unambiguous.
+func downloaderCacheKey(identity *S3Identity, bucket string) string {
+	if identity == nil {
+		return bucket
+	}
+
+	return identity.Name + "/" + bucket
+}
@@ -0,0 +1,130 @@
+package filecache_test
+
+import (
+	"context"
+
+	. "github.com/Nitro/filecache"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("S3 credentials", func() {
+	var (
+		tenantA = &S3Identity{
+			Name:        "tenant-a",
+			Credentials: credentials.NewStaticCredentials("AKIDA", "secret-a", ""),
+		}
+		tenantB = &S3Identity{
+			Name:    "tenant-b",
+			RoleARN: "arn:aws:iam::123456789012:role/tenant-b",
+		}
+	)
+
+	Describe("BucketCredentials()", func() {
+		It("maps buckets to identities", func() {
+			resolver := BucketCredentials(map[string]*S3Identity{"bucket-a": tenantA})
+
+			identity, err := resolver.ResolveIdentity(&DownloadRecord{Path: "bucket-a/foo.pdf"}, "bucket-a")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(identity).To(Equal(tenantA))
+		})
+
+		It("falls back to the ambient credentials for unknown buckets", func() {
+			resolver := BucketCredentials(map[string]*S3Identity{"bucket-a": tenantA})
+
+			identity, err := resolver.ResolveIdentity(&DownloadRecord{Path: "bucket-z/foo.pdf"}, "bucket-z")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(identity).To(BeNil())
+		})
+	})
+
+	Describe("ArgsCredentials()", func() {
+		var resolver S3CredentialResolver
+
+		BeforeEach(func() {
+			HashableArgs["x-tenant"] = struct{}{}
+			resolver = ArgsCredentials("X-Tenant", map[string]*S3Identity{
+				"a": tenantA,
+				"b": tenantB,
+			})
+		})
+
+		AfterEach(func() {
+			delete(HashableArgs, "x-tenant")
+		})
+
+		It("picks the identity named by the credential hint", func() {
+			dr, _ := NewDownloadRecord("/documents/shared/foo.pdf", map[string]string{"X-Tenant": "b"})
+
+			identity, err := resolver.ResolveIdentity(dr, "shared")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(identity).To(Equal(tenantB))
+		})
+
+		It("rejects unknown hints", func() {
+			dr, _ := NewDownloadRecord("/documents/shared/foo.pdf", map[string]string{"X-Tenant": "mallory"})
+
+			_, err := resolver.ResolveIdentity(dr, "shared")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("keeps the cache entries of different identities apart", func() {
+			drA, _ := NewDownloadRecord("/documents/shared/foo.pdf", map[string]string{"X-Tenant": "a"})
+			drB, _ := NewDownloadRecord("/documents/shared/foo.pdf", map[string]string{"X-Tenant": "b"})
+
+			Expect(drA.GetUniqueName()).NotTo(Equal(drB.GetUniqueName()))
+		})
+	})
+
+	Describe("GetIdentityDownloader()", func() {
+		It("never reuses a downloader across identities", func() {
+			manager := NewS3RegionManagedDownloader("us-west-2")
+			manager.BucketRegions = map[string]string{"nitro-public": "us-west-2"}
+			ambient := &s3manager.Downloader{}
+			manager.DownloaderCache["nitro-public"] = ambient
+
+			dLoader, err := manager.GetIdentityDownloader(context.Background(), tenantA, "nitro-public")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dLoader).NotTo(BeIdenticalTo(ambient))
+
+			cached, err := manager.GetIdentityDownloader(context.Background(), tenantA, "nitro-public")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cached).To(BeIdenticalTo(dLoader))
+		})
+
+		It("assumes roles in the bucket's region without a default region", func() {
+			manager := NewS3RegionManagedDownloader("")
+			manager.BucketRegions = map[string]string{"nitro-public": "eu-west-1"}
+
+			dLoader, err := manager.GetIdentityDownloader(context.Background(), tenantB, "nitro-public")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*dLoader.S3.(*s3.S3).Config.Region).To(Equal("eu-west-1"))
+		})
+
+		It("works when the manager is built as a struct literal", func() {
+			manager := &S3RegionManagedDownloader{
+				DefaultRegion:   "us-west-2",
+				DownloaderCache: map[string]*s3manager.Downloader{},
+				BucketRegions:   map[string]string{"nitro-public": "us-west-2"},
+			}
+
+			dLoader, err := manager.GetIdentityDownloader(context.Background(), tenantA, "nitro-public")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dLoader).NotTo(BeNil())
+		})
+
+		It("rejects identities without a name", func() {
+			manager := NewS3RegionManagedDownloader("us-west-2")
+			manager.CredentialResolver = BucketCredentials(map[string]*S3Identity{
+				"nitro-public": {RoleARN: "arn:aws:iam::123456789012:role/nameless"},
+			})
+
+			err := manager.Download(&DownloadRecord{Path: "nitro-public/foo.pdf"}, nil, 0)
+			Expect(err).To(MatchError(ContainSubstring("empty name")))
+		})
+	})
+})
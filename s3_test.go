@@ -2,7 +2,9 @@ package filecache_test
 
 import (
 	"context"
+	"encoding/base64"
 	"os"
+	"strings"
 	"time"
 
 	. "github.com/Nitro/filecache"
@@ -74,4 +76,61 @@ var _ = Describe("S3", func() {
 			Expect(err.Error()).NotTo(BeNil())
 		})
 	})
+
+	Describe("ArgsSSECustomerKey()", func() {
+		var (
+			sseKey = strings.Repeat("k", 32)
+			dr     *DownloadRecord
+		)
+
+		BeforeEach(func() {
+			HashableArgs["x-sse-key"] = struct{}{}
+		})
+
+		AfterEach(func() {
+			delete(HashableArgs, "x-sse-key")
+		})
+
+		It("decodes the key from the record args", func() {
+			dr, _ = NewDownloadRecord("/documents/sse-bucket/foo.pdf", map[string]string{
+				"X-SSE-Key": base64.StdEncoding.EncodeToString([]byte(sseKey)),
+			})
+
+			key, err := ArgsSSECustomerKey("X-SSE-Key").SSECustomerKey(dr)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(key)).To(Equal(sseKey))
+		})
+
+		It("returns no key when the arg is missing", func() {
+			dr, _ = NewDownloadRecord("/documents/sse-bucket/foo.pdf", nil)
+
+			key, err := ArgsSSECustomerKey("x-sse-key").SSECustomerKey(dr)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(key).To(BeNil())
+		})
+
+		It("rejects keys of the wrong length without leaking them", func() {
+			dr, _ = NewDownloadRecord("/documents/sse-bucket/foo.pdf", map[string]string{
+				"x-sse-key": base64.StdEncoding.EncodeToString([]byte("short-secret")),
+			})
+			manager.SSECustomerKeyProvider = ArgsSSECustomerKey("x-sse-key")
+
+			err := manager.Download(dr, localFile, 10*time.Second)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("expected 32 bytes"))
+			Expect(err.Error()).NotTo(ContainSubstring("short-secret"))
+		})
+
+		It("never puts the key in the cache file name", func() {
+			encodedKey := base64.StdEncoding.EncodeToString([]byte(sseKey))
+			dr, _ = NewDownloadRecord("/documents/sse-bucket/foo.pdf", map[string]string{
+				"x-sse-key": encodedKey,
+			})
+			cache, err := New(10, ".", S3SSECustomerKey(ArgsSSECustomerKey("x-sse-key")))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(cache.GetFileName(dr)).NotTo(ContainSubstring(encodedKey))
+			Expect(dr.GetUniqueName()).NotTo(ContainSubstring(encodedKey))
+		})
+	})
 })
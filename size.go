@@ -0,0 +1,216 @@
+package filecache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrEmptyObject is returned by the S3 downloader for 0-byte objects,
+	// unless the SizePolicy's AllowEmpty is set
+	ErrEmptyObject = errors.New("0 length file received")
+	// ErrObjectTooSmall is returned for objects smaller than the SizePolicy's
+	// MinSize
+	ErrObjectTooSmall = errors.New("object is smaller than the minimum size")
+	// ErrObjectTooLarge is returned for objects larger than the SizePolicy's
+	// MaxSize, before they are downloaded when the origin reports their size,
+	// and otherwise as soon as the download goes over the limit
+	ErrObjectTooLarge = errors.New("object is larger than the maximum size")
+)
+
+// SizePolicy bounds the size of the objects the cache downloads
+type SizePolicy struct {
+	// MinSize is the smallest object accepted
+	MinSize int64
+	// MaxSize is the largest object accepted, zero for no limit
+	MaxSize int64
+	// AllowEmpty lets the S3 downloader accept 0-byte objects, which it
+	// rejects by default. MinSize must be zero.
+	AllowEmpty bool
+}
+
+// allows reports why an object of the given size is refused, if it is
+func (p *SizePolicy) allows(size int64) error {
+	if size < p.MinSize {
+		return ErrObjectTooSmall
+	}
+	if p.MaxSize > 0 && size > p.MaxSize {
+		return ErrObjectTooLarge
+	}
+	return nil
+}
+
+// ObjectSizes sets the sizes of objects the cache accepts. Sizes are checked
+// with a HEAD request before downloading, where the downloader supports it,
+// again while downloading, and once the download is complete. The HEAD request
+// is skipped when revalidating, since the object is most likely unchanged. The
+// S3 downloader rejects empty objects unless the policy allows them. Files
+// written by a custom DownloadFunc, and uploads staged by Put, are only checked
+// once complete. Files added to Cache directly aren't checked at all.
+func ObjectSizes(policy SizePolicy) option {
+	return func(c *FileCache) error {
+		if policy.MinSize < 0 || policy.MaxSize < 0 {
+			return errors.New("negative object size limit")
+		}
+		if policy.MaxSize > 0 && policy.MinSize > policy.MaxSize {
+			return fmt.Errorf("minimum object size %d is above the maximum of %d", policy.MinSize, policy.MaxSize)
+		}
+		if policy.AllowEmpty && policy.MinSize > 0 {
+			return fmt.Errorf("empty objects are allowed but the minimum object size is %d", policy.MinSize)
+		}
+
+		c.sizes = &policy
+
+		return nil
+	}
+}
+
+// sizeFromHeader returns the size of the object in an HTTP response, which is
+// the total in Content-Range for partial responses, or -1 if it is unknown
+func sizeFromHeader(header http.Header) int64 {
+	if contentRange := header.Get("Content-Range"); contentRange != "" {
+		i := strings.LastIndexByte(contentRange, '/')
+		if i < 0 {
+			return -1
+		}
+		size, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+		if err != nil {
+			return -1
+		}
+		return size
+	}
+
+	size, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// preflightSize looks up the size of an object before downloading it, when
+// there is a SizePolicy and the downloader can tell, and refuses it if it is
+// out of bounds. Failed lookups are left to the download itself, and so are
+// conditional requests, which are cheap when the object hasn't changed.
+func (c *FileCache) preflightSize(dr *DownloadRecord) error {
+	if c.sizes == nil || dr.Validators != nil {
+		return nil
+	}
+
+	statter, ok := c.statters[dr.Manager]
+	if !ok {
+		return nil
+	}
+
+	info, err := statter(dr)
+	if err != nil {
+		log.Debugf("Unable to look up the size of %s before downloading it: %s", dr.Path, err)
+		return nil
+	}
+	if info == nil || info.Size < 0 {
+		return nil
+	}
+
+	if err := c.sizes.allows(info.Size); err != nil {
+		log.Warnf("Not downloading %s, which is %d bytes: %s", dr.Path, info.Size, err)
+		return err
+	}
+
+	return nil
+}
+
+// checkSize refuses a complete download which is out of bounds
+func (c *FileCache) checkSize(dr *DownloadRecord, file *os.File) error {
+	if c.sizes == nil {
+		return nil
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("could not stat downloaded file: %s", err)
+	}
+
+	if err := c.sizes.allows(info.Size()); err != nil {
+		log.Warnf("Discarding %s, which is %d bytes: %s", dr.Path, info.Size(), err)
+		return err
+	}
+
+	return nil
+}
+
+// newSizeLimit returns the limit downloads are held to as they are written,
+// or nil if there is none
+func (c *FileCache) newSizeLimit() *sizeLimit {
+	if c.sizes == nil || c.sizes.MaxSize == 0 {
+		return nil
+	}
+
+	return &sizeLimit{max: c.sizes.MaxSize}
+}
+
+// sizeLimit fails writes to a download past the maximum object size
+type sizeLimit struct {
+	max      int64
+	exceeded int32 // Set atomically, parts may be written concurrently
+}
+
+// writer wraps the file a downloader writes to sequentially
+func (l *sizeLimit) writer(w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+	return &sizeLimitedWriter{limit: l, w: w}
+}
+
+// writerAt wraps the file a downloader writes to in parts
+func (l *sizeLimit) writerAt(w io.WriterAt) io.WriterAt {
+	if l == nil {
+		return w
+	}
+	return &sizeLimitedWriter{limit: l, wa: w}
+}
+
+// wasExceeded reports whether a write went over the limit
+func (l *sizeLimit) wasExceeded() bool {
+	return l != nil && atomic.LoadInt32(&l.exceeded) != 0
+}
+
+// allows reports whether a write ending at end fits within the limit
+func (l *sizeLimit) allows(end int64) bool {
+	if end <= l.max {
+		return true
+	}
+	atomic.StoreInt32(&l.exceeded, 1)
+	return false
+}
+
+// sizeLimitedWriter applies a sizeLimit to a writer
+type sizeLimitedWriter struct {
+	limit  *sizeLimit
+	w      io.Writer
+	wa     io.WriterAt
+	offset int64 // For sequential writes
+}
+
+func (w *sizeLimitedWriter) Write(b []byte) (int, error) {
+	if !w.limit.allows(w.offset + int64(len(b))) {
+		return 0, ErrObjectTooLarge
+	}
+	n, err := w.w.Write(b)
+	w.offset += int64(n)
+	return n, err
+}
+
+func (w *sizeLimitedWriter) WriteAt(b []byte, offset int64) (int, error) {
+	if !w.limit.allows(offset + int64(len(b))) {
+		return 0, ErrObjectTooLarge
+	}
+	return w.wa.WriteAt(b, offset)
+}
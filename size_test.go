@@ -0,0 +1,197 @@
+package filecache
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ObjectSizes", func() {
+	var (
+		cache     *FileCache
+		baseDir   string
+		contents  map[string]string
+		reported  map[string]int64
+		etags     map[string]string
+		downloads int
+		written   int
+		stats     int
+	)
+
+	newCache := func(policy SizePolicy) {
+		var err error
+		cache, err = New(10, baseDir, ObjectSizes(policy))
+		Expect(err).ShouldNot(HaveOccurred())
+		stubDownloads(cache, func(dr *DownloadRecord, localFile *os.File) error {
+			downloads++
+			if etag, ok := etags[dr.Path]; ok {
+				dr.Info = &ObjectInfo{ETag: etag}
+			}
+			writer := dr.limit.writer(localFile)
+			for _, chunk := range strings.SplitAfter(contents[dr.Path], " ") {
+				n, err := writer.Write([]byte(chunk))
+				written += n
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		cache.statters[DownloadMangerDropbox] = func(dr *DownloadRecord) (*ObjectInfo, error) {
+			stats++
+			size, ok := reported[dr.Path]
+			if !ok {
+				size = -1
+			}
+			return &ObjectInfo{Size: size}, nil
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		baseDir, err = ioutil.TempDir("", "filecache-size")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		contents = map[string]string{
+			"erebor/coin.txt":  "gold",
+			"erebor/hoard.txt": "gold and silver and mithril and the Arkenstone",
+			"erebor/empty.txt": "",
+		}
+		reported = map[string]int64{
+			"erebor/coin.txt":  4,
+			"erebor/hoard.txt": 46,
+			"erebor/empty.txt": 0,
+		}
+		downloads = 0
+		written = 0
+		stats = 0
+		etags = map[string]string{}
+
+		newCache(SizePolicy{MinSize: 1, MaxSize: 16})
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(baseDir)
+	})
+
+	It("downloads objects within bounds", func() {
+		Expect(cache.Fetch(&DownloadRecord{Manager: DownloadMangerDropbox, Path: "erebor/coin.txt"})).To(BeTrue())
+	})
+
+	It("refuses objects reported as too large before downloading them", func() {
+		_, err := cache.Pin(&DownloadRecord{Manager: DownloadMangerDropbox, Path: "erebor/hoard.txt"}, 0)
+		Expect(err).To(Equal(ErrObjectTooLarge))
+		Expect(downloads).To(Equal(0))
+	})
+
+	It("refuses objects reported as too small before downloading them", func() {
+		_, err := cache.Pin(&DownloadRecord{Manager: DownloadMangerDropbox, Path: "erebor/empty.txt"}, 0)
+		Expect(err).To(Equal(ErrObjectTooSmall))
+		Expect(downloads).To(Equal(0))
+	})
+
+	It("aborts downloads which go over the limit", func() {
+		delete(reported, "erebor/hoard.txt")
+
+		dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "erebor/hoard.txt"}
+		_, err := cache.Pin(dr, 0)
+		Expect(err).To(Equal(ErrObjectTooLarge))
+		Expect(downloads).To(Equal(1))
+		Expect(written).To(BeNumerically("<=", 16))
+		Expect(cache.Contains(dr)).To(BeFalse())
+	})
+
+	It("checks the size of complete downloads", func() {
+		delete(reported, "erebor/empty.txt")
+
+		_, err := cache.Pin(&DownloadRecord{Manager: DownloadMangerDropbox, Path: "erebor/empty.txt"}, 0)
+		Expect(err).To(Equal(ErrObjectTooSmall))
+		Expect(downloads).To(Equal(1))
+	})
+
+	It("checks the size of files written by a custom DownloadFunc", func() {
+		cache.DownloadFunc = func(dr *DownloadRecord, localPath string) error {
+			Expect(os.MkdirAll(filepath.Dir(localPath), 0755)).To(Succeed())
+			return ioutil.WriteFile(localPath, []byte(contents[dr.Path]), 0644)
+		}
+
+		dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "erebor/hoard.txt"}
+		_, err := cache.Pin(dr, 0)
+		Expect(err).To(Equal(ErrObjectTooLarge))
+		Expect(cache.Contains(dr)).To(BeFalse())
+		_, err = os.Stat(cache.GetFileName(dr))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("checks the size of uploads before uploading them", func() {
+		uploads := 0
+		cache.uploaders[DownloadMangerDropbox] = func(ctx context.Context, dr *DownloadRecord, body io.ReadSeeker) error {
+			uploads++
+			return nil
+		}
+
+		dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "erebor/hoard.txt"}
+		err := cache.Put(context.Background(), dr, strings.NewReader("gold and silver and mithril"))
+		Expect(err).To(Equal(ErrObjectTooLarge))
+		Expect(uploads).To(BeZero())
+		Expect(cache.Contains(dr)).To(BeFalse())
+	})
+
+	It("allows empty objects with no minimum size", func() {
+		newCache(SizePolicy{})
+
+		Expect(cache.Fetch(&DownloadRecord{Manager: DownloadMangerDropbox, Path: "erebor/empty.txt"})).To(BeTrue())
+		Expect(cache.Fetch(&DownloadRecord{Manager: DownloadMangerDropbox, Path: "erebor/hoard.txt"})).To(BeTrue())
+	})
+
+	It("only lets S3 download empty objects when the policy says so", func() {
+		newCache(SizePolicy{})
+		Expect(cache.s3Manager().AllowEmpty).To(BeFalse())
+
+		newCache(SizePolicy{AllowEmpty: true})
+		Expect(cache.s3Manager().AllowEmpty).To(BeTrue())
+	})
+
+	It("doesn't look up the size again when revalidating", func() {
+		etags["erebor/coin.txt"] = "smaug"
+		dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "erebor/coin.txt"}
+		Expect(cache.Fetch(dr)).To(BeTrue())
+		Expect(stats).To(Equal(1))
+
+		Expect(cache.Revalidate(dr)).To(Succeed())
+		Expect(stats).To(Equal(1))
+		Expect(downloads).To(Equal(2))
+	})
+
+	It("rejects inconsistent policies", func() {
+		_, err := New(10, baseDir, ObjectSizes(SizePolicy{MinSize: 10, MaxSize: 5}))
+		Expect(err).To(HaveOccurred())
+
+		_, err = New(10, baseDir, ObjectSizes(SizePolicy{MinSize: -1}))
+		Expect(err).To(HaveOccurred())
+
+		_, err = New(10, baseDir, ObjectSizes(SizePolicy{MinSize: 1, AllowEmpty: true}))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("reads object sizes from response headers", func() {
+		header := http.Header{}
+		Expect(sizeFromHeader(header)).To(Equal(int64(-1)))
+
+		header.Set("Content-Length", "1024")
+		Expect(sizeFromHeader(header)).To(Equal(int64(1024)))
+
+		header.Set("Content-Range", "bytes 0-1023/5000000")
+		Expect(sizeFromHeader(header)).To(Equal(int64(5000000)))
+
+		header.Set("Content-Range", "bytes 0-1023/*")
+		Expect(sizeFromHeader(header)).To(Equal(int64(-1)))
+	})
+})
@@ -0,0 +1,381 @@
+package filecache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// downloadProgress follows a download as it is written to disk, so that
+// readers can consume it before it completes
+type downloadProgress struct {
+	lock       sync.Mutex
+	cond       *sync.Cond
+	path       string // Where the data is, empty until the download starts
+	partial    bool   // path is the download itself, not yet stored
+	generation int    // Bumped whenever path starts over with new data
+	available  int64  // Bytes written without gaps from the start
+	pending    map[int64]int64
+	done       bool
+	err        error
+	sizeOf     func(path string) (int64, error) // Of a finished file's contents
+}
+
+func newDownloadProgress(sizeOf func(path string) (int64, error)) *downloadProgress {
+	p := &downloadProgress{sizeOf: sizeOf}
+	p.cond = sync.NewCond(&p.lock)
+	return p
+}
+
+// start is called when a download starts writing to path
+func (p *downloadProgress) start(path string) {
+	if p == nil {
+		return
+	}
+
+	p.lock.Lock()
+	p.path = path
+	p.partial = true
+	p.generation++
+	p.available = 0
+	p.pending = nil
+	p.lock.Unlock()
+
+	p.cond.Broadcast()
+}
+
+// wrote records that the bytes in [offset, offset+n) were written. Downloads
+// made of concurrent parts don't write in order, so readers are only told
+// about the bytes once there are no gaps before them.
+func (p *downloadProgress) wrote(offset int64, n int) {
+	if n <= 0 {
+		return
+	}
+
+	p.lock.Lock()
+	end := offset + int64(n)
+	if offset > p.available {
+		if p.pending == nil {
+			p.pending = make(map[int64]int64)
+		}
+		if end > p.pending[offset] {
+			p.pending[offset] = end
+		}
+		p.lock.Unlock()
+		return
+	}
+
+	if end > p.available {
+		p.available = end
+	}
+	for merged := true; merged; {
+		merged = false
+		for start, end := range p.pending {
+			if start <= p.available {
+				if end > p.available {
+					p.available = end
+				}
+				delete(p.pending, start)
+				merged = true
+			}
+		}
+	}
+	p.lock.Unlock()
+
+	p.cond.Broadcast()
+}
+
+// rename moves the finished download into place without readers noticing
+func (p *downloadProgress) rename(from, to string) error {
+	if p == nil {
+		return os.Rename(from, to)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	err := os.Rename(from, to)
+	if err == nil && p.path == from {
+		p.path = to
+		p.partial = false
+	}
+
+	return err
+}
+
+// link gives the finished download a second name, which readers follow, while
+// keeping the first one
+func (p *downloadProgress) link(from, to string) error {
+	if p == nil {
+		return linkReplacing(from, to)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	err := linkReplacing(from, to)
+	if err == nil && p.path == from {
+		p.path = to
+		p.partial = false
+	}
+
+	return err
+}
+
+// linkReplacing makes to a hard link to from, replacing anything already there
+func linkReplacing(from, to string) error {
+	link := fmt.Sprintf("%s.link-%d", to, time.Now().UnixNano())
+	err := os.Link(from, link)
+	if err == nil {
+		err = os.Rename(link, to)
+	}
+	if err != nil {
+		os.Remove(link)
+	}
+
+	return err
+}
+
+// finish is called once the download is over, with the path the complete file
+// can be read from
+func (p *downloadProgress) finish(path string, err error) {
+	p.lock.Lock()
+	p.done = true
+	p.err = err
+	if err == nil {
+		if p.path != path {
+			// Not what we were writing, e.g. the origin reported no changes
+			p.path = path
+			p.partial = false
+			p.generation++
+		}
+
+		size, sizeErr := p.sizeOf(path)
+		if sizeErr != nil {
+			p.err = fmt.Errorf("could not stat downloaded file: %s", sizeErr)
+		} else {
+			p.available = size
+		}
+	}
+	p.lock.Unlock()
+
+	p.cond.Broadcast()
+}
+
+// writer wraps the file a downloader writes to in order, reporting progress
+func (p *downloadProgress) writer(file *os.File) io.Writer {
+	if p == nil {
+		return file
+	}
+	return &progressWriter{progress: p, file: file}
+}
+
+// writerAt wraps the file a downloader writes to in parts, reporting progress
+func (p *downloadProgress) writerAt(file *os.File) io.WriterAt {
+	if p == nil {
+		return file
+	}
+	return &progressWriter{progress: p, file: file}
+}
+
+// progressWriter reports writes to a file to its downloadProgress
+type progressWriter struct {
+	progress *downloadProgress
+	file     *os.File
+	offset   int64 // For sequential writes
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	n, err := w.file.Write(b)
+	w.progress.wrote(w.offset, n)
+	w.offset += int64(n)
+	return n, err
+}
+
+func (w *progressWriter) WriteAt(b []byte, offset int64) (int, error) {
+	n, err := w.file.WriteAt(b, offset)
+	w.progress.wrote(offset, n)
+	return n, err
+}
+
+// streamReader reads a file while it is being downloaded
+type streamReader struct {
+	cache      *FileCache
+	record     *DownloadRecord
+	progress   *downloadProgress
+	stored     *storedFile
+	decoder    io.ReadCloser // Positioned at offset, for compressed files
+	generation int
+	offset     int64
+	closed     bool // Guarded by progress.lock
+}
+
+func (c *FileCache) newStreamReader(dr *DownloadRecord, progress *downloadProgress) *streamReader {
+	return &streamReader{cache: c, record: dr, progress: progress}
+}
+
+func (r *streamReader) Read(b []byte) (int, error) {
+	p := r.progress
+
+	p.lock.Lock()
+	for !r.closed && !p.done && (p.path == "" || r.offset >= p.available) {
+		p.cond.Wait()
+	}
+
+	if r.closed {
+		p.lock.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	if p.err != nil {
+		p.lock.Unlock()
+		return 0, p.err
+	}
+	if r.offset >= p.available {
+		p.lock.Unlock()
+		return 0, io.EOF
+	}
+
+	// Opening under the lock means the file can't be renamed meanwhile
+	if r.stored == nil || r.generation != p.generation {
+		r.closeFile()
+		if err := r.open(p.path, p.partial); err != nil {
+			p.lock.Unlock()
+			return 0, err
+		}
+		r.generation = p.generation
+	}
+
+	if remaining := p.available - r.offset; int64(len(b)) > remaining {
+		b = b[:remaining]
+	}
+	stored, decoder := r.stored, r.decoder
+	p.lock.Unlock()
+
+	var n int
+	var err error
+	if decoder != nil {
+		n, err = decoder.Read(b)
+	} else {
+		n, err = stored.data.ReadAt(b, r.offset)
+	}
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+
+	return n, err
+}
+
+// open opens the file at path, positioned at our offset. Partial downloads are
+// read as they are, stored files through their headers. Must be called with
+// progress.lock held.
+func (r *streamReader) open(path string, partial bool) error {
+	var stored *storedFile
+	var err error
+	if partial {
+		stored, err = openPartial(path)
+	} else {
+		stored, err = r.cache.openStored(r.record, path)
+	}
+	if err != nil {
+		return err
+	}
+
+	if stored.codec != nil {
+		r.decoder, err = stored.decoder(r.offset)
+		if err != nil {
+			stored.file.Close()
+			return err
+		}
+	}
+	r.stored = stored
+
+	return nil
+}
+
+// closeFile closes the file we were reading, if any. Must be called with
+// progress.lock held.
+func (r *streamReader) closeFile() error {
+	if r.decoder != nil {
+		r.decoder.Close()
+		r.decoder = nil
+	}
+	if r.stored == nil {
+		return nil
+	}
+
+	err := r.stored.file.Close()
+	r.stored = nil
+
+	return err
+}
+
+// Close releases the file, and makes a Read blocked in another goroutine
+// return
+func (r *streamReader) Close() error {
+	r.progress.lock.Lock()
+	wasClosed := r.closed
+	r.closed = true
+	err := r.closeFile()
+	r.progress.lock.Unlock()
+
+	r.progress.cond.Broadcast()
+
+	if !wasClosed {
+		r.cache.unpin(r.record.GetUniqueName())
+	}
+
+	return err
+}
+
+// OpenStream opens a file for reading like Open, but on a miss it returns as
+// soon as the download has started, and reads follow the data as it is written
+// to disk, blocking until more arrives. Readers joining a download in progress
+// follow the same file, and download errors are returned by Read to all of
+// them. ctx only bounds the wait for the download to start. The caller must
+// Close the returned reader. With Validators, files can't be read before they
+// are validated, so OpenStream behaves like Open.
+func (c *FileCache) OpenStream(ctx context.Context, dr *DownloadRecord) (io.ReadCloser, error) {
+	if c.Contains(dr) || len(c.checks) > 0 {
+		return c.Open(ctx, dr)
+	}
+
+	// Held until the reader is closed, so the file can still be read if it
+	// isn't admitted to the cache
+	key := dr.GetUniqueName()
+	c.pin(key)
+
+	following := make(chan *downloadProgress, 1)
+	finished := make(chan error, 1)
+	go func() {
+		c.recordAccess(dr)
+		_, err := c.fetch(dr, false, following)
+		finished <- err
+	}()
+
+	select {
+	case progress := <-following:
+		return c.newStreamReader(dr, progress), nil
+	case err := <-finished:
+		select {
+		case progress := <-following:
+			return c.newStreamReader(dr, progress), nil
+		default:
+		}
+		defer c.unpin(key)
+		if err != nil {
+			return nil, err
+		}
+		// It was cached by the time we got there
+		return c.Open(ctx, dr)
+	case <-ctx.Done():
+		go func() {
+			<-finished
+			c.unpin(key)
+		}()
+		return nil, ctx.Err()
+	}
+}
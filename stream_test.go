@@ -0,0 +1,192 @@
+package filecache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("OpenStream", func() {
+	var (
+		cache     *FileCache
+		baseDir   string
+		chunks    chan string
+		failure   error
+		downloads int32
+		dr        *DownloadRecord
+	)
+
+	BeforeEach(func() {
+		var err error
+		baseDir, err = ioutil.TempDir("", "filecache-stream")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		chunks = make(chan string)
+		failure = nil
+		atomic.StoreInt32(&downloads, 0)
+		dr = &DownloadRecord{Manager: DownloadMangerDropbox, Path: "weathertop/amon-sul.pdf"}
+
+		cache, err = New(10, baseDir)
+		Expect(err).ShouldNot(HaveOccurred())
+		stubDownloads(cache, func(dr *DownloadRecord, localFile *os.File) error {
+			atomic.AddInt32(&downloads, 1)
+			writer := dr.progress.writer(localFile)
+			for chunk := range chunks {
+				if _, err := writer.Write([]byte(chunk)); err != nil {
+					return err
+				}
+			}
+			return failure
+		})
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(baseDir)
+	})
+
+	// readChunk reads exactly len(expected) bytes
+	readChunk := func(reader io.Reader, expected string) {
+		buf := make([]byte, len(expected))
+		_, err := io.ReadFull(reader, buf)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(string(buf)).To(Equal(expected))
+	}
+
+	It("reads the file while it is being downloaded", func() {
+		reader, err := cache.OpenStream(context.Background(), dr)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer reader.Close()
+
+		chunks <- "amon"
+		readChunk(reader, "amon")
+		Expect(cache.Contains(dr)).To(BeFalse())
+
+		chunks <- " sûl"
+		readChunk(reader, " sûl")
+		close(chunks)
+
+		rest, err := ioutil.ReadAll(reader)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(rest).To(BeEmpty())
+		Eventually(func() bool { return cache.Contains(dr) }).Should(BeTrue())
+	})
+
+	It("lets coalesced readers follow the same download", func() {
+		first, err := cache.OpenStream(context.Background(), dr)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer first.Close()
+
+		chunks <- "amon"
+		second, err := cache.OpenStream(context.Background(), dr)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer second.Close()
+
+		readChunk(second, "amon")
+		chunks <- " sûl"
+		close(chunks)
+
+		Expect(ioutil.ReadAll(first)).To(Equal([]byte("amon sûl")))
+		Expect(ioutil.ReadAll(second)).To(Equal([]byte(" sûl")))
+		Expect(atomic.LoadInt32(&downloads)).To(Equal(int32(1)))
+	})
+
+	It("reports download errors to every reader", func() {
+		failure = errors.New("connection reset")
+
+		first, err := cache.OpenStream(context.Background(), dr)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer first.Close()
+
+		chunks <- "amon"
+		second, err := cache.OpenStream(context.Background(), dr)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer second.Close()
+		close(chunks)
+
+		_, err = ioutil.ReadAll(first)
+		Expect(err).To(Equal(failure))
+		_, err = ioutil.ReadAll(second)
+		Expect(err).To(Equal(failure))
+		Expect(cache.Contains(dr)).To(BeFalse())
+	})
+
+	It("reads files which are already cached", func() {
+		go func() {
+			chunks <- "amon sûl"
+			close(chunks)
+		}()
+		Expect(cache.Fetch(dr)).To(BeTrue())
+
+		reader, err := cache.OpenStream(context.Background(), dr)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer reader.Close()
+
+		Expect(ioutil.ReadAll(reader)).To(Equal([]byte("amon sûl")))
+	})
+
+	It("unblocks reads when closed", func() {
+		reader, err := cache.OpenStream(context.Background(), dr)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		result := make(chan error, 1)
+		go func() {
+			_, err := reader.Read(make([]byte, 4))
+			result <- err
+		}()
+
+		Expect(reader.Close()).To(Succeed())
+		Eventually(result).Should(Receive(Equal(io.ErrClosedPipe)))
+		close(chunks)
+		Eventually(func() bool { return cache.Contains(dr) }).Should(BeTrue())
+	})
+
+	It("lets go of the file when cancelled while an upload is in progress", func() {
+		uploading := make(chan struct{})
+		failUpload := make(chan struct{})
+		cache.uploaders[DownloadMangerDropbox] = func(ctx context.Context, dr *DownloadRecord, body io.ReadSeeker) error {
+			close(uploading)
+			<-failUpload
+			return errors.New("access denied")
+		}
+
+		uploaded := make(chan error, 1)
+		go func() { uploaded <- cache.Put(context.Background(), dr, strings.NewReader("amon sûl")) }()
+		<-uploading
+
+		ctx, cancel := context.WithCancel(context.Background())
+		opened := make(chan error, 1)
+		go func() {
+			_, err := cache.OpenStream(ctx, dr)
+			opened <- err
+		}()
+		Eventually(func() bool { return cache.isPinned(dr.GetUniqueName()) }).Should(BeTrue())
+		cancel()
+		Eventually(opened).Should(Receive(Equal(context.Canceled)))
+
+		// The upload failed, so the waiting fetch downloads the file instead
+		close(failUpload)
+		Eventually(uploaded).Should(Receive(HaveOccurred()))
+		chunks <- "amon sûl"
+		close(chunks)
+
+		Eventually(func() bool { return cache.Contains(dr) }).Should(BeTrue())
+		Eventually(func() bool { return cache.isPinned(dr.GetUniqueName()) }).Should(BeFalse())
+	})
+
+	It("waits for gaps in out of order writes to be filled", func() {
+		progress := newDownloadProgress(nil)
+		progress.start("/tmp/somewhere")
+
+		progress.wrote(4, 4)
+		Expect(progress.available).To(Equal(int64(0)))
+		progress.wrote(0, 4)
+		Expect(progress.available).To(Equal(int64(8)))
+	})
+})
@@ -0,0 +1,118 @@
+package filecache
+
+import (
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultTTL sets how long files stay valid in the cache. Expired files are
+// treated as misses and downloaded again. Records can override it with their
+// own TTL. Without a TTL, files stay until they are evicted.
+func DefaultTTL(ttl time.Duration) option {
+	return func(c *FileCache) error {
+		if ttl < 0 {
+			return errors.New("negative TTL")
+		}
+
+		c.defaultTTL = ttl
+
+		return nil
+	}
+}
+
+// ExpiryJanitor starts a background goroutine which removes expired files from
+// the cache, and from disk, every interval. It is stopped by Close().
+func ExpiryJanitor(interval time.Duration) option {
+	return func(c *FileCache) error {
+		if interval <= 0 {
+			return errors.New("janitor interval must be positive")
+		}
+
+		c.janitorInterval = interval
+
+		return nil
+	}
+}
+
+// Clock replaces the function used to tell the time when expiring entries.
+// Mostly useful for tests.
+func Clock(now func() time.Time) option {
+	return func(c *FileCache) error {
+		if now == nil {
+			return errors.New("nil clock")
+		}
+
+		c.now = now
+
+		return nil
+	}
+}
+
+// ttl returns the TTL which applies to a record
+func (c *FileCache) ttl(dr *DownloadRecord) time.Duration {
+	if dr.TTL > 0 {
+		return dr.TTL
+	}
+
+	return c.defaultTTL
+}
+
+// isExpired reports whether the entry for key has outlived its TTL. Entries we
+// know nothing about never expire.
+func (c *FileCache) isExpired(key string) bool {
+	c.entriesLock.RLock()
+	entry, ok := c.entries[key]
+	c.entriesLock.RUnlock()
+
+	return ok && !entry.expiresAt.IsZero() && !c.now().Before(entry.expiresAt)
+}
+
+// RemoveExpired removes all the expired files from the cache, deleting them
+// from disk via the usual eviction path. Returns how many were removed.
+func (c *FileCache) RemoveExpired() int {
+	var expired []string
+
+	now := c.now()
+	c.entriesLock.RLock()
+	for key, entry := range c.entries {
+		if !entry.expiresAt.IsZero() && !now.Before(entry.expiresAt) {
+			expired = append(expired, key)
+		}
+	}
+	c.entriesLock.RUnlock()
+
+	var removed int
+	for _, key := range expired {
+		// It may have been downloaded again in the meantime
+		if !c.isExpired(key) {
+			continue
+		}
+
+		log.Debugf("Removing expired entry '%s'", key)
+		if c.evictUnlessVetoed(key, EvictionExpired) && !c.Cache.Contains(key) {
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// runJanitor calls RemoveExpired every interval until the cache is closed
+func (c *FileCache) runJanitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if removed := c.RemoveExpired(); removed > 0 {
+				log.Debugf("Janitor removed %d expired entries", removed)
+			}
+			c.sweepRejections()
+		case <-c.done:
+			return
+		}
+	}
+}
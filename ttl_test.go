@@ -0,0 +1,145 @@
+package filecache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TTL", func() {
+	var (
+		cache         *FileCache
+		now           time.Time
+		clockLock     sync.Mutex
+		downloadCount int
+		notModified   bool
+		dr            *DownloadRecord
+	)
+
+	clock := func() time.Time {
+		clockLock.Lock()
+		defer clockLock.Unlock()
+		return now
+	}
+
+	advance := func(d time.Duration) {
+		clockLock.Lock()
+		now = now.Add(d)
+		clockLock.Unlock()
+	}
+
+	BeforeEach(func() {
+		now = time.Date(2018, time.October, 1, 12, 0, 0, 0, time.UTC)
+		downloadCount = 0
+		notModified = false
+
+		var err error
+		cache, err = New(10, os.TempDir(), DefaultTTL(time.Hour), Clock(clock))
+		Expect(err).ShouldNot(HaveOccurred())
+
+		cache.DownloadFunc = func(dr *DownloadRecord, localPath string) error {
+			if dr.Validators != nil && notModified {
+				return ErrNotModified
+			}
+			downloadCount++
+			dr.Info = &ObjectInfo{ETag: `"pippin"`}
+			Expect(os.MkdirAll(filepath.Dir(localPath), 0755)).To(Succeed())
+			return ioutil.WriteFile(localPath, []byte("second breakfast"), 0644)
+		}
+
+		dr = &DownloadRecord{Path: "shire/pippin.pdf"}
+	})
+
+	AfterEach(func() {
+		cache.Close()
+		os.Remove(cache.GetFileName(dr))
+	})
+
+	It("rejects negative TTLs", func() {
+		_, err := New(10, ".", DefaultTTL(-time.Second))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("treats expired entries as misses", func() {
+		Expect(cache.Fetch(dr)).To(BeTrue())
+		Expect(cache.Contains(dr)).To(BeTrue())
+
+		advance(59 * time.Minute)
+		Expect(cache.Contains(dr)).To(BeTrue())
+
+		advance(time.Minute)
+		Expect(cache.Contains(dr)).To(BeFalse())
+
+		Expect(cache.Fetch(dr)).To(BeTrue())
+		Expect(downloadCount).To(Equal(2))
+		Expect(cache.Contains(dr)).To(BeTrue())
+	})
+
+	It("revalidates expired entries when it can", func() {
+		Expect(cache.Fetch(dr)).To(BeTrue())
+
+		advance(2 * time.Hour)
+		notModified = true
+
+		Expect(cache.Fetch(dr)).To(BeTrue())
+		Expect(downloadCount).To(Equal(1))
+		Expect(cache.Contains(dr)).To(BeTrue())
+	})
+
+	It("lets records override the default TTL", func() {
+		dr.TTL = 5 * time.Minute
+		Expect(cache.Fetch(dr)).To(BeTrue())
+
+		advance(5 * time.Minute)
+		Expect(cache.Contains(dr)).To(BeFalse())
+	})
+
+	It("never expires entries without a TTL", func() {
+		cache.defaultTTL = 0
+		Expect(cache.Fetch(dr)).To(BeTrue())
+
+		advance(365 * 24 * time.Hour)
+		Expect(cache.Contains(dr)).To(BeTrue())
+	})
+
+	Describe("RemoveExpired()", func() {
+		It("deletes expired files from the cache and disk", func() {
+			fresh := &DownloadRecord{Path: "shire/merry.pdf", TTL: 3 * time.Hour}
+			defer os.Remove(cache.GetFileName(fresh))
+
+			Expect(cache.Fetch(dr)).To(BeTrue())
+			Expect(cache.Fetch(fresh)).To(BeTrue())
+
+			advance(2 * time.Hour)
+			Expect(cache.RemoveExpired()).To(Equal(1))
+
+			Expect(cache.Cache.Contains(dr.GetUniqueName())).To(BeFalse())
+			_, err := os.Stat(cache.GetFileName(dr))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			Expect(cache.Contains(fresh)).To(BeTrue())
+		})
+	})
+
+	Describe("ExpiryJanitor()", func() {
+		It("removes expired entries in the background", func() {
+			var err error
+			cache, err = New(10, os.TempDir(), DefaultTTL(time.Hour), Clock(clock), ExpiryJanitor(time.Millisecond))
+			Expect(err).ShouldNot(HaveOccurred())
+			cache.DownloadFunc = func(dr *DownloadRecord, localPath string) error {
+				Expect(os.MkdirAll(filepath.Dir(localPath), 0755)).To(Succeed())
+				return ioutil.WriteFile(localPath, []byte("second breakfast"), 0644)
+			}
+
+			Expect(cache.Fetch(dr)).To(BeTrue())
+			advance(2 * time.Hour)
+
+			Eventually(func() int { return cache.Cache.Len() }).Should(Equal(0))
+		})
+	})
+})
@@ -0,0 +1,286 @@
+package filecache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Validator checks a downloaded file before it is published to the cache. An
+// error rejects the file.
+type Validator interface {
+	Validate(dr *DownloadRecord, file *os.File) error
+}
+
+// ValidatorFunc lets a plain function be used as a Validator
+type ValidatorFunc func(dr *DownloadRecord, file *os.File) error
+
+// Validate calls f(dr, file)
+func (f ValidatorFunc) Validate(dr *DownloadRecord, file *os.File) error {
+	return f(dr, file)
+}
+
+// Scanner looks for malware in files, usually by handing them to an external
+// service or daemon
+type Scanner interface {
+	// Scan returns the name of the threat found in the file at path, or an
+	// empty string if it is clean
+	Scan(ctx context.Context, path string) (threat string, err error)
+}
+
+// ValidationError is returned when a downloaded file is rejected by one of the
+// Validators. The file is never published to the cache.
+type ValidationError struct {
+	Path string
+	Err  error
+	// Quarantined is where the file was moved to, empty if it was deleted
+	Quarantined string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("validation failed for %s: %s", e.Path, e.Err)
+}
+
+// rejection is a negatively cached ValidationError
+type rejection struct {
+	err   *ValidationError
+	until time.Time
+}
+
+// Validators runs validators, in order, over every downloaded file before it
+// is published to the cache, and over the contents given to Put before they
+// are uploaded. The first to fail rejects the file, which is deleted, or moved
+// aside with Quarantine, and the fetch fails with a *ValidationError. Since
+// files must be complete to be validated, OpenStream waits for downloads to
+// finish like Open does. Files written by a custom DownloadFunc can only be
+// validated once they are in place, so a rejected one also drops the copy it
+// replaced.
+func Validators(validators ...Validator) option {
+	return func(c *FileCache) error {
+		for _, validator := range validators {
+			if validator == nil {
+				return errors.New("nil validator")
+			}
+		}
+
+		c.checks = append(c.checks, validators...)
+
+		return nil
+	}
+}
+
+// Quarantine moves files rejected by the Validators to dir, for inspection,
+// instead of deleting them. It should be on the same filesystem as the cache.
+func Quarantine(dir string) option {
+	return func(c *FileCache) error {
+		if dir == "" {
+			return errors.New("empty quarantine directory")
+		}
+
+		c.quarantineDir = dir
+
+		return nil
+	}
+}
+
+// RejectionTTL remembers files rejected by the Validators for ttl, failing
+// fetches of them straight away with the same error instead of downloading
+// them again. Copies which were cached before are still served. Expired
+// rejections are forgotten as new ones come in, and by the ExpiryJanitor.
+func RejectionTTL(ttl time.Duration) option {
+	return func(c *FileCache) error {
+		if ttl < 0 {
+			return errors.New("negative rejection TTL")
+		}
+
+		c.rejectionTTL = ttl
+
+		return nil
+	}
+}
+
+// RequireMagic returns a Validator accepting only files which start with one
+// of signatures, e.g. "%PDF-" for PDFs
+func RequireMagic(signatures ...string) Validator {
+	longest := 0
+	for _, signature := range signatures {
+		if len(signature) > longest {
+			longest = len(signature)
+		}
+	}
+
+	return ValidatorFunc(func(dr *DownloadRecord, file *os.File) error {
+		head := make([]byte, longest)
+		n, err := file.ReadAt(head, 0)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("could not read file signature: %s", err)
+		}
+
+		for _, signature := range signatures {
+			if bytes.HasPrefix(head[:n], []byte(signature)) {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("unexpected file signature %q", head[:n])
+	})
+}
+
+// MaxFileSize returns a Validator rejecting files larger than size bytes
+func MaxFileSize(size int64) Validator {
+	return ValidatorFunc(func(dr *DownloadRecord, file *os.File) error {
+		info, err := file.Stat()
+		if err != nil {
+			return fmt.Errorf("could not stat file: %s", err)
+		}
+
+		if info.Size() > size {
+			return fmt.Errorf("file is %d bytes, more than the limit of %d", info.Size(), size)
+		}
+
+		return nil
+	})
+}
+
+// ScanWith returns a Validator rejecting files in which scanner finds a
+// threat. Files which can't be scanned are rejected too.
+func ScanWith(scanner Scanner) Validator {
+	return ValidatorFunc(func(dr *DownloadRecord, file *os.File) error {
+		threat, err := scanner.Scan(context.Background(), file.Name())
+		if err != nil {
+			return fmt.Errorf("could not scan file: %s", err)
+		}
+
+		if threat != "" {
+			return fmt.Errorf("found %s", threat)
+		}
+
+		return nil
+	})
+}
+
+// validate runs the Validators over a downloaded file. A rejected file is
+// quarantined, if configured, and left for the caller to delete otherwise.
+func (c *FileCache) validate(dr *DownloadRecord, file *os.File) error {
+	for _, validator := range c.checks {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("could not rewind %s to validate it: %s", dr.Path, err)
+		}
+
+		err := validator.Validate(dr, file)
+		if err == nil {
+			continue
+		}
+
+		log.Warnf("Rejecting %s: %s", dr.Path, err)
+		return &ValidationError{Path: dr.Path, Err: err, Quarantined: c.quarantine(dr, file)}
+	}
+
+	return nil
+}
+
+// validateStored checks the size of a file which a custom DownloadFunc wrote
+// in place, and runs the Validators over it. A rejected file is taken out of
+// the cache, and deleted by the fetch once it is done.
+func (c *FileCache) validateStored(dr *DownloadRecord, storagePath string) error {
+	if c.sizes == nil && len(c.checks) == 0 {
+		return nil
+	}
+
+	file, err := os.Open(storagePath)
+	if err != nil {
+		return fmt.Errorf("could not open %s to validate it: %s", dr.Path, err)
+	}
+	defer file.Close()
+
+	err = c.checkSize(dr, file)
+	if err == nil {
+		err = c.validate(dr, file)
+	}
+	if err != nil {
+		c.removeWithReason(dr.GetUniqueName(), EvictionRemoved)
+	}
+
+	return err
+}
+
+// quarantine moves a rejected file into the quarantine directory, and returns
+// where it went, or an empty string if it wasn't moved
+func (c *FileCache) quarantine(dr *DownloadRecord, file *os.File) string {
+	if c.quarantineDir == "" {
+		return ""
+	}
+
+	err := os.MkdirAll(c.quarantineDir, 0755)
+	if err != nil {
+		log.Warnf("Unable to create quarantine directory '%s': %s", c.quarantineDir, err)
+		return ""
+	}
+
+	quarantined := filepath.Join(c.quarantineDir, filepath.Base(file.Name()))
+	err = os.Rename(file.Name(), quarantined)
+	if err != nil {
+		log.Warnf("Unable to quarantine %s, deleting it: %s", dr.Path, err)
+		return ""
+	}
+
+	return quarantined
+}
+
+// pastRejection returns the remembered rejection of a record, if it hasn't expired.
+// Must be called with WaitLock held.
+func (c *FileCache) pastRejection(dr *DownloadRecord) *ValidationError {
+	rejected, ok := c.rejections[dr.GetUniqueName()]
+	if !ok {
+		return nil
+	}
+
+	if !c.now().Before(rejected.until) {
+		delete(c.rejections, dr.GetUniqueName())
+		return nil
+	}
+
+	return rejected.err
+}
+
+// rememberRejection negatively caches a rejected download, if RejectionTTL is
+// set
+func (c *FileCache) rememberRejection(dr *DownloadRecord, err error) {
+	validationErr, ok := err.(*ValidationError)
+	if !ok || c.rejectionTTL == 0 {
+		return
+	}
+
+	now := c.now()
+	c.WaitLock.Lock()
+	c.rejections[dr.GetUniqueName()] = rejection{err: validationErr, until: now.Add(c.rejectionTTL)}
+	// Once per TTL is enough to keep the rejections from piling up
+	sweep := !now.Before(c.rejectionsSwept.Add(c.rejectionTTL))
+	c.WaitLock.Unlock()
+
+	if sweep {
+		c.sweepRejections()
+	}
+}
+
+// sweepRejections forgets the rejections which have expired
+func (c *FileCache) sweepRejections() {
+	now := c.now()
+
+	c.WaitLock.Lock()
+	defer c.WaitLock.Unlock()
+
+	for key, rejected := range c.rejections {
+		if !now.Before(rejected.until) {
+			delete(c.rejections, key)
+		}
+	}
+	c.rejectionsSwept = now
+}
@@ -0,0 +1,243 @@
+package filecache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// testScanner flags files containing the EICAR test string
+type testScanner struct {
+	scanned int
+	err     error
+}
+
+func (s *testScanner) Scan(ctx context.Context, path string) (string, error) {
+	s.scanned++
+	if s.err != nil {
+		return "", s.err
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if string(contents) == "EICAR" {
+		return "Eicar-Test-Signature", nil
+	}
+	return "", nil
+}
+
+var _ = Describe("Validators", func() {
+	var (
+		cache     *FileCache
+		baseDir   string
+		contents  map[string]string
+		downloads int
+		scanner   *testScanner
+		now       time.Time
+	)
+
+	newCache := func(opts ...option) {
+		var err error
+		cache, err = New(10, baseDir, append([]option{Clock(func() time.Time { return now })}, opts...)...)
+		Expect(err).ShouldNot(HaveOccurred())
+		stubDownloads(cache, func(dr *DownloadRecord, localFile *os.File) error {
+			downloads++
+			_, err := localFile.WriteString(contents[dr.Path])
+			return err
+		})
+	}
+
+	BeforeEach(func() {
+		var err error
+		baseDir, err = ioutil.TempDir("", "filecache-validate")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		contents = map[string]string{
+			"mordor/report.pdf": "%PDF-1.7 one does not simply walk into Mordor",
+			"mordor/fake.pdf":   "<html>not a PDF</html>",
+			"mordor/virus.pdf":  "EICAR",
+		}
+		downloads = 0
+		scanner = &testScanner{}
+		now = time.Now()
+
+		newCache(Validators(RequireMagic("%PDF-"), MaxFileSize(64), ScanWith(scanner)))
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(baseDir)
+	})
+
+	It("publishes files which pass every validator", func() {
+		dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "mordor/report.pdf"}
+		Expect(cache.Fetch(dr)).To(BeTrue())
+
+		Expect(scanner.scanned).To(Equal(1))
+		Expect(ioutil.ReadFile(cache.GetFileName(dr))).To(BeEquivalentTo(contents["mordor/report.pdf"]))
+	})
+
+	It("rejects files with the wrong signature", func() {
+		dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "mordor/fake.pdf"}
+		_, err := cache.Pin(dr, 0)
+		Expect(err).To(HaveOccurred())
+
+		validationErr, ok := err.(*ValidationError)
+		Expect(ok).To(BeTrue())
+		Expect(validationErr.Path).To(Equal("mordor/fake.pdf"))
+		Expect(validationErr.Err).To(MatchError(ContainSubstring("signature")))
+		Expect(validationErr.Quarantined).To(BeEmpty())
+
+		Expect(cache.Contains(dr)).To(BeFalse())
+		Expect(scanner.scanned).To(Equal(0))
+		matches, _ := filepath.Glob(filepath.Join(baseDir, "*", "*"))
+		Expect(matches).To(BeEmpty())
+	})
+
+	It("rejects files which are too large", func() {
+		contents["mordor/report.pdf"] = "%PDF-" + string(make([]byte, 64))
+		Expect(cache.Fetch(&DownloadRecord{Manager: DownloadMangerDropbox, Path: "mordor/report.pdf"})).To(BeFalse())
+	})
+
+	It("rejects files in which the scanner finds a threat", func() {
+		contents["mordor/virus.pdf"] = "EICAR"
+		newCache(Validators(ScanWith(scanner)))
+
+		_, err := cache.Pin(&DownloadRecord{Manager: DownloadMangerDropbox, Path: "mordor/virus.pdf"}, 0)
+		Expect(err).To(MatchError(ContainSubstring("Eicar-Test-Signature")))
+	})
+
+	It("rejects files which can't be scanned", func() {
+		scanner.err = errors.New("scanner unavailable")
+		Expect(cache.Fetch(&DownloadRecord{Manager: DownloadMangerDropbox, Path: "mordor/report.pdf"})).To(BeFalse())
+	})
+
+	It("quarantines rejected files", func() {
+		quarantine := filepath.Join(baseDir, "quarantine")
+		newCache(Validators(RequireMagic("%PDF-")), Quarantine(quarantine))
+
+		_, err := cache.Pin(&DownloadRecord{Manager: DownloadMangerDropbox, Path: "mordor/fake.pdf"}, 0)
+		validationErr, ok := err.(*ValidationError)
+		Expect(ok).To(BeTrue())
+		Expect(filepath.Dir(validationErr.Quarantined)).To(Equal(quarantine))
+		Expect(ioutil.ReadFile(validationErr.Quarantined)).To(BeEquivalentTo("<html>not a PDF</html>"))
+	})
+
+	It("remembers rejections for the rejection TTL", func() {
+		newCache(Validators(RequireMagic("%PDF-")), RejectionTTL(time.Minute))
+		dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "mordor/fake.pdf"}
+
+		_, first := cache.Pin(dr, 0)
+		Expect(first).To(HaveOccurred())
+		_, second := cache.Pin(dr, 0)
+		Expect(second).To(BeIdenticalTo(first))
+		Expect(downloads).To(Equal(1))
+
+		now = now.Add(time.Minute)
+		contents["mordor/fake.pdf"] = "%PDF-1.7 fixed"
+		Expect(cache.Fetch(dr)).To(BeTrue())
+		Expect(downloads).To(Equal(2))
+	})
+
+	It("hands the rejection to callers who waited on the download", func() {
+		entered := make(chan struct{})
+		release := make(chan struct{})
+		var calls int32
+		newCache(Validators(ValidatorFunc(func(dr *DownloadRecord, file *os.File) error {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				close(entered)
+				<-release
+			}
+			return errors.New("not today")
+		})))
+		dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "mordor/fake.pdf"}
+
+		errs := make(chan error, 2)
+		go func() {
+			_, err := cache.Pin(dr, 0)
+			errs <- err
+		}()
+		Eventually(entered).Should(BeClosed())
+		go func() {
+			_, err := cache.Pin(dr, 0)
+			errs <- err
+		}()
+		Consistently(errs, 50*time.Millisecond).ShouldNot(Receive())
+
+		close(release)
+		for i := 0; i < 2; i++ {
+			var err error
+			Eventually(errs).Should(Receive(&err))
+			Expect(err).To(BeAssignableToTypeOf(&ValidationError{}))
+		}
+		Expect(downloads).To(Equal(1))
+	})
+
+	It("validates files written by a custom DownloadFunc", func() {
+		cache.DownloadFunc = func(dr *DownloadRecord, localPath string) error {
+			Expect(os.MkdirAll(filepath.Dir(localPath), 0755)).To(Succeed())
+			return ioutil.WriteFile(localPath, []byte(contents[dr.Path]), 0644)
+		}
+		dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "mordor/report.pdf"}
+		Expect(cache.Fetch(dr)).To(BeTrue())
+
+		contents["mordor/report.pdf"] = "<html>not a PDF</html>"
+		err := cache.Revalidate(dr)
+		Expect(err).To(BeAssignableToTypeOf(&ValidationError{}))
+
+		Expect(cache.Contains(dr)).To(BeFalse())
+		Expect(cache.GetFileName(dr)).NotTo(BeAnExistingFile())
+	})
+
+	It("validates files before they are Put", func() {
+		var uploads int
+		cache.uploaders[DownloadMangerDropbox] = func(ctx context.Context, dr *DownloadRecord, body io.ReadSeeker) error {
+			uploads++
+			return nil
+		}
+		dr := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "mordor/fake.pdf"}
+
+		err := cache.Put(context.Background(), dr, strings.NewReader("<html>not a PDF</html>"))
+		Expect(err).To(BeAssignableToTypeOf(&ValidationError{}))
+		Expect(uploads).To(Equal(0))
+		Expect(cache.Contains(dr)).To(BeFalse())
+
+		Expect(cache.Put(context.Background(), dr, strings.NewReader("%PDF-1.7 fixed"))).To(Succeed())
+		Expect(uploads).To(Equal(1))
+		Expect(ioutil.ReadFile(cache.GetFileName(dr))).To(BeEquivalentTo("%PDF-1.7 fixed"))
+	})
+
+	It("forgets expired rejections", func() {
+		newCache(Validators(RequireMagic("%PDF-")), RejectionTTL(time.Minute))
+		fake := &DownloadRecord{Manager: DownloadMangerDropbox, Path: "mordor/fake.pdf"}
+		Expect(cache.Fetch(fake)).To(BeFalse())
+
+		now = now.Add(time.Minute)
+		Expect(cache.Fetch(&DownloadRecord{Manager: DownloadMangerDropbox, Path: "mordor/virus.pdf"})).To(BeFalse())
+
+		cache.WaitLock.Lock()
+		defer cache.WaitLock.Unlock()
+		Expect(cache.rejections).NotTo(HaveKey(fake.GetUniqueName()))
+		Expect(cache.rejections).To(HaveLen(1))
+	})
+
+	It("doesn't stream files before they are validated", func() {
+		reader, err := cache.OpenStream(context.Background(), &DownloadRecord{Manager: DownloadMangerDropbox, Path: "mordor/report.pdf"})
+		Expect(err).ShouldNot(HaveOccurred())
+		defer reader.Close()
+		Expect(scanner.scanned).To(Equal(1))
+
+		_, err = cache.OpenStream(context.Background(), &DownloadRecord{Manager: DownloadMangerDropbox, Path: "mordor/fake.pdf"})
+		Expect(err).To(BeAssignableToTypeOf(&ValidationError{}))
+	})
+})